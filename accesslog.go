@@ -0,0 +1,192 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// apiGatewayPromoted are the fields of API Gateway access logs promoted to
+// common names, by the keys the $context variables are usually logged as.
+// The first key present wins.
+var apiGatewayPromoted = []struct {
+	name string
+	keys []string
+}{
+	{"request_id", []string{"requestId", "request_id", "extendedRequestId"}},
+	{"status", []string{"status", "statusCode", "status_code"}},
+	{"latency_ms", []string{"responseLatency", "latency", "integrationLatency"}},
+	{"route", []string{"routeKey", "resourcePath", "resource", "route"}},
+	{"method", []string{"httpMethod", "method"}},
+	{"path", []string{"path"}},
+	{"source_ip", []string{"sourceIp", "ip", "source_ip"}},
+}
+
+// apiGatewayCLF is the Common Log Format suggested by the API Gateway
+// console, $context.identity.sourceIp $context.identity.caller
+// $context.identity.user [$context.requestTime] "$context.httpMethod
+// $context.resourcePath $context.protocol" $context.status
+// $context.responseLength $context.requestId
+var apiGatewayCLF = regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\] "(\S+) (\S+) (\S+)" (\d{3}) (\S+) (\S+)`)
+
+// apiGatewayPreset recognizes the access logs of API Gateway, in JSON or the
+// Common Log Format.
+type apiGatewayPreset struct{}
+
+func newAPIGatewayPreset(ServiceConfig) stage { return apiGatewayPreset{} }
+
+func (apiGatewayPreset) apply(event logEvent, out []logEvent) []logEvent {
+	fields := event.Fields
+	if fields == nil {
+		var ok bool
+		if fields, ok = parseJSONObject(event.Message); !ok {
+			if m := apiGatewayCLF.FindStringSubmatch(event.Message); m != nil {
+				event.Fields = map[string]any{
+					"source_ip":       m[1],
+					"request_time":    m[2],
+					"method":          m[3],
+					"route":           m[4],
+					"protocol":        m[5],
+					"status":          presetNumber(m[6]),
+					"response_length": presetNumber(m[7]),
+					"request_id":      m[8],
+				}
+			}
+			return append(out, event)
+		}
+	}
+	matched := false
+	for _, p := range apiGatewayPromoted {
+		for _, key := range p.keys {
+			value, ok := fields[key]
+			if !ok {
+				continue
+			}
+			// $context variables are logged as strings, "-" without a
+			// value
+			if s, ok := value.(string); ok {
+				if s == "-" {
+					break
+				}
+				if p.name == "status" || p.name == "latency_ms" {
+					value = presetNumber(s)
+				}
+			}
+			matched = matched || p.name == "request_id"
+			fields[p.name] = value
+			break
+		}
+	}
+	if matched {
+		event.Fields = fields
+	}
+	return append(out, event)
+}
+
+// albFields are the space separated fields of an ALB access log entry, in
+// order. Entries may have more at the end, which are ignored.
+var albFields = []string{
+	"type", "time", "elb", "client", "target",
+	"request_processing_time", "target_processing_time", "response_processing_time",
+	"status", "target_status", "received_bytes", "sent_bytes", "request",
+	"user_agent", "ssl_cipher", "ssl_protocol", "target_group_arn", "request_id",
+	"domain_name", "chosen_cert_arn", "matched_rule_priority", "request_creation_time",
+	"actions_executed", "redirect_url", "error_reason",
+}
+
+// albNumbers are the albFields stored as numbers.
+var albNumbers = map[string]bool{
+	"request_processing_time": true, "target_processing_time": true, "response_processing_time": true,
+	"status": true, "target_status": true, "received_bytes": true, "sent_bytes": true,
+	"matched_rule_priority": true,
+}
+
+var albType = regexp.MustCompile(`^(?:http|https|h2|grpcs|ws|wss) \d{4}-`)
+
+// albPreset parses the access log entries of Application Load Balancers. The
+// trace ID is the request_id, and latency_ms the time the load balancer and
+// the target took, unless it could not be reached; empty fields, written as "-", are left out.
+type albPreset struct{}
+
+func newALBPreset(ServiceConfig) stage { return albPreset{} }
+
+func (albPreset) apply(event logEvent, out []logEvent) []logEvent {
+	if event.Fields != nil || !albType.MatchString(event.Message) {
+		return append(out, event)
+	}
+	values := splitQuoted(strings.TrimRight(event.Message, "\n"))
+	if len(values) < 13 {
+		return append(out, event)
+	}
+	fields := make(map[string]any)
+	for i, name := range albFields {
+		if i == len(values) {
+			break
+		}
+		switch value := values[i]; {
+		case value == "-" || value == "":
+		case name == "client" || name == "target":
+			host, port, _ := strings.Cut(value, ":")
+			fields[name+"_ip"] = host
+			if port != "" {
+				fields[name+"_port"] = presetNumber(port)
+			}
+		case name == "request":
+			// "GET https://example.com:443/path?query HTTP/1.1"
+			parts := strings.Fields(value)
+			if len(parts) != 3 {
+				fields[name] = value
+				continue
+			}
+			fields["method"], fields["url"], fields["protocol"] = parts[0], parts[1], parts[2]
+			if u, err := url.Parse(parts[1]); err == nil {
+				fields["path"] = u.Path
+			}
+		case name == "request_id":
+			fields[name] = strings.TrimPrefix(value, "Root=")
+		case albNumbers[name]:
+			fields[name] = presetNumber(value)
+		default:
+			fields[name] = value
+		}
+	}
+	// the times are -1 if the target could not be reached
+	latency := 0.0
+	for _, value := range values[5:8] {
+		if value, err := strconv.ParseFloat(value, 64); err == nil && value >= 0 && latency >= 0 {
+			latency += value
+		} else {
+			latency = -1
+		}
+	}
+	if latency >= 0 {
+		fields["latency_ms"] = presetNumber(strconv.FormatFloat(math.Round(latency*1e6)/1e3, 'f', -1, 64))
+	}
+	event.Fields = fields
+	return append(out, event)
+}
+
+// splitQuoted splits an access log entry at spaces, except within double
+// quotes, which are removed.
+func splitQuoted(entry string) []string {
+	var values []string
+	for entry != "" {
+		var value string
+		if rest, ok := strings.CutPrefix(entry, `"`); ok {
+			end := strings.Index(rest, `"`)
+			if end < 0 {
+				end = len(rest)
+			}
+			value, entry = rest[:end], rest[min(end+1, len(rest)):]
+		} else if end := strings.IndexByte(entry, ' '); end >= 0 {
+			value, entry = entry[:end], entry[end:]
+		} else {
+			value, entry = entry, ""
+		}
+		values = append(values, value)
+		entry = strings.TrimPrefix(entry, " ")
+	}
+	return values
+}
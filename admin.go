@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"gopkg.in/yaml.v2"
+)
+
+// adminAPI lets platforms manage services at runtime. Changes are written to
+// the Consul services prefix rather than applied directly, so they survive
+// restarts, reach every instance watching the prefix and are applied by the
+// same watch as hand-written keys.
+type adminAPI struct {
+	sup    *supervisor
+	kv     *api.KV
+	prefix string
+	token  string
+}
+
+const maxAdminBodySize = 1 << 20
+
+func serveAdmin(addr string, a *adminAPI) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/config", a.auth(a.getConfig))
+	mux.HandleFunc("GET /admin/services", a.auth(a.listServices))
+	mux.HandleFunc("GET /admin/services/{name}", a.auth(a.getService))
+	mux.HandleFunc("PUT /admin/services/{name}", a.auth(a.putService))
+	mux.HandleFunc("DELETE /admin/services/{name}", a.auth(a.deleteService))
+	mux.HandleFunc("POST /admin/services/{name}/pause", a.auth(a.setPaused(true)))
+	mux.HandleFunc("POST /admin/services/{name}/resume", a.auth(a.setPaused(false)))
+	mux.HandleFunc("GET /admin/streams", a.auth(a.listStreams))
+	serverLog.Infof("Serving admin API on %s/admin", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		serverLog.Fatalf("admin server failed: %v", err)
+	}
+}
+
+func (a *adminAPI) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasBearerToken(r, a.token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func hasBearerToken(r *http.Request, want string) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+func (a *adminAPI) key(name string) string {
+	return strings.TrimSuffix(a.prefix, "/") + "/" + name
+}
+
+// getConfig returns the effective config the instance runs with, rendered
+// like "cwsync config show" renders a local file.
+func (a *adminAPI) getConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(a.sup.effectiveConfig())
+}
+
+func (a *adminAPI) listServices(w http.ResponseWriter, r *http.Request) {
+	services := a.sup.list()
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, s := range services {
+		state := "running"
+		if s.Paused {
+			state = "paused"
+		}
+		lag := "-"
+		if l, ok := serviceLag(s.Name); ok {
+			lag = l.Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Name, s.source, state, lag)
+	}
+}
+
+// listStreams returns the status of every tailed stream as JSON, only of
+// one service with ?service=<name>.
+func (a *adminAPI) listStreams(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(streamStatuses(r.URL.Query().Get("service")))
+}
+
+func (a *adminAPI) getService(w http.ResponseWriter, r *http.Request) {
+	service, _, ok := a.sup.lookup(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "no such service", http.StatusNotFound)
+		return
+	}
+	out, err := yaml.Marshal(redactService(service))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(out)
+}
+
+// putService creates or replaces a service. The body is the service in the
+// format of an entry of services, YAML or JSON; name may be omitted.
+func (a *adminAPI) putService(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !a.ownedByConsul(w, name) {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAdminBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(body, &doc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	doc = setMapKey(doc, "name", name)
+	stored, err := yaml.Marshal(doc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var service ServiceConfig
+	if err := yaml.UnmarshalStrict(stored, &service); err != nil {
+		http.Error(w, strings.Join(decodeErrors("service", false, err), "\n"), http.StatusBadRequest)
+		return
+	}
+	if errs := validateService("", service); len(errs) > 0 {
+		var msgs []string
+		for _, e := range errs {
+			msgs = append(msgs, e.format("service", nil))
+		}
+		http.Error(w, strings.Join(msgs, "\n"), http.StatusBadRequest)
+		return
+	}
+	key, ok := a.consulKey(name)
+	if !ok {
+		key = a.key(name)
+	}
+	if _, err := a.kv.Put(&api.KVPair{Key: key, Value: stored}, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	serverLog.Infof("Admin API stored service %s", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) deleteService(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !a.ownedByConsul(w, name) {
+		return
+	}
+	key, ok := a.consulKey(name)
+	if !ok {
+		http.Error(w, "no such service", http.StatusNotFound)
+		return
+	}
+	if _, err := a.kv.Delete(key, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	serverLog.Infof("Admin API removed service %s", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setPaused rewrites the paused key of a stored service, keeping the rest of
+// the stored document as it was.
+func (a *adminAPI) setPaused(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !a.ownedByConsul(w, name) {
+			return
+		}
+		key, ok := a.consulKey(name)
+		if !ok {
+			http.Error(w, "no such service", http.StatusNotFound)
+			return
+		}
+		pair, _, err := a.kv.Get(key, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if pair == nil {
+			http.Error(w, "no such service", http.StatusNotFound)
+			return
+		}
+		var doc yaml.MapSlice
+		if err := yaml.Unmarshal(pair.Value, &doc); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pair.Value, err = yaml.Marshal(setMapKey(doc, "paused", paused))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// check-and-set so a concurrent PUT is not overwritten
+		written, _, err := a.kv.CAS(pair, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if !written {
+			http.Error(w, "service changed concurrently, retry", http.StatusConflict)
+			return
+		}
+		serverLog.Infof("Admin API set paused=%t for service %s", paused, name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ownedByConsul rejects changes to services defined in the config file, which
+// the admin API cannot persist.
+func (a *adminAPI) ownedByConsul(w http.ResponseWriter, name string) bool {
+	if _, source, ok := a.sup.lookup(name); ok && source == serviceSourceFile {
+		http.Error(w, "service is defined in the config file", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// consulKey returns the key a Consul service was read from, which is not
+// necessarily prefix/name for keys written by hand.
+func (a *adminAPI) consulKey(name string) (string, bool) {
+	service, source, ok := a.sup.lookup(name)
+	if !ok || source != serviceSourceConsul {
+		return "", false
+	}
+	return service.origin, true
+}
+
+func setMapKey(doc yaml.MapSlice, key string, value any) yaml.MapSlice {
+	for i := range doc {
+		if doc[i].Key == key {
+			doc[i].Value = value
+			return doc
+		}
+	}
+	return append(doc, yaml.MapItem{Key: key, Value: value})
+}
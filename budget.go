@@ -0,0 +1,104 @@
+package main
+
+import "sync"
+
+const (
+	defaultMaxBufferedBytes = 256 << 20
+
+	metricBufferedBytes = "cwsync_buffered_bytes"
+)
+
+func init() {
+	metrics.describe(metricBufferedBytes, "gauge", "Bytes of log messages fetched but not yet written, across all services.")
+}
+
+// byteBudget caps the message bytes of events that were fetched but not yet
+// written, in pipelines and mergers of all services. Fetchers block in
+// acquire while the budget is used up and continue as the writers catch up.
+type byteBudget struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	max    int64
+	used   int64
+	paused bool
+	// full is closed while fetching is paused, so writers deliver their
+	// partial batches right away instead of waiting for batch_interval
+	full chan struct{}
+	// waiting counts the fetchers blocked in acquire by priority
+	waiting [numPriorities]int
+}
+
+var buffered = newByteBudget(defaultMaxBufferedBytes)
+
+func newByteBudget(max int64) *byteBudget {
+	if max <= 0 {
+		max = defaultMaxBufferedBytes
+	}
+	b := &byteBudget{max: max, full: make(chan struct{})}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire takes n bytes, waiting while they do not fit. Once the budget ran
+// full, fetching stays paused until half of it is free again, so it does not
+// flap around the limit. High priority services only wait while their bytes
+// do not fit, and nobody gets bytes while a higher priority is waiting. An
+// event larger than the whole budget is let through once nothing else is
+// buffered.
+func (b *byteBudget) acquire(n int64, priority int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.waiting[priority]++
+	for b.blocked(n, priority) {
+		if !b.paused && b.used+n > b.max {
+			b.paused = true
+			close(b.full)
+			pipelineLog.Infof("Buffered events reached max_buffered_bytes (%d bytes), pausing fetching until they are written", b.max)
+		}
+		b.cond.Wait()
+	}
+	b.waiting[priority]--
+	b.used += n
+	metrics.Set(metricBufferedBytes, float64(b.used))
+	// lower priorities may have been held back by this one
+	b.cond.Broadcast()
+}
+
+// blocked reports whether n bytes of the given priority have to wait. b.mu
+// must be held.
+func (b *byteBudget) blocked(n int64, priority int) bool {
+	for higher := 0; higher < priority; higher++ {
+		if b.waiting[higher] > 0 {
+			return true
+		}
+	}
+	if b.used == 0 {
+		return false
+	}
+	return b.used+n > b.max || (b.paused && priority != priorityHigh)
+}
+
+func (b *byteBudget) fullCh() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.full
+}
+
+func (b *byteBudget) usedBytes() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+func (b *byteBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	metrics.Set(metricBufferedBytes, float64(b.used))
+	if b.paused && b.used <= b.max/2 {
+		b.paused = false
+		b.full = make(chan struct{})
+		pipelineLog.Infof("Buffered events below half of max_buffered_bytes, resuming fetching")
+	}
+	b.cond.Broadcast()
+}
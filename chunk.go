@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
+const (
+	oversizedSplit    = "split"
+	oversizedTruncate = "truncate"
+
+	// every chunk of a split message but the last ends with
+	// chunkContinues, every one but the first starts with chunkContinued
+	chunkContinues = " [continued]"
+	chunkContinued = "[continued] "
+
+	// minMessageBytes leaves room for the markers and some text
+	minMessageBytes = 64
+
+	metricOversizedEvents = "cwsync_oversized_events_total"
+)
+
+func init() {
+	metrics.describe(metricOversizedEvents, "counter", "Events longer than max_message_bytes, by what was done with them.")
+}
+
+// fit appends event to out, split into chunks or truncated if its message
+// is longer than max_message_bytes. Chunks are cut at character boundaries
+// and only the first keeps the event's share of max_buffered_bytes.
+func (d Destination) fit(service string, event logEvent, out []logEvent) []logEvent {
+	max := d.MaxMessageBytes
+	if max <= 0 || len(event.Message) <= max {
+		return append(out, event)
+	}
+	// validateDestination rejects less, the markers have to fit
+	if max < minMessageBytes {
+		max = minMessageBytes
+	}
+	if d.Oversized == oversizedTruncate {
+		metrics.Add(metricOversizedEvents, 1, "service", service, "action", oversizedTruncate)
+		event.Message = truncateMessage(event.Message, max)
+		return append(out, event)
+	}
+	metrics.Add(metricOversizedEvents, 1, "service", service, "action", oversizedSplit)
+	rest := event.Message
+	chunk := event
+	for prefix := ""; ; prefix = chunkContinued {
+		if len(prefix)+len(rest) <= max {
+			chunk.Message = prefix + rest
+			return append(out, chunk)
+		}
+		cut := runeCut(rest, max-len(prefix)-len(chunkContinues))
+		chunk.Message = prefix + rest[:cut] + chunkContinues
+		out = append(out, chunk)
+		rest = rest[cut:]
+		chunk.buffered = 0
+	}
+}
+
+// truncateMessage cuts message to max bytes including a marker telling how
+// many bytes were cut, e.g. " [truncated 1234 bytes]". The marker is sized
+// for as many digits as the length of message has, which is enough for any
+// number of removed bytes.
+func truncateMessage(message string, max int) string {
+	marker := len(" [truncated  bytes]") + len(strconv.Itoa(len(message)))
+	cut := runeCut(message, max-marker)
+	return message[:cut] + " [truncated " + strconv.Itoa(len(message)-cut) + " bytes]"
+}
+
+// runeCut returns the largest length up to n that does not split a UTF-8
+// encoded character of s. Without a character start in that range, e.g. in
+// invalid UTF-8, which CloudWatch passes through, it cuts at n, and it never
+// returns less than 1, so splitting always makes progress.
+func runeCut(s string, n int) int {
+	n = max(n, 1)
+	if n >= len(s) {
+		return len(s)
+	}
+	for cut := n; cut > 0; cut-- {
+		if utf8.RuneStart(s[cut]) {
+			return cut
+		}
+	}
+	return n
+}
@@ -0,0 +1,72 @@
+package main
+
+import "time"
+
+// cloudTrailPromoted are the fields of a CloudTrail record promoted to the
+// top level, by their path in the record.
+var cloudTrailPromoted = []struct {
+	name string
+	path []string
+}{
+	{"event_time", []string{"eventTime"}},
+	{"event_source", []string{"eventSource"}},
+	{"event_name", []string{"eventName"}},
+	{"event_type", []string{"eventType"}},
+	{"event_id", []string{"eventID"}},
+	{"aws_region", []string{"awsRegion"}},
+	{"account_id", []string{"recipientAccountId"}},
+	{"source_ip", []string{"sourceIPAddress"}},
+	{"user_agent", []string{"userAgent"}},
+	{"user_type", []string{"userIdentity", "type"}},
+	{"user_arn", []string{"userIdentity", "arn"}},
+	{"access_key_id", []string{"userIdentity", "accessKeyId"}},
+	{"error_code", []string{"errorCode"}},
+	{"error_message", []string{"errorMessage"}},
+	{"read_only", []string{"readOnly"}},
+}
+
+// cloudTrailPreset unwraps CloudTrail events, delivered one per log event or
+// as a Records array as in S3, into one event per record. Each has the key
+// fields of the record at the top level and the whole record below
+// "record", and the record's eventTime as timestamp.
+type cloudTrailPreset struct{}
+
+func newCloudTrailPreset(ServiceConfig) stage { return cloudTrailPreset{} }
+
+func (cloudTrailPreset) apply(event logEvent, out []logEvent) []logEvent {
+	fields := event.Fields
+	if fields == nil {
+		var ok bool
+		if fields, ok = parseJSONObject(event.Message); !ok {
+			return append(out, event)
+		}
+	}
+	var records []any
+	if wrapped, ok := fields["Records"].([]any); ok {
+		records = wrapped
+	} else if _, ok := fields["eventName"]; ok {
+		records = []any{fields}
+	} else {
+		return append(out, event)
+	}
+	for _, r := range records {
+		record, ok := r.(map[string]any)
+		if !ok {
+			continue
+		}
+		e := event
+		e.Fields = map[string]any{"record": record}
+		for _, p := range cloudTrailPromoted {
+			if value, ok := lookupField(record, p.path); ok {
+				e.Fields[p.name] = value
+			}
+		}
+		if at, ok := record["eventTime"].(string); ok {
+			if t, err := time.Parse(time.RFC3339, at); err == nil {
+				e.Timestamp = t.UnixMilli()
+			}
+		}
+		out = append(out, e)
+	}
+	return out
+}
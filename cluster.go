@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	clusterModeShard = "shard"
+	clusterModeClaim = "claim"
+
+	defaultClusterKVPrefix  = "cwsync/cluster"
+	defaultClusterTTL       = 10 * time.Second
+	clusterLockDelay        = time.Second
+	clusterWatchErrorDelay  = 5 * time.Second
+	clusterMembersKeyPrefix = "members/"
+	clusterClaimsKeyPrefix  = "claims/"
+)
+
+type ClusterConfig struct {
+	Mode       string   `yaml:"mode"`
+	KVPrefix   string   `yaml:"kv_prefix"`
+	InstanceID string   `yaml:"instance_id"`
+	SessionTTL Duration `yaml:"session_ttl"`
+	// LeaderElect runs the instance as one of several where only the
+	// holder of the leader lock is active, see acquireLeadership
+	LeaderElect bool `yaml:"leader_elect"`
+}
+
+// cluster is this instance's membership among the replicas sharing a Consul
+// KV prefix. Membership is a key below <kv_prefix>/members held by a Consul
+// session: if the instance dies the session expires, Consul deletes the key
+// and the other replicas take over its streams.
+type cluster struct {
+	client *api.Client
+	prefix string
+	id     string
+	ttl    time.Duration
+	// claims makes the instance lock every stream before tailing it
+	claims bool
+
+	mu      sync.Mutex
+	session string
+	members []string
+	// changed is closed and replaced whenever the member list changes
+	changed chan struct{}
+	// lost is closed when the session expired, which released every
+	// claim, and replaced once the instance joined again
+	lost chan struct{}
+}
+
+// joinCluster registers the instance and starts keeping its membership
+// alive until ctx is cancelled. It returns nil if clustering is disabled.
+func joinCluster(ctx context.Context, client *api.Client, config ClusterConfig) (*cluster, error) {
+	if config.Mode == "" {
+		return nil, nil
+	}
+	c := &cluster{
+		client:  client,
+		prefix:  strings.Trim(config.KVPrefix, "/") + "/",
+		id:      config.InstanceID,
+		ttl:     time.Duration(config.SessionTTL),
+		claims:  config.Mode == clusterModeClaim,
+		changed: make(chan struct{}),
+		lost:    make(chan struct{}),
+	}
+	if c.prefix == "/" {
+		c.prefix = defaultClusterKVPrefix + "/"
+	}
+	if c.id == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("cluster.instance_id is not set and the hostname is unknown: %v", err)
+		}
+		c.id = hostname
+	}
+	if c.ttl <= 0 {
+		c.ttl = defaultClusterTTL
+	}
+	if err := c.register(ctx); err != nil {
+		return nil, err
+	}
+	index, err := c.loadMembers(ctx, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cluster members: %v", err)
+	}
+	clusterLog.Infof("Joined cluster at %s as %s, %d members", c.prefix, c.id, len(c.members))
+	go c.keepAlive(ctx)
+	go c.watchMembers(ctx, index)
+	return c, nil
+}
+
+// register creates a session and takes the instance's member key with it.
+func (c *cluster) register(ctx context.Context) error {
+	opts := (&api.WriteOptions{}).WithContext(ctx)
+	session, _, err := c.client.Session().CreateNoChecks(&api.SessionEntry{
+		Name:      "cwsync " + c.id,
+		TTL:       c.ttl.String(),
+		Behavior:  api.SessionBehaviorDelete,
+		LockDelay: clusterLockDelay,
+	}, opts)
+	if err != nil {
+		return fmt.Errorf("failed to create Consul session: %v", err)
+	}
+	acquired, _, err := c.client.KV().Acquire(&api.KVPair{
+		Key:     c.prefix + clusterMembersKeyPrefix + c.id,
+		Session: session,
+	}, opts)
+	if err == nil && !acquired {
+		err = fmt.Errorf("instance id %s is already in use by another instance", c.id)
+	}
+	if err != nil {
+		c.client.Session().Destroy(session, nil)
+		return err
+	}
+	c.mu.Lock()
+	c.session = session
+	c.mu.Unlock()
+	return nil
+}
+
+// keepAlive renews the session and joins again with a new one if it expired,
+// e.g. after a network partition. On shutdown the session is destroyed so the
+// other replicas take over right away instead of after the TTL.
+func (c *cluster) keepAlive(ctx context.Context) {
+	for {
+		c.mu.Lock()
+		session := c.session
+		c.mu.Unlock()
+		err := c.client.Session().RenewPeriodic(c.ttl.String(), session, (&api.WriteOptions{}).WithContext(ctx), nil)
+		if ctx.Err() != nil {
+			c.client.Session().Destroy(session, nil)
+			return
+		}
+		if err == nil {
+			err = api.ErrSessionExpired
+		}
+		clusterLog.Warnf("Lost cluster membership of %s: %v, joining again", c.id, err)
+		c.mu.Lock()
+		close(c.lost)
+		c.mu.Unlock()
+		for {
+			err := c.register(ctx)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			clusterLog.Errorf("Error joining cluster: %v", err)
+			sleepContext(ctx, clusterWatchErrorDelay)
+		}
+		c.mu.Lock()
+		c.lost = make(chan struct{})
+		c.mu.Unlock()
+	}
+}
+
+func (c *cluster) loadMembers(ctx context.Context, waitIndex uint64) (uint64, error) {
+	opts := (&api.QueryOptions{WaitIndex: waitIndex, WaitTime: consulWatchWait}).WithContext(ctx)
+	keys, meta, err := c.client.KV().Keys(c.prefix+clusterMembersKeyPrefix, "", opts)
+	if err != nil {
+		return waitIndex, err
+	}
+	members := make([]string, 0, len(keys))
+	for _, key := range keys {
+		members = append(members, strings.TrimPrefix(key, c.prefix+clusterMembersKeyPrefix))
+	}
+	slices.Sort(members)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !slices.Equal(members, c.members) {
+		if c.members != nil {
+			clusterLog.Infof("Cluster members changed: %s", strings.Join(members, ", "))
+		}
+		c.members = members
+		close(c.changed)
+		c.changed = make(chan struct{})
+	}
+	return meta.LastIndex, nil
+}
+
+func (c *cluster) watchMembers(ctx context.Context, index uint64) {
+	for ctx.Err() == nil {
+		newIndex, err := c.loadMembers(ctx, index)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, context.Canceled) {
+				clusterLog.Errorf("Error watching cluster members: %v", err)
+				sleepContext(ctx, clusterWatchErrorDelay)
+			}
+			continue
+		}
+		// the index can go backwards after a Consul snapshot restore
+		if newIndex < index {
+			newIndex = 0
+		}
+		index = newIndex
+	}
+}
+
+// memberChanges returns a channel that is closed on the next change of the
+// member list. A nil cluster never changes.
+func (c *cluster) memberChanges() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.changed
+}
+
+// sessionLoss returns a channel that is closed when the session expires and
+// with it every claim. A nil cluster never loses anything.
+func (c *cluster) sessionLoss() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lost
+}
+
+// claim locks key for this instance with its session, so no other replica
+// tails the same stream until it is released or the instance dies. It
+// reports false if another replica holds the lock, typically the previous
+// owner still stopping after a rebalance. Without claims it always succeeds.
+func (c *cluster) claim(key string) bool {
+	if c == nil || !c.claims {
+		return true
+	}
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	acquired, _, err := c.client.KV().Acquire(&api.KVPair{
+		Key:     c.prefix + clusterClaimsKeyPrefix + key,
+		Value:   []byte(c.id),
+		Session: session,
+	}, nil)
+	if err != nil {
+		clusterLog.Errorf("Error claiming %s: %v", key, err)
+		return false
+	}
+	if !acquired {
+		clusterLog.Debugf("%s is claimed by another cluster member", key)
+	}
+	return acquired
+}
+
+// release gives up a claim taken with claim.
+func (c *cluster) release(key string) {
+	if c == nil || !c.claims {
+		return
+	}
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	if _, _, err := c.client.KV().Release(&api.KVPair{Key: c.prefix + clusterClaimsKeyPrefix + key, Session: session}, nil); err != nil {
+		clusterLog.Errorf("Error releasing claim on %s: %v", key, err)
+	}
+}
+
+// owns reports whether this instance is responsible for key. Keys are
+// assigned by rendezvous hashing: every member scores the key and the
+// highest score wins, so a joining or leaving member only moves the keys it
+// gains or had. Without clustering every key is owned.
+func (c *cluster) owns(key string) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the instance keeps working while its member key is being recreated
+	best, bestScore := c.id, memberScore(c.id, key)
+	for _, member := range c.members {
+		if score := memberScore(member, key); score > bestScore || (score == bestScore && member < best) {
+			best, bestScore = member, score
+		}
+	}
+	return best == c.id
+}
+
+func memberScore(member, key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(member))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	// fnv alone barely spreads keys that differ in their last bytes
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
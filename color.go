@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+
+	ansiReset = "\x1b[0m"
+	ansiDim   = "\x1b[2m"
+)
+
+// levelColors are the ANSI colors of the messages of each of levelNames.
+// Info messages keep the terminal's color.
+var levelColors = []string{"\x1b[2m", "\x1b[36m", "", "\x1b[33m", "\x1b[31m", "\x1b[1;31m"}
+
+// colorOutput is whether events written to stdout are colorized, see
+// setColor.
+var colorOutput bool
+
+// setColor decides whether to colorize stdout: always, never, or with auto
+// if it is a terminal and NO_COLOR is not set.
+func setColor(mode string) error {
+	switch mode {
+	case "", colorAuto:
+		colorOutput = os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout)
+	case colorAlways:
+		colorOutput = true
+	case colorNever:
+		colorOutput = false
+	default:
+		return fmt.Errorf("invalid color %q, expected %s, %s or %s", mode, colorAuto, colorAlways, colorNever)
+	}
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// messageColor returns the color of an event by its level, detected here
+// for services that do not detect levels themselves.
+func messageColor(event *logEvent) string {
+	level, ok := parseLevel(event.Level)
+	if !ok {
+		level, ok = detectLevel(event.Message, defaultLevelFieldPattern)
+	}
+	if !ok {
+		return ""
+	}
+	return levelColors[level]
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const redacted = "<redacted>"
+
+// renderEffectiveConfig renders the config as it is run: env interpolated,
+// includes merged, profile and defaults applied. It is rendered before secret
+// references are resolved, and plain secret values are redacted, so the
+// output is safe to show.
+func renderEffectiveConfig(config Config) ([]byte, error) {
+	config.AWSSecretKey = redactSecret(config.AWSSecretKey)
+	config.Consul.Token = redactSecret(config.Consul.Token)
+	config.AdminToken = redactSecret(config.AdminToken)
+	config.PprofToken = redactSecret(config.PprofToken)
+	if u, err := url.Parse(config.ProxyURL); err == nil && u.User != nil {
+		config.ProxyURL = u.Redacted()
+	}
+	config.Profiles = nil
+	services := make([]ServiceConfig, len(config.Services))
+	for i, service := range config.Services {
+		services[i] = redactService(service)
+	}
+	config.Services = services
+
+	full, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(full, &doc); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(pruneUnset(doc))
+}
+
+// pruneUnset drops keys with zero values, which mean "default" everywhere in
+// the config, so the rendered config only shows what is actually set.
+func pruneUnset(value any) any {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		var out yaml.MapSlice
+		for _, item := range v {
+			if pruned := pruneUnset(item.Value); pruned != nil {
+				out = append(out, yaml.MapItem{Key: item.Key, Value: pruned})
+			}
+		}
+		if len(out) == 0 {
+			return nil
+		}
+		return out
+	case []any:
+		if len(v) == 0 {
+			return nil
+		}
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = pruneUnset(item)
+		}
+		return out
+	case string:
+		if v == "" || v == "0s" {
+			return nil
+		}
+	case bool:
+		if !v {
+			return nil
+		}
+	case int:
+		if v == 0 {
+			return nil
+		}
+	case float64:
+		if v == 0 {
+			return nil
+		}
+	}
+	return value
+}
+
+// redactService hides the secrets of a service, for the rendered config and
+// the admin API alike.
+func redactService(service ServiceConfig) ServiceConfig {
+	service.AWSSecretKey = redactSecret(service.AWSSecretKey)
+	return service
+}
+
+func redactSecret(value string) string {
+	if value == "" || isSecretRef(value) {
+		return value
+	}
+	return redacted
+}
+
+// runConfig dispatches "cwsync config show" and "cwsync config diff".
+func runConfig(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: cwsync config show|diff [flags]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("config "+args[0], flag.ExitOnError)
+	configPath := fs.String("config", configPathFromEnv(), "path to the config file")
+	profile := fs.String("config-profile", profileFromEnv(), "config profile to apply")
+	adminURL := fs.String("admin-url", "http://127.0.0.1:9091", "admin API of the running instance (diff only)")
+	adminToken := fs.String("admin-token", os.Getenv("CWSYNC_ADMIN_TOKEN"), "admin API token (env CWSYNC_ADMIN_TOKEN)")
+	fs.Parse(args[1:])
+
+	config, _, err := readConfig(*configPath, *profile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		os.Exit(2)
+	}
+	local, err := renderEffectiveConfig(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to render config: %v\n", err)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "show":
+		os.Stdout.Write(local)
+	case "diff":
+		running, err := fetchRunningConfig(*adminURL, *adminToken)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to fetch the running config: %v\n", err)
+			os.Exit(2)
+		}
+		diff := unifiedDiff("running", *configPath, string(running), string(local))
+		if diff == "" {
+			fmt.Println("no changes")
+			return
+		}
+		fmt.Print(diff)
+		os.Exit(1)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown config command %q\n", args[0])
+		os.Exit(2)
+	}
+}
+
+func fetchRunningConfig(adminURL, token string) ([]byte, error) {
+	return fetchAdmin(adminURL, token, "/admin/config")
+}
+
+// fetchAdmin GETs path from the admin API of a running instance.
+func fetchAdmin(adminURL, token, path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(adminURL, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+const diffContext = 3
+
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// unifiedDiff returns a unified diff of two texts, or "" if they are equal.
+// Configs are small, so a plain LCS table is good enough.
+func unifiedDiff(fromName, toName, from, to string) string {
+	a := splitLines(from)
+	b := splitLines(to)
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	type op struct {
+		kind byte
+		line string
+		ai   int
+		bi   int
+	}
+	var ops []op
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, op{' ', a[i], i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, op{'-', a[i], i, j})
+			i++
+		default:
+			ops = append(ops, op{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	var out strings.Builder
+	for k := 0; k < len(ops); {
+		if ops[k].kind == ' ' {
+			k++
+			continue
+		}
+		// a hunk runs from diffContext lines before the first change to
+		// diffContext lines after the last change that is not followed by
+		// a longer run of equal lines
+		start := max(k-diffContext, 0)
+		end := k
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*diffContext {
+				end = min(end+diffContext, len(ops))
+				break
+			}
+			end = run
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		var aLen, bLen int
+		for _, o := range ops[start:end] {
+			if o.kind != '+' {
+				aLen++
+			}
+			if o.kind != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", ops[start].ai+1, aLen, ops[start].bi+1, bLen)
+		for _, o := range ops[start:end] {
+			line := o.line
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			out.WriteByte(o.kind)
+			out.WriteString(line)
+		}
+		k = end
+	}
+	return out.String()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	configFormatYAML = "yaml"
+	configFormatJSON = "json"
+	configFormatTOML = "toml"
+)
+
+// configFormat picks the config format from CONFIG_FORMAT or, when that is
+// not set, from the file extension. YAML is the default.
+func configFormat(path string) (string, error) {
+	format := strings.ToLower(os.Getenv("CONFIG_FORMAT"))
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json":
+			format = configFormatJSON
+		case ".toml":
+			format = configFormatTOML
+		default:
+			format = configFormatYAML
+		}
+	}
+	switch format {
+	case configFormatYAML, "yml", configFormatJSON, configFormatTOML:
+		return format, nil
+	}
+	return "", fmt.Errorf("unsupported config format %q", format)
+}
+
+// decodeConfig decodes a config document (or an included service) in the
+// given format. JSON is a subset of YAML, so
+// it goes through the YAML decoder directly. TOML is decoded generically and
+// re-encoded as YAML, so the yaml struct tags are the single source of key
+// names for every format. Decoding is strict: unknown and duplicate keys are
+// errors rather than silently ignored.
+func decodeConfig(data []byte, format string, out any) error {
+	if format == configFormatTOML {
+		var doc map[string]any
+		if err := toml.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		converted, err := yaml.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		data = converted
+	}
+	return yaml.UnmarshalStrict(data, out)
+}
+
+var (
+	decodeErrorLine  = regexp.MustCompile(`^line (\d+): (.*)$`)
+	unknownFieldText = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+)
+
+// decodeErrors turns the YAML decoder's errors into one "file:line: message"
+// entry per problem. Line numbers of TOML configs refer to the re-encoded
+// document, so they are dropped when withLines is false.
+func decodeErrors(path string, withLines bool, err error) []string {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return []string{fmt.Sprintf("%s: %v", path, err)}
+	}
+	var out []string
+	for _, msg := range typeErr.Errors {
+		location := path
+		if m := decodeErrorLine.FindStringSubmatch(msg); m != nil {
+			if withLines {
+				location = path + ":" + m[1]
+			}
+			msg = m[2]
+		}
+		if m := unknownFieldText.FindStringSubmatch(msg); m != nil {
+			msg = fmt.Sprintf("unknown key %q", m[1])
+		}
+		out = append(out, location+": "+msg)
+	}
+	return out
+}
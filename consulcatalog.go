@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// enrichPair is an attribute attached by enrichStage.
+type enrichPair struct {
+	key, value string
+}
+
+var (
+	catalogsMu sync.Mutex
+	// catalogs are the attributes of every service from the Consul catalog
+	catalogs = make(map[string][]enrichPair)
+)
+
+func catalogFor(service string) []enrichPair {
+	catalogsMu.Lock()
+	defer catalogsMu.Unlock()
+	return catalogs[service]
+}
+
+// catalogPairs returns the attributes of the instances of a catalog service:
+// their datacenter, their nodes and the union of their tags, comma separated,
+// and their service metadata, of the first instance for keys they disagree
+// on.
+func catalogPairs(instances []*api.CatalogService) []enrichPair {
+	if len(instances) == 0 {
+		return nil
+	}
+	slices.SortFunc(instances, func(a, b *api.CatalogService) int { return strings.Compare(a.Node, b.Node) })
+	var nodes, tags []string
+	meta := make(map[string]string)
+	for _, instance := range instances {
+		nodes = append(nodes, instance.Node)
+		tags = append(tags, instance.ServiceTags...)
+		for key, value := range instance.ServiceMeta {
+			if _, ok := meta[key]; !ok {
+				meta[key] = value
+			}
+		}
+	}
+	slices.Sort(tags)
+	pairs := []enrichPair{
+		{"consul_datacenter", instances[0].Datacenter},
+		{"consul_node", strings.Join(slices.Compact(nodes), ",")},
+		{"consul_tags", strings.Join(slices.Compact(tags), ",")},
+	}
+	for _, key := range sortedLabels(meta) {
+		pairs = append(pairs, enrichPair{"consul_meta_" + key, meta[key]})
+	}
+	return pairs
+}
+
+// watchConsulCatalog keeps the catalog attributes of service up to date
+// until ctx is cancelled. The first lookup is done before it returns, so the
+// first events of the service have them; a failed one is retried in the
+// background.
+func watchConsulCatalog(ctx context.Context, client *api.Client, service ServiceConfig) {
+	index, _ := lookupConsulCatalog(ctx, client, service, 0)
+	go func() {
+		for ctx.Err() == nil {
+			newIndex, ok := lookupConsulCatalog(ctx, client, service, index)
+			if !ok {
+				sleepContext(ctx, consulWatchErrorDelay)
+				continue
+			}
+			// the index can go backwards after a Consul snapshot restore
+			if newIndex < index {
+				newIndex = 0
+			}
+			index = newIndex
+		}
+	}()
+}
+
+// lookupConsulCatalog blocks until the catalog service changed since
+// waitIndex, stores its attributes and returns the new index.
+func lookupConsulCatalog(ctx context.Context, client *api.Client, service ServiceConfig, waitIndex uint64) (uint64, bool) {
+	opts := (&api.QueryOptions{WaitIndex: waitIndex, WaitTime: consulWatchWait}).WithContext(ctx)
+	instances, meta, err := client.Catalog().Service(service.Enrich.ConsulService, "", opts)
+	if err != nil {
+		if ctx.Err() == nil {
+			consulLog.Errorf("Error looking up %s in the Consul catalog for the enrichment of %s: %v", service.Enrich.ConsulService, service.Name, err)
+		}
+		return waitIndex, false
+	}
+	if len(instances) == 0 && waitIndex == 0 {
+		consulLog.Infof("Service %s of %s is not in the Consul catalog yet", service.Enrich.ConsulService, service.Name)
+	}
+	catalogsMu.Lock()
+	catalogs[service.Name] = catalogPairs(instances)
+	catalogsMu.Unlock()
+	return meta.LastIndex, true
+}
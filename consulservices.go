@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	serviceSourceFile   = "file"
+	serviceSourceConsul = "consul"
+
+	consulWatchWait       = 5 * time.Minute
+	consulWatchErrorDelay = 10 * time.Second
+)
+
+// loadConsulServices reads every service definition stored below prefix. Each
+// key holds one service in the same YAML format as an entry of the services
+// list. Invalid entries are logged and skipped so one bad key cannot take
+// down the others.
+func loadConsulServices(ctx context.Context, client *api.Client, prefix string, waitIndex uint64) ([]ServiceConfig, uint64, error) {
+	opts := (&api.QueryOptions{WaitIndex: waitIndex, WaitTime: consulWatchWait}).WithContext(ctx)
+	pairs, meta, err := client.KV().List(prefix, opts)
+	if err != nil {
+		return nil, waitIndex, err
+	}
+
+	var services []ServiceConfig
+	for _, pair := range pairs {
+		if strings.HasSuffix(pair.Key, "/") || len(pair.Value) == 0 {
+			continue
+		}
+		var service ServiceConfig
+		if err := yaml.UnmarshalStrict(pair.Value, &service); err != nil {
+			consulLog.Warnf("Ignoring service in Consul key %s: %v", pair.Key, err)
+			continue
+		}
+		service.origin = pair.Key
+		if errs := validateService(pair.Key, service); len(errs) > 0 {
+			for _, e := range errs {
+				consulLog.Warnf("Ignoring service in Consul key %s: %s", pair.Key, e.format("consul", nil))
+			}
+			continue
+		}
+		services = append(services, service)
+	}
+	return services, meta.LastIndex, nil
+}
+
+// watchConsulServices blocks on the KV prefix and pushes every change of the
+// stored services to the supervisor.
+func watchConsulServices(ctx context.Context, client *api.Client, prefix string, index uint64, sup *supervisor) {
+	for ctx.Err() == nil {
+		services, newIndex, err := loadConsulServices(ctx, client, prefix, index)
+		if err != nil {
+			if ctx.Err() == nil {
+				consulLog.Errorf("Error watching services in Consul at %s: %v", prefix, err)
+				sleepContext(ctx, consulWatchErrorDelay)
+			}
+			continue
+		}
+		if newIndex == index {
+			continue
+		}
+		// the index can go backwards after a Consul snapshot restore
+		if newIndex < index {
+			newIndex = 0
+		}
+		index = newIndex
+		consulLog.Infof("Services in Consul at %s changed", prefix)
+		if err := sup.update(serviceSourceConsul, services); err != nil {
+			consulLog.Errorf("Applying services from Consul: %v", err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import "strings"
+
+// awslogsPreset adds the container of an ECS task logging with the awslogs
+// driver, whose streams are named prefix/container/task-id, to its events.
+type awslogsPreset struct{}
+
+func newAWSLogsPreset(ServiceConfig) stage { return awslogsPreset{} }
+
+func (awslogsPreset) apply(event logEvent, out []logEvent) []logEvent {
+	parts := strings.Split(event.LogStream, "/")
+	if event.Fields != nil || len(parts) != 3 {
+		return append(out, event)
+	}
+	event.Fields = containerMessage(event.Message)
+	addMissing(event.Fields, map[string]any{
+		"stream_prefix":  parts[0],
+		"container_name": parts[1],
+		"task_id":        parts[2],
+	})
+	return append(out, event)
+}
+
+// fluentBitPreset unwraps the JSON records Fluent Bit writes for Kubernetes
+// containers on EKS, or FireLens writes on ECS, into the inner message and
+// the container's metadata.
+type fluentBitPreset struct{}
+
+func newFluentBitPreset(ServiceConfig) stage { return fluentBitPreset{} }
+
+func (fluentBitPreset) apply(event logEvent, out []logEvent) []logEvent {
+	record := event.Fields
+	if record == nil {
+		var ok bool
+		if record, ok = parseJSONObject(event.Message); !ok {
+			return append(out, event)
+		}
+	}
+	inner, ok := record["log"].(string)
+	if !ok {
+		return append(out, event)
+	}
+	fields := containerMessage(inner)
+	metadata := make(map[string]any)
+	for name, path := range map[string][]string{
+		"stream":              {"stream"},
+		"time":                {"time"},
+		"pod":                 {"kubernetes", "pod_name"},
+		"pod_id":              {"kubernetes", "pod_id"},
+		"namespace":           {"kubernetes", "namespace_name"},
+		"container_name":      {"kubernetes", "container_name"},
+		"container_image":     {"kubernetes", "container_image"},
+		"host":                {"kubernetes", "host"},
+		"labels":              {"kubernetes", "labels"},
+		"ecs_cluster":         {"ecs_cluster"},
+		"ecs_task_arn":        {"ecs_task_arn"},
+		"ecs_task_definition": {"ecs_task_definition"},
+	} {
+		if value, ok := lookupField(record, path); ok {
+			metadata[name] = value
+		}
+	}
+	// FireLens names the source and the container differently
+	if source, ok := record["source"].(string); ok {
+		metadata["stream"] = source
+	}
+	if name, ok := record["container_name"].(string); ok {
+		metadata["container_name"] = strings.TrimPrefix(name, "/")
+	}
+	addMissing(fields, metadata)
+	event.Fields = fields
+	return append(out, event)
+}
+
+// containerMessage returns the fields of a container's log line: those of
+// the line if it is a JSON object, else the line as message.
+func containerMessage(line string) map[string]any {
+	if fields, ok := parseJSONObject(line); ok {
+		return fields
+	}
+	return map[string]any{"message": strings.TrimRight(line, "\r\n")}
+}
+
+// addMissing adds the values to fields that fields does not have yet.
+func addMissing(fields, values map[string]any) {
+	for key, value := range values {
+		if _, ok := fields[key]; !ok {
+			fields[key] = value
+		}
+	}
+}
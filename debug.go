@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// serveDebug serves the net/http/pprof profiles on their own listener, so
+// they can stay on a private interface while metrics are scraped from
+// elsewhere. Requests need the bearer token if one is set.
+func serveDebug(addr, token string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	var handler http.Handler = mux
+	if token != "" {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasBearerToken(r, token) {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		})
+	}
+	serverLog.Infof("Serving pprof on %s/debug/pprof/", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		serverLog.Fatalf("pprof server failed: %v", err)
+	}
+}
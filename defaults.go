@@ -0,0 +1,95 @@
+package main
+
+// ServiceDefaults holds settings inherited by every service in the config
+// file. A value set on a service or log config always wins.
+type ServiceDefaults struct {
+	OffsetFallbackDuration Duration    `yaml:"offset_fallback_duration"`
+	PollInterval           Duration    `yaml:"poll_interval"`
+	MaxPollInterval        Duration    `yaml:"max_poll_interval"`
+	FetchLimit             int64       `yaml:"fetch_limit"`
+	ErrorBackoff           Duration    `yaml:"error_backoff"`
+	MaxConcurrentFetches   int         `yaml:"max_concurrent_fetches"`
+	Destination            Destination `yaml:"destination"`
+
+	// Labels are merged into those of every service
+	Labels map[string]string `yaml:"labels"`
+}
+
+// applyDefaults fills unset service and log config values from the defaults
+// block; poll settings of a log config fall back to its service where they
+// are used, see pollSettings. It runs before validation, so inherited values
+// are validated like values written on the service itself.
+func (c *Config) applyDefaults() {
+	d := c.Defaults
+	for i := range c.Services {
+		service := &c.Services[i]
+		if service.OffsetFallbackDuration == 0 {
+			service.OffsetFallbackDuration = d.OffsetFallbackDuration
+		}
+		if service.ErrorBackoff == 0 {
+			service.ErrorBackoff = d.ErrorBackoff
+		}
+		if service.PollInterval == 0 {
+			service.PollInterval = d.PollInterval
+		}
+		if service.MaxPollInterval == 0 {
+			service.MaxPollInterval = d.MaxPollInterval
+		}
+		if service.FetchLimit == 0 {
+			service.FetchLimit = d.FetchLimit
+		}
+		if service.Destination.Type == "" {
+			service.Destination.Type = d.Destination.Type
+		}
+		if service.Destination.FilePath == "" {
+			service.Destination.FilePath = d.Destination.FilePath
+		}
+		if service.Destination.FileName == "" {
+			service.Destination.FileName = d.Destination.FileName
+		}
+		if service.Destination.BatchSize == 0 {
+			service.Destination.BatchSize = d.Destination.BatchSize
+		}
+		if service.Destination.BatchBytes == 0 {
+			service.Destination.BatchBytes = d.Destination.BatchBytes
+		}
+		if service.Destination.BatchInterval == 0 {
+			service.Destination.BatchInterval = d.Destination.BatchInterval
+		}
+		if service.Destination.MaxEventsPerSecond == 0 {
+			service.Destination.MaxEventsPerSecond = d.Destination.MaxEventsPerSecond
+		}
+		if service.Destination.MaxBytesPerSecond == 0 {
+			service.Destination.MaxBytesPerSecond = d.Destination.MaxBytesPerSecond
+		}
+		if service.Destination.MaxMessageBytes == 0 {
+			service.Destination.MaxMessageBytes = d.Destination.MaxMessageBytes
+		}
+		if service.Destination.Oversized == "" {
+			service.Destination.Oversized = d.Destination.Oversized
+		}
+		// template and prefix exclude each other, so they are inherited
+		// together and only by services setting neither
+		if service.Destination.Template == "" && service.Destination.Prefix == "" {
+			service.Destination.Template = d.Destination.Template
+			service.Destination.Prefix = d.Destination.Prefix
+		}
+		if !service.Destination.Timestamp.enabled() {
+			service.Destination.Timestamp = d.Destination.Timestamp
+		}
+		for name, value := range d.Labels {
+			if _, ok := service.Labels[name]; !ok {
+				if service.Labels == nil {
+					service.Labels = make(map[string]string, len(d.Labels))
+				}
+				service.Labels[name] = value
+			}
+		}
+		for j := range service.LogConfigs {
+			logConfig := &service.LogConfigs[j]
+			if logConfig.MaxConcurrentFetches == 0 {
+				logConfig.MaxConcurrentFetches = d.MaxConcurrentFetches
+			}
+		}
+	}
+}
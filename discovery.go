@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	defaultDiscoveryInterval      = time.Minute
+	defaultMaxConcurrentDiscovery = 4
+	defaultStartupJitter          = 10 * time.Second
+)
+
+// discoverySlots caps how many DescribeLogStreams listings run at the same
+// time across all services, so a restart with hundreds of log configs does
+// not list them all at once.
+var discoverySlots = newDiscoverySlots(defaultMaxConcurrentDiscovery)
+
+func newDiscoverySlots(size int) chan struct{} {
+	if size <= 0 {
+		size = defaultMaxConcurrentDiscovery
+	}
+	return make(chan struct{}, size)
+}
+
+// tailerManager keeps track of which streams already have a tailer so that
+// periodic discovery only starts goroutines for streams it has not seen yet,
+// and stops the ones whose stream has gone quiet.
+type tailerManager struct {
+	// ctx is cancelled on shutdown and is the parent of every tailer
+	ctx                    context.Context
+	mu                     sync.Mutex
+	running                map[string]*tailer
+	consulClient           *api.Client
+	pool                   *tailPool
+	cluster                *cluster
+	offsets                offsetPaths
+	offsetFallbackDuration time.Duration
+	idleTimeout            time.Duration
+	// startupJitter delays the first fetch of a new tailer by a random
+	// share of it, so thousands of streams do not all fetch in the same
+	// second after a restart
+	startupJitter time.Duration
+	// runOnce makes tailers return once their stream is caught up instead
+	// of polling forever; wg lets the caller wait for all of them.
+	runOnce bool
+	wg      sync.WaitGroup
+}
+
+func newTailerManager(ctx context.Context, pool *tailPool, cluster *cluster, consulClient *api.Client, offsets offsetPaths, offsetFallbackDuration, idleTimeout, startupJitter time.Duration, runOnce bool) *tailerManager {
+	return &tailerManager{
+		ctx:                    ctx,
+		pool:                   pool,
+		cluster:                cluster,
+		runOnce:                runOnce,
+		running:                make(map[string]*tailer),
+		consulClient:           consulClient,
+		offsets:                offsets,
+		offsetFallbackDuration: offsetFallbackDuration,
+		idleTimeout:            idleTimeout,
+		startupJitter:          startupJitter,
+	}
+}
+
+type tailer struct {
+	cancel context.CancelFunc
+}
+
+func tailerKey(service ServiceConfig, logConfig LogConfig, logStreamName string) string {
+	return service.Name + "|" + logConfig.LogGroupName + "|" + logStreamName
+}
+
+func (m *tailerManager) start(cwLogs *cloudwatchlogs.CloudWatchLogs, service ServiceConfig, logConfig LogConfig, logStreamName string) {
+	key := tailerKey(service, logConfig, logStreamName)
+	if !m.cluster.owns(key) {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.running[key]; ok {
+		return
+	}
+	if !m.cluster.claim(key) {
+		return
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	t := &tailer{cancel: cancel}
+	m.running[key] = t
+	st := &streamTail{
+		m:         m,
+		ctx:       ctx,
+		cwLogs:    cwLogs,
+		service:   service,
+		logConfig: logConfig,
+		name:      logStreamName,
+		key:       key,
+		t:         t,
+		log:       streamLogger(tailLog, service.Name, logConfig.LogGroupName, logStreamName),
+	}
+	st.log.Debugf("Discovered log stream %s in %s for %s", logStreamName, logConfig.LogGroupName, service.Name)
+	m.wg.Add(1)
+	m.pool.schedule(st, m.startDelay())
+}
+
+func (m *tailerManager) startDelay() time.Duration {
+	if m.startupJitter <= 0 {
+		return 0
+	}
+	return rand.N(m.startupJitter)
+}
+
+// acquireDiscoverySlot blocks until fewer than max_concurrent_discovery
+// listings are running and returns the function releasing the slot.
+func acquireDiscoverySlot(ctx context.Context) (func(), error) {
+	select {
+	case discoverySlots <- struct{}{}:
+		return func() { <-discoverySlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// finish is called by the pool once a tail ended.
+func (m *tailerManager) finish(st *streamTail, err error) {
+	defer m.wg.Done()
+	m.release(st.key, st.t)
+	if st.started && err == st.ctx.Err() {
+		st.log.Infof("Stopped tailing log stream %s", st.name)
+	}
+	if errors.Is(err, errStreamGone) {
+		// Forget the stream so discovery re-attaches a tailer if a
+		// stream with the same name is created again.
+		m.forget(st.key, st.t)
+	}
+}
+
+// release gives up the cluster claim and the status of a tail that ended, unless
+// the stream got a new tailer in the meantime, which holds the same claim.
+func (m *tailerManager) release(key string, t *tailer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if other, ok := m.running[key]; ok && other != t {
+		return
+	}
+	m.cluster.release(key)
+	forgetStream(key)
+}
+
+func (m *tailerManager) forget(key string, t *tailer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running[key] == t {
+		t.cancel()
+		delete(m.running, key)
+	}
+}
+
+func (m *tailerManager) stop(service ServiceConfig, logConfig LogConfig, logStreamName string) {
+	key := tailerKey(service, logConfig, logStreamName)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.running[key]; ok {
+		t.cancel()
+		delete(m.running, key)
+	}
+}
+
+// rebalance stops the tailers of streams another cluster member is now
+// responsible for. Streams this instance gained are started by the discovery
+// that follows.
+func (m *tailerManager) rebalance() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, t := range m.running {
+		if !m.cluster.owns(key) {
+			tailLog.Debugf("Handing %s over to another cluster member", key)
+			t.cancel()
+			delete(m.running, key)
+		}
+	}
+}
+
+// stopAll stops every tailer, used when the cluster session expired and with
+// it the claims: another replica may already be taking the streams over.
+func (m *tailerManager) stopAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, t := range m.running {
+		t.cancel()
+		delete(m.running, key)
+	}
+}
+
+// isIdle reports whether the stream has not received events for longer than
+// the idle timeout. CloudWatch only updates lastEventTimestamp eventually, so
+// the timeout should be generous (hours, not minutes).
+func (m *tailerManager) isIdle(stream *cloudwatchlogs.LogStream) bool {
+	if m.idleTimeout <= 0 {
+		return false
+	}
+	last := aws.Int64Value(stream.LastEventTimestamp)
+	if last == 0 {
+		last = aws.Int64Value(stream.CreationTime)
+	}
+	return time.Since(time.UnixMilli(last)) > m.idleTimeout
+}
+
+func (m *tailerManager) syncStreams(cwLogs *cloudwatchlogs.CloudWatchLogs, service ServiceConfig, logConfig LogConfig) error {
+	filter, err := newStreamFilter(logConfig)
+	if err != nil {
+		return err
+	}
+	release, err := acquireDiscoverySlot(m.ctx)
+	if err != nil {
+		return err
+	}
+	logStreams, err := listLogStreams(m.ctx, cwLogs, logConfig.LogGroupName, logConfig.LogStreamPrefix)
+	release()
+	if err != nil {
+		return err
+	}
+	for _, stream := range logStreams {
+		if !filter.match(*stream.LogStreamName) {
+			continue
+		}
+		if m.isIdle(stream) {
+			m.stop(service, logConfig, *stream.LogStreamName)
+			continue
+		}
+		m.start(cwLogs, service, logConfig, *stream.LogStreamName)
+	}
+	return nil
+}
+
+// syncLogConfig expands the log config's group name (which may be a glob,
+// regex or tag selector) and syncs the streams of every matching log group.
+func (m *tailerManager) syncLogConfig(cwLogs *cloudwatchlogs.CloudWatchLogs, service ServiceConfig, logConfig LogConfig) error {
+	logGroups, err := resolveLogGroups(m.ctx, cwLogs, logConfig)
+	if err != nil {
+		return err
+	}
+	for _, logGroup := range logGroups {
+		groupConfig := logConfig
+		groupConfig.LogGroupName = logGroup
+		if groupConfig.FetchMode == fetchModeGroup {
+			if err := m.startGroup(cwLogs, service, groupConfig); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := m.syncStreams(cwLogs, service, groupConfig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *tailerManager) discoverPeriodically(cwLogs *cloudwatchlogs.CloudWatchLogs, service ServiceConfig, logConfig LogConfig, interval time.Duration) {
+	// every round waits a jittered interval, so log configs that were
+	// all started together drift apart instead of listing in lockstep
+	timer := time.NewTimer(jitter(interval))
+	defer timer.Stop()
+
+	// the loss channel stays closed until the instance joined again
+	var handledLoss <-chan struct{}
+	for {
+		loss := m.cluster.sessionLoss()
+		if loss == handledLoss {
+			loss = nil
+		}
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-timer.C:
+			timer.Reset(jitter(interval))
+		case <-m.cluster.memberChanges():
+			m.rebalance()
+		case <-loss:
+			handledLoss = loss
+			tailLog.with("service", service.Name).Errorf("Cluster session lost, stopping all tailers of %s", service.Name)
+			m.stopAll()
+			continue
+		}
+		if err := m.syncLogConfig(cwLogs, service, logConfig); err != nil && m.ctx.Err() == nil {
+			streamLogger(tailLog, service.Name, logConfig.LogGroupName, "").Errorf("Error discovering log streams for %s in %s: %v", service.Name, logConfig.LogGroupName, err)
+		}
+	}
+}
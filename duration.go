@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that is written as a string in the config. On
+// top of the units time.ParseDuration knows it accepts days ("7d", "1d12h").
+// Bare integers are rejected: yaml would otherwise read them as nanoseconds,
+// so "offset_fallback_duration: 3600" meant 3.6µs, not an hour.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := parseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	rest := strings.TrimSpace(s)
+	if _, err := strconv.ParseFloat(rest, 64); err == nil && rest != "0" {
+		return 0, fmt.Errorf("invalid duration %q: a unit is required, e.g. \"15m\", \"24h\" or \"7d\"", s)
+	}
+	var days time.Duration
+	if i := strings.IndexByte(rest, 'd'); i >= 0 {
+		n, err := strconv.ParseFloat(rest[:i], 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		days = time.Duration(n * float64(24*time.Hour))
+		rest = rest[i+1:]
+		if rest == "" {
+			return days, nil
+		}
+	}
+	d, err := time.ParseDuration(rest)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return days + d, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	emfModeKeep  = "keep"
+	emfModeStrip = "strip"
+	emfModeDrop  = "drop"
+
+	defaultEMFPrefix = "emf_"
+
+	metricEMFEvents = "cwsync_emf_events_total"
+)
+
+func init() {
+	metrics.describe(metricEMFEvents, "counter", "Events in embedded metric format whose metrics were extracted.")
+}
+
+// EMFConfig extracts the metrics of events in CloudWatch embedded metric
+// format into gauges of the metrics endpoint, named prefix + namespace + "_"
+// + metric and labeled with the service and the metric's dimensions.
+type EMFConfig struct {
+	// Mode is keep to pass the events on unchanged, strip to remove the
+	// _aws metadata and metric values from them, or drop to only keep the
+	// metrics
+	Mode   string `yaml:"mode"`
+	Prefix string `yaml:"prefix"`
+}
+
+func (c EMFConfig) enabled() bool {
+	return c.Mode != ""
+}
+
+func (c EMFConfig) validate() error {
+	switch c.Mode {
+	case "", emfModeKeep, emfModeStrip, emfModeDrop:
+	default:
+		return fmt.Errorf("mode must be %q, %q or %q, got %q", emfModeKeep, emfModeStrip, emfModeDrop, c.Mode)
+	}
+	if c.Prefix != "" && promName(c.Prefix) != c.Prefix {
+		return fmt.Errorf("prefix %q is not a valid metric name", c.Prefix)
+	}
+	return nil
+}
+
+// emfMetadata is the _aws object of an event in embedded metric format.
+type emfMetadata struct {
+	CloudWatchMetrics []struct {
+		Namespace  string
+		Dimensions [][]string
+		Metrics    []struct{ Name string }
+	}
+}
+
+type emfStage struct {
+	mode, prefix, service string
+	// described are the gauges already given a help text
+	described map[string]bool
+}
+
+func newEMFStage(service ServiceConfig) *emfStage {
+	s := &emfStage{mode: service.EMF.Mode, prefix: service.EMF.Prefix, service: service.Name, described: make(map[string]bool)}
+	if s.prefix == "" {
+		s.prefix = defaultEMFPrefix
+	}
+	return s
+}
+
+func (s *emfStage) apply(event logEvent, out []logEvent) []logEvent {
+	fields := event.Fields
+	if fields == nil {
+		var ok bool
+		if fields, ok = parseJSONObject(event.Message); !ok {
+			return append(out, event)
+		}
+	}
+	raw, ok := fields["_aws"].(map[string]any)
+	if !ok {
+		return append(out, event)
+	}
+	var metadata emfMetadata
+	if encoded, err := json.Marshal(raw); err != nil || json.Unmarshal(encoded, &metadata) != nil || len(metadata.CloudWatchMetrics) == 0 {
+		return append(out, event)
+	}
+	metrics.Add(metricEMFEvents, 1, "service", s.service)
+	for _, directive := range metadata.CloudWatchMetrics {
+		for _, metric := range directive.Metrics {
+			value, ok := emfValue(fields[metric.Name])
+			if !ok {
+				continue
+			}
+			name := promName(s.prefix + directive.Namespace + "_" + metric.Name)
+			if !s.described[name] {
+				metrics.describe(name, "gauge", fmt.Sprintf("Embedded metric %s of namespace %s.", metric.Name, directive.Namespace))
+				s.described[name] = true
+			}
+			// an event without dimension sets has one series without
+			// dimensions
+			sets := directive.Dimensions
+			if len(sets) == 0 {
+				sets = [][]string{nil}
+			}
+			for _, dimensions := range sets {
+				labels := []string{"service", s.service}
+				for _, dimension := range dimensions {
+					label := promName(dimension)
+					if label == "service" {
+						label = "exported_service"
+					}
+					labels = append(labels, label, fmt.Sprint(fields[dimension]))
+				}
+				metrics.Set(name, value, labels...)
+			}
+		}
+	}
+	switch s.mode {
+	case emfModeDrop:
+		return out
+	case emfModeStrip:
+		delete(fields, "_aws")
+		for _, directive := range metadata.CloudWatchMetrics {
+			for _, metric := range directive.Metrics {
+				delete(fields, metric.Name)
+			}
+		}
+		event.Fields = fields
+	}
+	return append(out, event)
+}
+
+// emfValue returns the value of a metric, the last one if the event holds
+// several.
+func emfValue(value any) (float64, bool) {
+	if values, ok := value.([]any); ok {
+		if len(values) == 0 {
+			return 0, false
+		}
+		value = values[len(values)-1]
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := number.Float64()
+	return f, err == nil
+}
+
+// promName turns name into a valid Prometheus metric or label name.
+func promName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r >= '0' && r <= '9' && i > 0:
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// endBound is the parsed form of end_time: either an absolute RFC3339 time or
+// a lag behind the current time ("now", "now-5m").
+type endBound struct {
+	absolute time.Time
+	lag      time.Duration
+	relative bool
+}
+
+func parseEndBound(value string) (*endBound, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if value == "now" {
+		return &endBound{relative: true}, nil
+	}
+	if strings.HasPrefix(value, "now-") {
+		lag, err := time.ParseDuration(strings.TrimPrefix(value, "now-"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid end_time %q: %v", value, err)
+		}
+		return &endBound{lag: lag, relative: true}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid end_time %q: expected RFC3339, \"now\" or \"now-<duration>\"", value)
+	}
+	return &endBound{absolute: t}, nil
+}
+
+func (b *endBound) millis() int64 {
+	if b.relative {
+		return time.Now().Add(-b.lag).UnixMilli()
+	}
+	return b.absolute.UnixMilli()
+}
+
+// reached reports whether no event can ever fall inside the window again,
+// which is only the case for an absolute bound in the past.
+func (b *endBound) reached() bool {
+	return !b.relative && time.Now().After(b.absolute)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	enrichFormatJSON   = "json"
+	enrichFormatPrefix = "prefix"
+)
+
+// enrichFields are the attributes enrichment can attach, in the order they
+// are written. consul stands for the attributes from the Consul catalog, see
+// catalogPairs.
+var enrichFields = []string{"log_group", "log_stream", "service", "region", "account_id", "consul"}
+
+// EnrichConfig attaches where an event came from to its message, so sources
+// can still be told apart once downstream systems merged them.
+type EnrichConfig struct {
+	// Fields are the attributes attached, default all of enrichFields
+	Fields []string `yaml:"fields"`
+	// Format is json to add the attributes to the message's JSON object,
+	// or prefix to put them in front of the message as key=value pairs
+	Format string `yaml:"format"`
+	// Key nests the attributes below this key of the JSON object
+	Key string `yaml:"key"`
+	// ConsulService is the service in the Consul catalog whose tags and
+	// metadata are attached
+	ConsulService string `yaml:"consul_service"`
+}
+
+func (c EnrichConfig) enabled() bool {
+	return c.Format != "" || len(c.Fields) > 0 || c.ConsulService != ""
+}
+
+func (c EnrichConfig) validate() error {
+	switch c.Format {
+	case "", enrichFormatJSON, enrichFormatPrefix:
+	default:
+		return fmt.Errorf("format must be %q or %q, got %q", enrichFormatJSON, enrichFormatPrefix, c.Format)
+	}
+	if c.Key != "" && c.Format == enrichFormatPrefix {
+		return fmt.Errorf("key only applies to format %q", enrichFormatJSON)
+	}
+	for _, field := range c.Fields {
+		if !slices.Contains(enrichFields, field) {
+			return fmt.Errorf("unknown field %q, expected one of %s", field, strings.Join(enrichFields, ", "))
+		}
+		if field == "consul" && c.ConsulService == "" {
+			return fmt.Errorf("field consul needs consul_service")
+		}
+	}
+	return nil
+}
+
+func (c EnrichConfig) fields() []string {
+	if len(c.Fields) == 0 {
+		return enrichFields
+	}
+	return c.Fields
+}
+
+// needsIdentity reports whether the service's region and account have to be
+// resolved before it starts.
+func (c EnrichConfig) needsIdentity() bool {
+	fields := c.fields()
+	return c.enabled() && (slices.Contains(fields, "region") || slices.Contains(fields, "account_id"))
+}
+
+// needsCatalog reports whether the service has to be looked up in the Consul
+// catalog.
+func (c EnrichConfig) needsCatalog() bool {
+	return c.ConsulService != "" && slices.Contains(c.fields(), "consul")
+}
+
+// awsIdentity is the region and account a service reads from.
+type awsIdentity struct {
+	region, account string
+}
+
+var (
+	identitiesMu sync.Mutex
+	identities   = make(map[string]awsIdentity)
+	// accounts caches the account of each session, which needs an STS call
+	accounts = make(map[*session.Session]string)
+)
+
+// resolveIdentity looks up the region and account of sess for the enrichment
+// of service. A failed lookup is logged and leaves the account empty, the
+// events are still written.
+func resolveIdentity(service ServiceConfig, sess *session.Session) {
+	identity := awsIdentity{region: aws.StringValue(sess.Config.Region)}
+	identitiesMu.Lock()
+	account, ok := accounts[sess]
+	identitiesMu.Unlock()
+	if !ok && slices.Contains(service.Enrich.fields(), "account_id") {
+		resp, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		if err != nil {
+			pipelineLog.with("service", service.Name).Errorf("Error looking up the account of %s for enrichment: %v", service.Name, err)
+		} else {
+			account = aws.StringValue(resp.Account)
+			identitiesMu.Lock()
+			accounts[sess] = account
+			identitiesMu.Unlock()
+		}
+	}
+	identity.account = account
+	identitiesMu.Lock()
+	identities[service.Name] = identity
+	identitiesMu.Unlock()
+}
+
+func identityFor(service string) awsIdentity {
+	identitiesMu.Lock()
+	defer identitiesMu.Unlock()
+	return identities[service]
+}
+
+// enrichStage attaches the configured attributes to every event, followed by
+// the labels of the service. Empty values, such as the account of a service
+// started without AWS, are left out.
+type enrichStage struct {
+	config   EnrichConfig
+	fields   []string
+	labels   []enrichPair
+	service  string
+	identity awsIdentity
+	pairs    []enrichPair
+}
+
+// enriched reports whether the events of the service get an enrichStage,
+// which attaches the labels also without enrich.
+func (s ServiceConfig) enriched() bool {
+	return s.Enrich.enabled() || len(s.Labels) > 0
+}
+
+func newEnrichStage(service ServiceConfig) *enrichStage {
+	s := &enrichStage{
+		config:   service.Enrich,
+		service:  service.Name,
+		identity: identityFor(service.Name),
+	}
+	if service.Enrich.enabled() {
+		s.fields = service.Enrich.fields()
+	}
+	for _, name := range sortedLabels(service.Labels) {
+		s.labels = append(s.labels, enrichPair{name, service.Labels[name]})
+	}
+	return s
+}
+
+func (s *enrichStage) value(event *logEvent, field string) string {
+	switch field {
+	case "log_group":
+		return event.LogGroup
+	case "log_stream":
+		return event.LogStream
+	case "service":
+		return s.service
+	case "region":
+		return s.identity.region
+	case "account_id":
+		// a subscription tells which account the log group belongs to
+		if event.Account != "" {
+			return event.Account
+		}
+		return s.identity.account
+	}
+	return ""
+}
+
+// attributes returns the attributes of event in the order they are written,
+// leaving out empty ones.
+func (s *enrichStage) attributes(event *logEvent) []enrichPair {
+	s.pairs = s.pairs[:0]
+	for _, field := range s.fields {
+		if field == "consul" {
+			s.pairs = append(s.pairs, catalogFor(s.service)...)
+		} else {
+			s.pairs = append(s.pairs, enrichPair{field, s.value(event, field)})
+		}
+	}
+	s.pairs = append(s.pairs, s.labels...)
+	return slices.DeleteFunc(s.pairs, func(p enrichPair) bool { return p.value == "" })
+}
+
+func (s *enrichStage) apply(event logEvent, out []logEvent) []logEvent {
+	if s.config.Format == enrichFormatPrefix {
+		var b strings.Builder
+		for _, p := range s.attributes(&event) {
+			b.WriteString(p.key)
+			b.WriteByte('=')
+			value := p.value
+			if strings.ContainsAny(value, " \"=") {
+				value = strconv.Quote(value)
+			}
+			b.WriteString(value)
+			b.WriteByte(' ')
+		}
+		event.Message = b.String() + event.Message
+		return append(out, event)
+	}
+	fields := event.Fields
+	if fields == nil {
+		var ok bool
+		if fields, ok = parseJSONObject(event.Message); !ok {
+			fields = map[string]any{"message": event.Message}
+		}
+	}
+	target := fields
+	if s.config.Key != "" {
+		nested, ok := fields[s.config.Key].(map[string]any)
+		if !ok {
+			nested = make(map[string]any, len(s.fields)+len(s.labels))
+			fields[s.config.Key] = nested
+		}
+		target = nested
+	}
+	for _, p := range s.attributes(&event) {
+		// fields the message already has win
+		if _, ok := target[p.key]; !ok {
+			target[p.key] = p.value
+		}
+	}
+	event.Fields = fields
+	return append(out, event)
+}
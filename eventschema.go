@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+const (
+	schemaActionTag    = "tag"
+	schemaActionReject = "reject"
+	schemaActionDrop   = "drop"
+
+	defaultSchemaField = "_schema_errors"
+
+	metricSchemaInvalidEvents = "cwsync_schema_invalid_events_total"
+)
+
+func init() {
+	metrics.describe(metricSchemaInvalidEvents, "counter", "Events that did not match the json_schema of their service.")
+}
+
+// JSONSchemaConfig checks the events of a service against a JSON Schema,
+// to catch producers breaking their logging contract. Events are checked
+// as parsed, after the json, parse, preset and field_mappings settings;
+// messages that are not a JSON object never match.
+type JSONSchemaConfig struct {
+	Path string `yaml:"path"`
+	// Action is tag to add the errors to the event under Field, reject to
+	// write the event to RejectPath instead, or drop to drop it
+	Action     string `yaml:"action"`
+	Field      string `yaml:"field"`
+	RejectPath string `yaml:"reject_path"`
+}
+
+func (c JSONSchemaConfig) enabled() bool {
+	return c.Path != ""
+}
+
+func (c JSONSchemaConfig) validate() error {
+	if !c.enabled() {
+		if c.Action != "" || c.Field != "" || c.RejectPath != "" {
+			return fmt.Errorf("path is required")
+		}
+		return nil
+	}
+	switch c.Action {
+	case "", schemaActionTag, schemaActionReject, schemaActionDrop:
+	default:
+		return fmt.Errorf("action must be %q, %q or %q, got %q", schemaActionTag, schemaActionReject, schemaActionDrop, c.Action)
+	}
+	if (c.Action == schemaActionReject) != (c.RejectPath != "") {
+		return fmt.Errorf("reject_path is required for and only applies to action %q", schemaActionReject)
+	}
+	if c.Field != "" && c.Action != "" && c.Action != schemaActionTag {
+		return fmt.Errorf("field only applies to action %q", schemaActionTag)
+	}
+	_, err := compileEventSchema(c.Path)
+	return err
+}
+
+func compileEventSchema(path string) (*jsonschema.Schema, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := jsonschema.NewCompiler().Compile(abs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %v", path, err)
+	}
+	return schema, nil
+}
+
+// schemaErrors lists where and how value does not match schema, nil if it
+// does.
+func schemaErrors(schema *jsonschema.Schema, value any) []any {
+	err := schema.Validate(value)
+	if err == nil {
+		return nil
+	}
+	var invalid *jsonschema.ValidationError
+	if !errors.As(err, &invalid) {
+		return []any{err.Error()}
+	}
+	var list []any
+	for _, unit := range invalid.BasicOutput().Errors {
+		if unit.Error != nil {
+			location := unit.InstanceLocation
+			if location == "" {
+				location = "/"
+			}
+			list = append(list, fmt.Sprintf("%s: %s", location, unit.Error))
+		}
+	}
+	if len(list) == 0 {
+		list = append(list, invalid.Error())
+	}
+	return list
+}
+
+// schemaStage checks every event against the service's json_schema and acts
+// on those that do not match it.
+type schemaStage struct {
+	schema  *jsonschema.Schema
+	config  JSONSchemaConfig
+	service string
+	// rejects is the reject file, opened on the first rejected event
+	rejects *os.File
+	// redact applies the redact rules to rejected events, which never
+	// reach the redact stage
+	redact *redactStage
+}
+
+func newSchemaStage(service ServiceConfig) *schemaStage {
+	s := &schemaStage{config: service.JSONSchema, service: service.Name}
+	if s.config.Field == "" {
+		s.config.Field = defaultSchemaField
+	}
+	if len(service.Redact) > 0 {
+		s.redact = newRedactStage(service)
+	}
+	schema, err := compileEventSchema(service.JSONSchema.Path)
+	if err != nil {
+		// the schema was compiled when validating, but may have changed
+		pipelineLog.with("service", service.Name).Errorf("Error loading the json_schema of %s, events are not checked: %v", service.Name, err)
+		return s
+	}
+	s.schema = schema
+	return s
+}
+
+func (s *schemaStage) apply(event logEvent, out []logEvent) []logEvent {
+	if s.schema == nil {
+		return append(out, event)
+	}
+	fields := event.Fields
+	var list []any
+	if fields == nil {
+		var ok bool
+		if fields, ok = parseJSONObject(event.Message); !ok {
+			list = []any{"message is not a JSON object"}
+		}
+	}
+	if fields != nil {
+		list = schemaErrors(s.schema, fields)
+	}
+	if list == nil {
+		return append(out, event)
+	}
+	metrics.Add(metricSchemaInvalidEvents, 1, "service", s.service)
+	switch s.config.Action {
+	case schemaActionDrop:
+		return out
+	case schemaActionReject:
+		if err := s.reject(&event, list); err != nil {
+			// the event is passed on rather than lost
+			pipelineLog.with("service", s.service).Errorf("Error writing to the reject file of %s: %v", s.service, err)
+			return append(out, event)
+		}
+		return out
+	}
+	if fields == nil {
+		fields = map[string]any{"message": event.Message}
+	}
+	fields[s.config.Field] = list
+	event.Fields = fields
+	return append(out, event)
+}
+
+// reject appends the event and its errors to the reject file as a JSON line,
+// redacted like the events that are written.
+func (s *schemaStage) reject(event *logEvent, list []any) error {
+	if s.rejects == nil {
+		file, err := os.OpenFile(s.config.RejectPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		s.rejects = file
+	}
+	message := event.Message
+	if event.Fields != nil {
+		message = encodeFields(event.Fields)
+	}
+	if s.redact != nil {
+		// the event is dropped, redacting its fields in place is fine
+		redacted := s.redact.apply(*event, nil)[0]
+		message = redacted.Message
+		if redacted.Fields != nil {
+			message = encodeFields(redacted.Fields)
+		}
+	}
+	line, err := json.Marshal(map[string]any{
+		"log_group":  event.LogGroup,
+		"log_stream": event.LogStream,
+		"timestamp":  event.Timestamp,
+		"message":    message,
+		"errors":     list,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := s.rejects.Write(append(line, '\n')); err != nil {
+		s.rejects.Close()
+		s.rejects = nil
+		return err
+	}
+	return nil
+}
+
+func (s *schemaStage) close() {
+	if s.rejects != nil {
+		s.rejects.Close()
+	}
+}
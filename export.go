@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+const exportPollInterval = 10 * time.Second
+
+// runExport drives CreateExportTask to S3 for every configured log group (or
+// the ones given with -log-group). CloudWatch only allows one active export
+// task per account, so tasks are created and awaited one after another.
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := fs.String("config", configPathFromEnv(), "path to the config file")
+	from := fs.String("from", "", "start of the range to export (RFC3339)")
+	to := fs.String("to", "", "end of the range to export (RFC3339), default now")
+	bucket := fs.String("bucket", "", "destination S3 bucket")
+	prefix := fs.String("prefix", "cwsync", "S3 key prefix, the log group name is appended")
+	var logGroups stringList
+	fs.Var(&logGroups, "log-group", "log group to export, repeatable; defaults to all configured log groups")
+	fs.Parse(args)
+
+	if *from == "" || *bucket == "" {
+		fmt.Fprintln(os.Stderr, "usage: cwsync export -from <RFC3339> [-to <RFC3339>] -bucket <bucket> [-prefix <prefix>] [-log-group <name>]...")
+		os.Exit(2)
+	}
+	fromTime, err := time.Parse(time.RFC3339, *from)
+	if err != nil {
+		mainLog.Fatalf("invalid -from: %v", err)
+	}
+	toTime := time.Now()
+	if *to != "" {
+		if toTime, err = time.Parse(time.RFC3339, *to); err != nil {
+			mainLog.Fatalf("invalid -to: %v", err)
+		}
+	}
+
+	config := loadConfig(*configPath, nil)
+	sess := createAWSSession(config)
+	cwLogs := newCloudWatchLogsClient(sess, config, newAPILimiter(config.APIRateLimits))
+	instrumentClient(cwLogs, "export")
+
+	if len(logGroups) == 0 {
+		for _, service := range config.Services {
+			for _, logConfig := range service.LogConfigs {
+				resolved, err := resolveLogGroups(context.Background(), cwLogs, logConfig)
+				if err != nil {
+					mainLog.Fatalf("failed to resolve log groups for %s: %v", service.Name, err)
+				}
+				logGroups = append(logGroups, resolved...)
+			}
+		}
+	}
+
+	failed := 0
+	for _, logGroup := range logGroups {
+		destPrefix := strings.TrimSuffix(*prefix, "/") + "/" + strings.TrimPrefix(logGroup, "/")
+		if err := exportLogGroup(cwLogs, logGroup, fromTime, toTime, *bucket, destPrefix); err != nil {
+			mainLog.Errorf("Export of %s failed: %v", logGroup, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func exportLogGroup(cwLogs *cloudwatchlogs.CloudWatchLogs, logGroup string, from, to time.Time, bucket, prefix string) error {
+	input := &cloudwatchlogs.CreateExportTaskInput{
+		TaskName:          aws.String(fmt.Sprintf("cwsync-%d", time.Now().Unix())),
+		LogGroupName:      aws.String(logGroup),
+		From:              aws.Int64(from.UnixMilli()),
+		To:                aws.Int64(to.UnixMilli()),
+		Destination:       aws.String(bucket),
+		DestinationPrefix: aws.String(prefix),
+	}
+
+	var taskID string
+	for {
+		resp, err := cwLogs.CreateExportTask(input)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == cloudwatchlogs.ErrCodeLimitExceededException {
+			// another export task is still running in this account
+			mainLog.Infof("Export task limit reached, waiting to export %s", logGroup)
+			time.Sleep(exportPollInterval)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		taskID = *resp.TaskId
+		break
+	}
+	mainLog.Infof("Started export task %s for %s to s3://%s/%s", taskID, logGroup, bucket, prefix)
+
+	for {
+		time.Sleep(exportPollInterval)
+		resp, err := cwLogs.DescribeExportTasks(&cloudwatchlogs.DescribeExportTasksInput{
+			TaskId: aws.String(taskID),
+		})
+		if err != nil {
+			mainLog.Errorf("Error polling export task %s: %v", taskID, err)
+			continue
+		}
+		if len(resp.ExportTasks) == 0 || resp.ExportTasks[0].Status == nil {
+			continue
+		}
+		status := resp.ExportTasks[0].Status
+		switch aws.StringValue(status.Code) {
+		case cloudwatchlogs.ExportTaskStatusCodeCompleted:
+			mainLog.Infof("Export task %s for %s completed", taskID, logGroup)
+			return nil
+		case cloudwatchlogs.ExportTaskStatusCodeFailed, cloudwatchlogs.ExportTaskStatusCodeCancelled:
+			return fmt.Errorf("task %s %s: %s", taskID, aws.StringValue(status.Code), aws.StringValue(status.Message))
+		}
+	}
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
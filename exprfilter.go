@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+const (
+	metricExprFilteredEvents = "cwsync_expr_filtered_events_total"
+	metricExprFilterErrors   = "cwsync_expr_filter_errors_total"
+)
+
+func init() {
+	metrics.describe(metricExprFilteredEvents, "counter", "Events dropped by filter expressions.")
+	metrics.describe(metricExprFilterErrors, "counter", "Events a filter expression failed on, which were kept.")
+}
+
+// filterEnv is what a filter expression sees of an event.
+type filterEnv struct {
+	Message       string         `expr:"message"`
+	Level         string         `expr:"level"`
+	LogGroup      string         `expr:"log_group"`
+	LogStream     string         `expr:"log_stream"`
+	Service       string         `expr:"service"`
+	Timestamp     int64          `expr:"timestamp"`
+	IngestionTime int64          `expr:"ingestion_time"`
+	Fields        map[string]any `expr:"fields"`
+}
+
+func compileFilter(code string) (*vm.Program, error) {
+	program, err := expr.Compile(code, expr.Env(&filterEnv{}), expr.AsBool())
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %v", code, err)
+	}
+	return program, nil
+}
+
+// exprFilter keeps the events filter evaluates to true for. An event it
+// fails on, e.g. by comparing a missing field, is kept and counted.
+type exprFilter struct {
+	program *vm.Program
+	vm      vm.VM
+	env     filterEnv
+	service string
+}
+
+func newExprFilter(service ServiceConfig) *exprFilter {
+	// the filter was validated when loading the config
+	program, _ := compileFilter(service.Filter)
+	return &exprFilter{program: program, service: service.Name}
+}
+
+func (f *exprFilter) apply(event logEvent, out []logEvent) []logEvent {
+	f.env = filterEnv{
+		Message:       event.Message,
+		Level:         event.Level,
+		LogGroup:      event.LogGroup,
+		LogStream:     event.LogStream,
+		Service:       f.service,
+		Timestamp:     event.Timestamp,
+		IngestionTime: event.IngestionTime,
+		Fields:        filterFields(event.Fields),
+	}
+	keep, err := f.vm.Run(f.program, &f.env)
+	if err != nil {
+		metrics.Add(metricExprFilterErrors, 1, "service", f.service)
+		pipelineLog.with("service", f.service).Debugf("Error evaluating the filter of %s, keeping the event: %v", f.service, err)
+		return append(out, event)
+	}
+	if keep != true {
+		metrics.Add(metricExprFilteredEvents, 1, "service", f.service)
+		return out
+	}
+	return append(out, event)
+}
+
+// filterFields copies fields with their numbers converted from json.Number,
+// so expressions can compare them with numbers.
+func filterFields(fields map[string]any) map[string]any {
+	if fields == nil {
+		return nil
+	}
+	converted := make(map[string]any, len(fields))
+	for key, value := range fields {
+		converted[key] = filterValue(value)
+	}
+	return converted
+}
+
+func filterValue(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return int(n)
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case map[string]any:
+		return filterFields(v)
+	case []any:
+		converted := make([]any, len(v))
+		for i, item := range v {
+			converted[i] = filterValue(item)
+		}
+		return converted
+	}
+	return value
+}
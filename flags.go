@@ -0,0 +1,75 @@
+package main
+
+import "flag"
+
+// cliFlags holds the command line of the daemon. Every flag that is set
+// explicitly overrides the value from the config file.
+type cliFlags struct {
+	fs         *flag.FlagSet
+	configPath string
+	// configProfile selects an entry of profiles in the config file
+	configProfile string
+	region        string
+	profile       string
+	roleARN       string
+	consulAddr    string
+	consulTok     string
+	metrics       string
+	pprof         string
+	logLevel      string
+	logFormat     string
+	color         string
+	once          bool
+	leaderElect   bool
+}
+
+func parseFlags(args []string) *cliFlags {
+	f := &cliFlags{fs: flag.NewFlagSet("cwsync", flag.ExitOnError)}
+	f.fs.StringVar(&f.configPath, "config", configPathFromEnv(), "path to the config file (env CONFIG_PATH)")
+	f.fs.StringVar(&f.configProfile, "config-profile", profileFromEnv(), "config profile to apply, e.g. prod (env CWSYNC_PROFILE)")
+	f.fs.StringVar(&f.region, "region", "", "AWS region, overrides aws_region")
+	f.fs.StringVar(&f.profile, "profile", "", "AWS profile, overrides aws_profile")
+	f.fs.StringVar(&f.roleARN, "role-arn", "", "IAM role to assume, overrides aws_role_arn")
+	f.fs.StringVar(&f.consulAddr, "consul-addr", "", "consul address, overrides consul.address")
+	f.fs.StringVar(&f.consulTok, "consul-token", "", "consul token, overrides consul.token")
+	f.fs.StringVar(&f.metrics, "metrics-addr", "", "metrics listen address, overrides metrics_addr")
+	f.fs.StringVar(&f.pprof, "pprof-addr", "", "pprof listen address, overrides pprof_addr")
+	f.fs.StringVar(&f.logLevel, "log-level", "", "log level (debug, info, warn, error), overrides log_level")
+	f.fs.StringVar(&f.logFormat, "log-format", "", "log format (text, json), overrides log_format")
+	f.fs.StringVar(&f.color, "color", "", "colorize events on stdout (auto, always, never), overrides color")
+	f.fs.BoolVar(&f.once, "once", false, "do one catch-up pass and exit, overrides run_once")
+	f.fs.BoolVar(&f.leaderElect, "leader-elect", false, "only tail while holding the leader lock in consul, overrides cluster.leader_elect")
+	f.fs.Parse(args)
+	return f
+}
+
+func (f *cliFlags) apply(config *Config) {
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "region":
+			config.AWSRegion = f.region
+		case "profile":
+			config.AWSProfile = f.profile
+		case "role-arn":
+			config.AWSRoleARN = f.roleARN
+		case "consul-addr":
+			config.Consul.Address = f.consulAddr
+		case "consul-token":
+			config.Consul.Token = f.consulTok
+		case "metrics-addr":
+			config.MetricsAddr = f.metrics
+		case "pprof-addr":
+			config.PprofAddr = f.pprof
+		case "log-level":
+			config.LogLevel = f.logLevel
+		case "log-format":
+			config.LogFormat = f.logFormat
+		case "color":
+			config.Color = f.color
+		case "once":
+			config.RunOnce = f.once
+		case "leader-elect":
+			config.Cluster.LeaderElect = f.leaderElect
+		}
+	})
+}
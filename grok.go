@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// grokPatterns is the library of patterns grok expressions can refer to as
+// %{NAME}, a subset of the logstash ones rewritten for RE2.
+var grokPatterns = map[string]string{
+	"USERNAME":          `[a-zA-Z0-9._-]+`,
+	"USER":              `%{USERNAME}`,
+	"EMAILLOCALPART":    `[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+(?:\.[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+)*`,
+	"EMAILADDRESS":      `%{EMAILLOCALPART}@%{HOSTNAME}`,
+	"INT":               `(?:[+-]?[0-9]+)`,
+	"BASE10NUM":         `(?:[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+))`,
+	"NUMBER":            `(?:%{BASE10NUM})`,
+	"BASE16NUM":         `(?:0[xX]?[0-9a-fA-F]+)`,
+	"POSINT":            `\b(?:[1-9][0-9]*)\b`,
+	"NONNEGINT":         `\b(?:[0-9]+)\b`,
+	"WORD":              `\b\w+\b`,
+	"NOTSPACE":          `\S+`,
+	"SPACE":             `\s*`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"QUOTEDSTRING":      `(?:"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*')`,
+	"QS":                `%{QUOTEDSTRING}`,
+	"UUID":              `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"IPV4":              `(?:(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.){3}(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)`,
+	"IPV6":              `(?:[0-9A-Fa-f]{0,4}:){2,7}(?:[0-9A-Fa-f]{1,4}|%{IPV4})?`,
+	"IP":                `(?:%{IPV6}|%{IPV4})`,
+	"HOSTNAME":          `\b(?:[0-9A-Za-z][0-9A-Za-z-]{0,62})(?:\.(?:[0-9A-Za-z][0-9A-Za-z-]{0,62}))*\.?`,
+	"IPORHOST":          `(?:%{IP}|%{HOSTNAME})`,
+	"HOSTPORT":          `%{IPORHOST}:%{POSINT}`,
+	"PATH":              `(?:/[^\s?#]*)+`,
+	"URIPROTO":          `[A-Za-z][A-Za-z0-9+.-]+`,
+	"URIPATH":           `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_-]*)+`,
+	"URIPARAM":          `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\[\]<>-]*`,
+	"URIPATHPARAM":      `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":               `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?(?:%{IPORHOST}(?::%{POSINT})?)?(?:%{URIPATHPARAM})?`,
+	"MONTH":             `\b(?:[Jj]an(?:uary)?|[Ff]eb(?:ruary)?|[Mm]ar(?:ch)?|[Aa]pr(?:il)?|[Mm]ay|[Jj]une?|[Jj]uly?|[Aa]ug(?:ust)?|[Ss]ep(?:tember)?|[Oo]ct(?:ober)?|[Nn]ov(?:ember)?|[Dd]ec(?:ember)?)\b`,
+	"MONTHNUM":          `(?:0?[1-9]|1[0-2])`,
+	"MONTHDAY":          `(?:0[1-9]|[12][0-9]|3[01]|[1-9])`,
+	"YEAR":              `(?:\d\d){1,2}`,
+	"HOUR":              `(?:2[0123]|[01]?[0-9])`,
+	"MINUTE":            `(?:[0-5][0-9])`,
+	"SECOND":            `(?:(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?)`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"ISO8601_TIMEZONE":  `(?:Z|[+-]%{HOUR}(?::?%{MINUTE}))`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?%{ISO8601_TIMEZONE}?`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+	"LOGLEVEL":          `(?:[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo|INFO|[Ww]arn(?:ing)?|WARN(?:ING)?|[Ee]rr(?:or)?|ERR(?:OR)?|[Cc]rit(?:ical)?|CRIT(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|[Ee]merg(?:ency)?|EMERG(?:ENCY)?)`,
+	"COMMONAPACHELOG":   `%{IPORHOST:clientip} %{USER:ident} %{USER:auth} \[%{HTTPDATE:timestamp}\] "(?:%{WORD:verb} %{NOTSPACE:request}(?: HTTP/%{NUMBER:httpversion})?|%{DATA:rawrequest})" %{NUMBER:response:int} (?:%{NUMBER:bytes:int}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} %{QS:referrer} %{QS:agent}`,
+}
+
+// grokReference is %{NAME}, %{NAME:field} or %{NAME:field:type}.
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::([\w.@-]+))?(?::(int|float))?\}`)
+
+// maxGrokDepth bounds how deeply patterns may refer to each other, which
+// also catches patterns referring to themselves.
+const maxGrokDepth = 20
+
+// ParseConfig turns unstructured messages into fields that are encoded like
+// the fields of JSON messages. Either set of Patterns, tried in order, or
+// Dissect is used.
+type ParseConfig struct {
+	// Patterns are grok expressions such as "%{IP:client} %{WORD:method}"
+	Patterns []string `yaml:"patterns"`
+	// Definitions adds patterns to the library, or replaces some of it
+	Definitions map[string]string `yaml:"definitions"`
+	// Dissect splits messages at the text between its %{field} keys
+	Dissect string `yaml:"dissect"`
+	// Field parses this field of JSON messages instead of the message
+	Field string `yaml:"field"`
+	// Unmatched is what happens to messages no pattern matches
+	Unmatched string `yaml:"unmatched"`
+}
+
+func (c ParseConfig) enabled() bool {
+	return len(c.Patterns) > 0 || c.Dissect != ""
+}
+
+func (c ParseConfig) validate() error {
+	if len(c.Patterns) > 0 && c.Dissect != "" {
+		return fmt.Errorf("patterns and dissect cannot be combined")
+	}
+	if !c.enabled() && (len(c.Definitions) > 0 || c.Field != "" || c.Unmatched != "") {
+		return fmt.Errorf("patterns or dissect must be set")
+	}
+	switch c.Unmatched {
+	case "", jsonInvalidKeep, jsonInvalidDrop:
+	default:
+		return fmt.Errorf("unmatched must be %q or %q, got %q", jsonInvalidKeep, jsonInvalidDrop, c.Unmatched)
+	}
+	if c.Dissect != "" {
+		_, err := parseDissect(c.Dissect)
+		return err
+	}
+	for _, pattern := range c.Patterns {
+		if _, err := compileGrok(pattern, c.Definitions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grokCapture is what a capture group of a compiled grok expression is
+// stored as.
+type grokCapture struct {
+	path []string
+	kind string
+}
+
+type grokExpr struct {
+	re       *regexp.Regexp
+	captures map[int]grokCapture
+}
+
+// compileGrok expands the references of pattern into one regular expression.
+// Named references become numbered groups, since field names such as
+// source.ip are not valid group names.
+func compileGrok(pattern string, definitions map[string]string) (*grokExpr, error) {
+	var names []grokCapture
+	var expand func(string, int) (string, error)
+	expand = func(pattern string, depth int) (string, error) {
+		if depth > maxGrokDepth {
+			return "", fmt.Errorf("grok patterns nest too deeply in %q", pattern)
+		}
+		var err error
+		expanded := grokReference.ReplaceAllStringFunc(pattern, func(ref string) string {
+			m := grokReference.FindStringSubmatch(ref)
+			definition, ok := definitions[m[1]]
+			if !ok {
+				definition, ok = grokPatterns[m[1]]
+			}
+			if !ok {
+				err = fmt.Errorf("unknown grok pattern %s in %q", m[1], pattern)
+				return ""
+			}
+			inner, innerErr := expand(definition, depth+1)
+			if innerErr != nil {
+				err = innerErr
+				return ""
+			}
+			if m[2] == "" {
+				return "(?:" + inner + ")"
+			}
+			names = append(names, grokCapture{path: strings.Split(m[2], "."), kind: m[3]})
+			return fmt.Sprintf("(?P<g%d>%s)", len(names)-1, inner)
+		})
+		return expanded, err
+	}
+	expanded, err := expand(pattern, 0)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(expanded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid grok pattern %q: %v", pattern, err)
+	}
+	expr := &grokExpr{re: re, captures: make(map[int]grokCapture)}
+	for i, name := range re.SubexpNames() {
+		var n int
+		if _, err := fmt.Sscanf(name, "g%d", &n); err == nil {
+			expr.captures[i] = names[n]
+		}
+	}
+	return expr, nil
+}
+
+// match returns the fields text has for the expression. Captures that
+// matched nothing, such as an unused alternative, are left out.
+func (e *grokExpr) match(text string, fields map[string]any) bool {
+	m := e.re.FindStringSubmatchIndex(text)
+	if m == nil {
+		return false
+	}
+	for i, capture := range e.captures {
+		if m[2*i] < 0 {
+			continue
+		}
+		setField(fields, capture.path, grokValue(text[m[2*i]:m[2*i+1]], capture.kind))
+	}
+	return true
+}
+
+// grokValue converts a captured value of type int or float to a number,
+// stored like numbers of parsed JSON messages.
+func grokValue(value, kind string) any {
+	switch kind {
+	case "int":
+		if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return json.Number(value)
+		}
+	case "float":
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return json.Number(value)
+		}
+	}
+	return value
+}
+
+// dissectKey is one %{...} of a dissect pattern and the text following it.
+type dissectKey struct {
+	path []string
+	// skip discards the value of %{} and %{?name}, appendTo joins the
+	// value of %{+name} to the earlier one
+	skip, appendTo bool
+	// padding skips repeated delimiters, written as %{name->}
+	padding   bool
+	delimiter string
+}
+
+type dissectPattern struct {
+	prefix string
+	keys   []dissectKey
+}
+
+var dissectReference = regexp.MustCompile(`%\{([^}]*)\}`)
+
+func parseDissect(pattern string) (*dissectPattern, error) {
+	refs := dissectReference.FindAllStringSubmatchIndex(pattern, -1)
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("dissect pattern %q has no %%{field}", pattern)
+	}
+	d := &dissectPattern{prefix: pattern[:refs[0][0]]}
+	for i, ref := range refs {
+		name := pattern[ref[2]:ref[3]]
+		key := dissectKey{}
+		if strings.HasSuffix(name, "->") {
+			key.padding = true
+			name = strings.TrimSuffix(name, "->")
+		}
+		switch {
+		case name == "" || strings.HasPrefix(name, "?"):
+			key.skip = true
+		case strings.HasPrefix(name, "+"):
+			key.appendTo = true
+			name = name[1:]
+		}
+		if !key.skip {
+			key.path = strings.Split(name, ".")
+		}
+		end := len(pattern)
+		if i+1 < len(refs) {
+			end = refs[i+1][0]
+		}
+		key.delimiter = pattern[ref[1]:end]
+		if key.delimiter == "" && i+1 < len(refs) {
+			return nil, fmt.Errorf("dissect pattern %q has keys without text between them", pattern)
+		}
+		d.keys = append(d.keys, key)
+	}
+	return d, nil
+}
+
+func (d *dissectPattern) match(text string, fields map[string]any) bool {
+	rest, ok := strings.CutPrefix(text, d.prefix)
+	if !ok {
+		return false
+	}
+	values := make([]string, len(d.keys))
+	for i, key := range d.keys {
+		if key.delimiter == "" {
+			values[i], rest = rest, ""
+			break
+		}
+		value, after, found := strings.Cut(rest, key.delimiter)
+		if !found {
+			return false
+		}
+		if key.padding {
+			for strings.HasPrefix(after, key.delimiter) {
+				after = after[len(key.delimiter):]
+			}
+		}
+		values[i], rest = value, after
+	}
+	for i, key := range d.keys {
+		if key.skip {
+			continue
+		}
+		value := values[i]
+		if key.appendTo {
+			if earlier, ok := lookupField(fields, key.path); ok {
+				value = fmt.Sprint(earlier) + " " + value
+			}
+		}
+		setField(fields, key.path, value)
+	}
+	return true
+}
+
+// parseStage sets the fields of every event from its message, or from the
+// configured field of JSON messages.
+type parseStage struct {
+	config ParseConfig
+	exprs  []interface {
+		match(string, map[string]any) bool
+	}
+	field []string
+}
+
+func newParseStage(config ParseConfig) *parseStage {
+	s := &parseStage{config: config}
+	// the patterns were validated when loading the config
+	if config.Dissect != "" {
+		d, _ := parseDissect(config.Dissect)
+		s.exprs = append(s.exprs, d)
+	}
+	for _, pattern := range config.Patterns {
+		expr, _ := compileGrok(pattern, config.Definitions)
+		s.exprs = append(s.exprs, expr)
+	}
+	if config.Field != "" {
+		s.field = strings.Split(config.Field, ".")
+	}
+	return s
+}
+
+func (s *parseStage) apply(event logEvent, out []logEvent) []logEvent {
+	text := event.Message
+	fields := event.Fields
+	if s.field != nil {
+		// without json settings the message is parsed here, a message
+		// that is not a JSON object has no field to match
+		if fields == nil {
+			fields, _ = parseJSONObject(event.Message)
+		}
+		value, _ := lookupField(fields, s.field)
+		text, _ = value.(string)
+	}
+	if fields == nil {
+		fields = make(map[string]any)
+	}
+	for _, expr := range s.exprs {
+		if expr.match(text, fields) {
+			event.Fields = fields
+			return append(out, event)
+		}
+	}
+	if s.config.Unmatched == jsonInvalidDrop {
+		return out
+	}
+	return append(out, event)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+const defaultMaxConcurrentFetches = 5
+
+// groupSemaphores caps how many GetLogEvents calls run at the same time for
+// one log group. CloudWatch throttles per group, so after a restart the
+// tailers of a big group queue here instead of all calling at once.
+var (
+	groupSemaphoresMu sync.Mutex
+	groupSemaphores   = make(map[string]chan struct{})
+)
+
+func groupSemaphore(logConfig LogConfig) chan struct{} {
+	groupSemaphoresMu.Lock()
+	defer groupSemaphoresMu.Unlock()
+	sem, ok := groupSemaphores[logConfig.LogGroupName]
+	if !ok {
+		size := logConfig.MaxConcurrentFetches
+		if size <= 0 {
+			size = defaultMaxConcurrentFetches
+		}
+		sem = make(chan struct{}, size)
+		groupSemaphores[logConfig.LogGroupName] = sem
+	}
+	return sem
+}
+
+// acquireGroupSlot blocks until a fetch slot for the log group is free and
+// returns the function releasing it.
+func acquireGroupSlot(ctx context.Context, logConfig LogConfig) (func(), error) {
+	sem := groupSemaphore(logConfig)
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+const (
+	fetchModeStreams = "streams"
+	fetchModeGroup   = "group"
+)
+
+// groupOffsetSuffix is appended to the offset prefix of a log group to store
+// the checkpoint of a group tail. Stream names cannot contain ':', so the key
+// never collides with a stream offset.
+const groupOffsetSuffix = "/:group"
+
+// groupTail fetches all streams of a log group with FilterLogEvents from a
+// single goroutine. Streams are never listed, so groups with many short-lived
+// streams cost one API call per poll instead of one per stream, and there is
+// one checkpoint for the whole group.
+//
+// FilterLogEvents returns the events of all streams ordered by timestamp, but
+// streams are ingested with different delays; an event that shows up after
+// the group moved past its timestamp is only picked up with a
+// late_event_window.
+type groupTail struct {
+	m         *tailerManager
+	ctx       context.Context
+	cwLogs    *cloudwatchlogs.CloudWatchLogs
+	service   ServiceConfig
+	logConfig LogConfig
+	key       string
+	filter    *patternFilter
+	end       *endBound
+	log       logger
+}
+
+type groupFetchResult struct {
+	resp *cloudwatchlogs.FilterLogEventsOutput
+	err  error
+}
+
+func (g *groupTail) fetch(startTime int64, token *string) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	_, _, fetchLimit := g.logConfig.pollSettings(g.service)
+	params := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName: aws.String(g.logConfig.LogGroupName),
+		StartTime:    aws.Int64(startTime),
+		Limit:        aws.Int64(fetchLimit),
+		NextToken:    token,
+	}
+	if g.logConfig.LogStreamPrefix != "" {
+		params.LogStreamNamePrefix = aws.String(g.logConfig.LogStreamPrefix)
+	}
+	if g.end != nil {
+		params.EndTime = aws.Int64(g.end.millis())
+	}
+	return g.cwLogs.FilterLogEventsWithContext(g.ctx, params)
+}
+
+func (m *tailerManager) startGroup(cwLogs *cloudwatchlogs.CloudWatchLogs, service ServiceConfig, logConfig LogConfig) error {
+	filter, err := newStreamFilter(logConfig)
+	if err != nil {
+		return err
+	}
+	key := tailerKey(service, logConfig, "")
+	if !m.cluster.owns(key) {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.running[key]; ok {
+		return nil
+	}
+	if !m.cluster.claim(key) {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	t := &tailer{cancel: cancel}
+	m.running[key] = t
+	end, _ := parseEndBound(service.EndTime)
+	log := streamLogger(tailLog, service.Name, logConfig.LogGroupName, "")
+	g := &groupTail{m: m, ctx: ctx, cwLogs: cwLogs, service: service, logConfig: logConfig, key: key, filter: filter, end: end, log: log}
+	log.Debugf("Discovered log group %s for %s", logConfig.LogGroupName, service.Name)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer m.release(key, t)
+		if !sleepContext(ctx, m.startDelay()) {
+			return
+		}
+		if g.run() {
+			// Forget the group so discovery starts it again if a group
+			// with the same name is created again.
+			m.forget(key, t)
+		}
+	}()
+	return nil
+}
+
+// run tails the group until the context is cancelled, the group is caught up
+// or keeps failing in run-once mode or is past end_time, or the group is
+// deleted, in which case it returns true.
+func (g *groupTail) run() bool {
+	ctx, service, logConfig, groupName := g.ctx, g.service, g.logConfig, g.logConfig.LogGroupName
+	offsetPath := g.m.offsets.base(service, groupName) + groupOffsetSuffix
+
+	var checkpoint int64
+	var ids []string
+	if service.TailFromLatest {
+		checkpoint = time.Now().UnixMilli()
+	} else {
+		checkpoint, ids = loadOffsetFromConsul(g.m.consulClient, offsetPath, g.m.offsetFallbackDuration)
+	}
+	boundary := newResumeBoundary(checkpoint, ids)
+	startTime := checkpoint
+	byIngestion := service.CheckpointBy == checkpointByIngestionTime
+	if byIngestion && !service.TailFromLatest {
+		startTime = checkpoint - service.ingestionLookback().Milliseconds()
+	}
+	if oldest := service.oldestTimestamp(time.Now()); startTime < oldest {
+		g.log.Infof("Skipping events of log group %s older than max_event_age %s", groupName, time.Duration(service.MaxEventAge))
+		startTime = oldest
+	}
+	g.log.Infof("Starting to tail log group %s from timestamp %d (%s)", groupName, startTime, time.Unix(startTime/1000, 0).Format(time.RFC3339))
+
+	end := g.end
+	pollInterval, maxPollInterval, _ := logConfig.pollSettings(service)
+	retryDelay := pollInterval
+	baseDelay, maxDelay := service.errorBackoff()
+	errorDelay := baseDelay
+	failures := 0
+	lateWindow := time.Duration(service.LateEventWindow).Milliseconds()
+	// queries restart at the newest timestamp rather than after it, so
+	// events of other streams with the same millisecond are not lost;
+	// seen drops the ones already written
+	seen := newSeenEvents()
+	resumed := newResumeCutoff(checkpoint, byIngestion)
+	newestTimestamp := startTime
+	var nextToken *string
+	var events []logEvent
+	// prefetch delivers the next page of the query, requested while the
+	// current one is being written
+	var prefetch chan groupFetchResult
+
+	for {
+		var resp *cloudwatchlogs.FilterLogEventsOutput
+		var err error
+		if prefetch != nil {
+			result := <-prefetch
+			prefetch = nil
+			resp, err = result.resp, result.err
+		} else {
+			resp, err = g.fetch(startTime, nextToken)
+		}
+
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException {
+			g.log.Infof("Log group %s no longer exists, stopping tailer", groupName)
+			return true
+		}
+		if err != nil && ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			g.log.Errorf("Error filtering log events of group %s: %v", groupName, err)
+			recordFetchError(g.key, service, groupName, "", checkpoint, err)
+			if failures++; giveUp(g.m.runOnce, failures) {
+				g.log.Errorf("Giving up on log group %s after %d failed fetches", groupName, failures)
+				break
+			}
+			if !sleepContext(ctx, jitter(errorDelay)) {
+				break
+			}
+			if isThrottlingError(err) && errorDelay < maxDelay {
+				errorDelay = min(errorDelay*2, maxDelay)
+			}
+			continue
+		}
+		errorDelay, failures = baseDelay, 0
+
+		if resp.NextToken != nil {
+			ch := make(chan groupFetchResult, 1)
+			go func(startTime int64, token *string) {
+				resp, err := g.fetch(startTime, token)
+				ch <- groupFetchResult{resp, err}
+			}(startTime, resp.NextToken)
+			prefetch = ch
+		}
+		events = events[:0]
+		for _, event := range resp.Events {
+			if *event.Timestamp > newestTimestamp {
+				newestTimestamp = *event.Timestamp
+			}
+			if byIngestion && *event.IngestionTime < checkpoint {
+				continue
+			}
+			if resumed.written(*event.Timestamp, *event.IngestionTime) {
+				continue
+			}
+			if !seen.addID(*event.EventId, *event.Timestamp) {
+				continue
+			}
+			if !g.filter.match(*event.LogStreamName) {
+				continue
+			}
+			at := *event.Timestamp
+			if byIngestion {
+				at = *event.IngestionTime
+			}
+			if boundary.tracks(at) {
+				if boundary.written(at, *event.EventId) {
+					continue
+				}
+				boundary.record(at, *event.EventId)
+			}
+			events = append(events, logEvent{
+				LogGroup:      groupName,
+				LogStream:     *event.LogStreamName,
+				Timestamp:     *event.Timestamp,
+				IngestionTime: *event.IngestionTime,
+				Message:       *event.Message,
+			})
+			if byIngestion && *event.IngestionTime > checkpoint {
+				checkpoint = *event.IngestionTime
+			}
+		}
+		if !byIngestion && newestTimestamp > checkpoint {
+			checkpoint = newestTimestamp
+		}
+		writeEvents(service, events)
+		if len(resp.Events) > 0 {
+			recordFetch(g.key, service, groupName, "", checkpoint, newestTimestamp, false)
+		}
+		if len(events) > 0 {
+			if err := saveOffsetToConsul(g.m.consulClient, offsetPath, checkpoint, boundary.saved(checkpoint)); err != nil {
+				g.log.Errorf("Error saving offset to Consul: %v", err)
+			}
+			retryDelay = pollInterval
+		}
+		// pages come in timestamp order and the next query starts
+		// lateWindow behind the newest event, nothing older is read again
+		seen.prune(newestTimestamp - lateWindow)
+		if resp.NextToken != nil {
+			nextToken = resp.NextToken
+			continue
+		}
+
+		// the query is exhausted, the next one starts a new time range
+		recordFetch(g.key, service, groupName, "", checkpoint, newestTimestamp, true)
+		if g.m.runOnce {
+			g.log.Infof("Log group %s is caught up", groupName)
+			return false
+		}
+		if end != nil && end.reached() {
+			g.log.Infof("Log group %s reached end_time %s, stopping tailer", groupName, service.EndTime)
+			return false
+		}
+		nextToken = nil
+		startTime = newestTimestamp - lateWindow
+		if !sleepContext(ctx, retryDelay) {
+			break
+		}
+		if retryDelay < maxPollInterval {
+			retryDelay = min(retryDelay*2, maxPollInterval)
+		}
+	}
+	g.log.Infof("Stopped tailing log group %s", groupName)
+	return false
+}
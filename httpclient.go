@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+// proxyFunc returns the proxy selector for outbound HTTP clients. Without an
+// explicit proxy_url the usual HTTP(S)_PROXY/NO_PROXY variables still apply.
+func proxyFunc(proxyURL string) (func(*http.Request) (*url.URL, error), error) {
+	if proxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy_url: %v", err)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// loadCABundle returns the system roots with the PEM bundle appended, so a
+// TLS-intercepting proxy's CA can be trusted without losing the public CAs.
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca_bundle: %v", err)
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in ca_bundle %s", path)
+	}
+	return pool, nil
+}
+
+func newHTTPTransport(config Config) *http.Transport {
+	transport := cleanhttp.DefaultPooledTransport()
+	proxy, err := proxyFunc(config.ProxyURL)
+	if err != nil {
+		awsLog.Fatalf("%v", err)
+	}
+	transport.Proxy = proxy
+	if config.CABundle != "" {
+		pool, err := loadCABundle(config.CABundle)
+		if err != nil {
+			awsLog.Fatalf("%v", err)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return transport
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// loadIncludes appends the services of every file matched by the include
+// patterns to config.Services. Each included file holds a single service in
+// the same format as an entry of services, so a team can own its file in a
+// conf.d directory. Patterns are globs relative to the main config file; a
+// matched directory includes all its YAML, JSON and TOML files.
+func loadIncludes(configPath string, config *Config) error {
+	dir := filepath.Dir(configPath)
+	for _, pattern := range config.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid include pattern %q: %v", pattern, err)
+		}
+		for _, match := range matches {
+			files, err := includedFiles(match)
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				service, err := readServiceFile(file)
+				if err != nil {
+					return err
+				}
+				config.Services = append(config.Services, service)
+			}
+		}
+	}
+	return nil
+}
+
+func includedFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read included file: %v", err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read include directory: %v", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".yaml", ".yml", ".json", ".toml":
+			if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func readServiceFile(path string) (ServiceConfig, error) {
+	var service ServiceConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return service, fmt.Errorf("failed to read included file: %v", err)
+	}
+	format, err := configFormat(path)
+	if err != nil {
+		return service, err
+	}
+	if data, err = decryptSOPS(path, data, format); err != nil {
+		return service, err
+	}
+	data, err = interpolateEnv(data)
+	if err != nil {
+		return service, fmt.Errorf("failed to interpolate %s: %v", path, err)
+	}
+	if err := decodeConfig(data, format, &service); err != nil {
+		return service, fmt.Errorf("failed to unmarshal included file:\n%s", strings.Join(decodeErrors(path, format != configFormatTOML, err), "\n"))
+	}
+	service.origin = path
+	return service, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// runInit writes a starter config for a set of log groups. Without -log-group
+// the log groups of the account are listed and the user picks some; with -yes
+// every listed group is taken without asking.
+func runInit(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	output := fs.String("output", "config.yaml", "path of the config file to write")
+	force := fs.Bool("force", false, "overwrite an existing config file")
+	region := fs.String("region", os.Getenv("AWS_REGION"), "AWS region of the log groups")
+	profile := fs.String("profile", "", "AWS profile used to list log groups")
+	consulAddr := fs.String("consul-addr", "http://localhost:8500", "consul address")
+	kvPrefix := fs.String("kv-prefix", "cwsync", "consul KV prefix for the offsets")
+	groupPrefix := fs.String("prefix", "", "only list log groups starting with this prefix")
+	yes := fs.Bool("yes", false, "take every listed log group without asking")
+	var logGroups stringList
+	fs.Var(&logGroups, "log-group", "log group to add, repeatable; skips listing")
+	fs.Parse(args)
+
+	if *region == "" {
+		fmt.Fprintln(os.Stderr, "usage: cwsync init -region <region> [-profile <profile>] [-prefix <prefix>] [-log-group <name>]... [-yes] [-output config.yaml]")
+		os.Exit(2)
+	}
+	if _, err := os.Stat(*output); err == nil && !*force {
+		mainLog.Fatalf("%s already exists, use -force to overwrite it", *output)
+	}
+
+	if len(logGroups) == 0 {
+		config := Config{AWSRegion: *region, AWSProfile: *profile}
+		cwLogs := newCloudWatchLogsClient(createAWSSession(config), config, newAPILimiter(config.APIRateLimits))
+		available, err := listLogGroupNames(context.Background(), cwLogs, *groupPrefix)
+		if err != nil {
+			mainLog.Fatalf("failed to list log groups: %v", err)
+		}
+		if len(available) == 0 {
+			mainLog.Fatalf("no log groups found in %s", *region)
+		}
+		if *yes {
+			logGroups = available
+		} else if logGroups, err = pickLogGroups(os.Stdin, os.Stdout, available); err != nil {
+			mainLog.Fatalf("%v", err)
+		}
+	}
+
+	data, err := renderStarterConfig(*region, *profile, *consulAddr, *kvPrefix, logGroups)
+	if err != nil {
+		mainLog.Fatalf("failed to render config: %v", err)
+	}
+	// the scaffold must pass the same checks as a hand-written config
+	var generated Config
+	if err := decodeConfig(data, configFormatYAML, &generated); err != nil {
+		mainLog.Fatalf("generated config does not decode: %v", err)
+	}
+	if errs := validateConfig(generated); len(errs) > 0 {
+		mainLog.Fatalf("generated config is invalid: %s", errs[0].format(*output, nil))
+	}
+	if err := os.WriteFile(*output, data, 0o644); err != nil {
+		mainLog.Fatalf("failed to write %s: %v", *output, err)
+	}
+	fmt.Printf("Wrote %s with %d services, check it with: cwsync validate --config %s\n", *output, len(generated.Services), *output)
+}
+
+func listLogGroupNames(ctx context.Context, cwLogs *cloudwatchlogs.CloudWatchLogs, prefix string) ([]string, error) {
+	input := &cloudwatchlogs.DescribeLogGroupsInput{}
+	if prefix != "" {
+		input.LogGroupNamePrefix = aws.String(prefix)
+	}
+	var names []string
+	err := cwLogs.DescribeLogGroupsPagesWithContext(ctx, input, func(page *cloudwatchlogs.DescribeLogGroupsOutput, lastPage bool) bool {
+		for _, group := range page.LogGroups {
+			names = append(names, *group.LogGroupName)
+		}
+		return !lastPage
+	})
+	return names, err
+}
+
+// pickLogGroups shows the numbered log groups and reads a selection such as
+// "1,3,5-7" or "all".
+func pickLogGroups(in io.Reader, out io.Writer, available []string) ([]string, error) {
+	for i, name := range available {
+		fmt.Fprintf(out, "%4d  %s\n", i+1, name)
+	}
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "Log groups to sync (e.g. 1,3,5-7 or all): ")
+		if !scanner.Scan() {
+			return nil, fmt.Errorf("no log groups selected")
+		}
+		picked, err := parseSelection(strings.TrimSpace(scanner.Text()), available)
+		if err == nil && len(picked) > 0 {
+			return picked, nil
+		}
+		if err != nil {
+			fmt.Fprintln(out, err)
+		}
+	}
+}
+
+func parseSelection(input string, available []string) ([]string, error) {
+	if input == "all" {
+		return available, nil
+	}
+	var picked []string
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(input, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selection %q", part)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(last); err != nil {
+				return nil, fmt.Errorf("invalid selection %q", part)
+			}
+		}
+		if from < 1 || to > len(available) || from > to {
+			return nil, fmt.Errorf("selection %q is out of range 1-%d", part, len(available))
+		}
+		for i := from; i <= to; i++ {
+			if !seen[i] {
+				seen[i] = true
+				picked = append(picked, available[i-1])
+			}
+		}
+	}
+	return picked, nil
+}
+
+var serviceNameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// serviceNameFor derives a service name from the last segment of the log
+// group, e.g. "payments" for "/aws/lambda/payments".
+func serviceNameFor(logGroup string, taken map[string]bool) string {
+	name := strings.Trim(serviceNameUnsafe.ReplaceAllString(path.Base(logGroup), "-"), "-")
+	if name == "" {
+		name = "service"
+	}
+	unique := name
+	for i := 2; taken[unique]; i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	taken[unique] = true
+	return unique
+}
+
+var starterConfig = template.Must(template.New("config").Parse(`# generated by cwsync init, see the README for every setting
+aws_region: {{printf "%q" .Region}}
+{{- if .Profile}}
+aws_profile: {{printf "%q" .Profile}}
+{{- end}}
+
+consul:
+  address: {{printf "%q" .ConsulAddr}}
+  # token: "<consul ACL token>"
+
+# start new streams this far back when no offset is stored yet
+offset_fallback_duration: "1h"
+
+defaults:
+  poll_interval: "10s"
+  max_poll_interval: "5m"
+  fetch_limit: 500
+  destination:
+    type: stdout
+
+services:
+{{- range .Services}}
+  - name: {{printf "%q" .Name}}
+    consul_kv_path: {{printf "%q" .KVPath}}
+    log_configs:
+      - log_group_name: {{printf "%q" .LogGroup}}
+{{- end}}
+`))
+
+func renderStarterConfig(region, profile, consulAddr, kvPrefix string, logGroups []string) ([]byte, error) {
+	type starterService struct {
+		Name, KVPath, LogGroup string
+	}
+	data := struct {
+		Region, Profile, ConsulAddr string
+		Services                    []starterService
+	}{Region: region, Profile: profile, ConsulAddr: consulAddr}
+
+	taken := make(map[string]bool)
+	added := make(map[string]bool)
+	for _, logGroup := range logGroups {
+		if added[logGroup] {
+			continue
+		}
+		added[logGroup] = true
+		name := serviceNameFor(logGroup, taken)
+		data.Services = append(data.Services, starterService{
+			Name:     name,
+			KVPath:   strings.Trim(kvPrefix, "/") + "/" + name,
+			LogGroup: logGroup,
+		})
+	}
+	var out strings.Builder
+	if err := starterConfig.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	return []byte(out.String()), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// envPattern matches ${VAR} and ${VAR:-default}. A bare $VAR is left alone so
+// regexes like "^/aws/lambda/.*$" in the config keep working; "$${" escapes a
+// literal "${".
+var envPattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// blockScalarPattern matches the end of a line starting a literal or folded
+// block scalar, such as "template: |" or "- >-".
+var blockScalarPattern = regexp.MustCompile(`(^|[\s:-])[|>][-+0-9]*\s*$`)
+
+// interpolateEnv expands the references in data line by line, leaving YAML
+// comments alone so commented-out lines cannot fail the config. Lines of
+// block scalars are content, "#" included.
+func interpolateEnv(data []byte) ([]byte, error) {
+	var missing []string
+	expand := func(text []byte) []byte {
+		return envPattern.ReplaceAllFunc(text, func(match []byte) []byte {
+			if bytes.HasPrefix(match, []byte("$$")) {
+				return match[1:]
+			}
+			groups := envPattern.FindSubmatch(match)
+			name := string(groups[1])
+			if value, ok := os.LookupEnv(name); ok {
+				return []byte(value)
+			}
+			if len(groups[2]) > 0 {
+				return groups[3]
+			}
+			missing = append(missing, name)
+			return nil
+		})
+	}
+	var out bytes.Buffer
+	// block is the indentation of the line starting the block scalar being
+	// read, -1 outside of one
+	block := -1
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		indent := len(line) - len(bytes.TrimLeft(line, " "))
+		if block >= 0 && (len(bytes.TrimSpace(line)) == 0 || indent > block) {
+			out.Write(expand(line))
+			continue
+		}
+		block = -1
+		code, comment := splitComment(line)
+		out.Write(expand(code))
+		out.Write(comment)
+		if blockScalarPattern.Match(code) {
+			block = indent
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	return out.Bytes(), nil
+}
+
+// splitComment splits a line before its comment, a "#" at the start or after
+// whitespace outside of a quoted scalar.
+func splitComment(line []byte) ([]byte, []byte) {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote == '\'' && c == '\'' && i+1 < len(line) && line[i+1] == '\'':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			// quotes only open a scalar at its start, "don't" is plain
+			if i == 0 || bytes.IndexByte([]byte(" \t:[{,-"), line[i-1]) >= 0 {
+				quote = c
+			}
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i], line[i:]
+		}
+	}
+	return line, nil
+}
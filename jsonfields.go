@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	jsonInvalidKeep = "keep"
+	jsonInvalidDrop = "drop"
+)
+
+// JSONConfig parses messages as JSON objects so fields can be selected,
+// flattened and renamed. The message is written as the re-encoded object.
+type JSONConfig struct {
+	// Fields keeps only these fields; nested ones are given as dotted
+	// paths such as request.id
+	Fields []string `yaml:"fields"`
+	// Flatten turns nested objects into dotted keys
+	Flatten bool              `yaml:"flatten"`
+	Rename  map[string]string `yaml:"rename"`
+	// Invalid is what happens to messages that are not a JSON object
+	Invalid string `yaml:"invalid"`
+}
+
+func (c JSONConfig) enabled() bool {
+	return len(c.Fields) > 0 || c.Flatten || len(c.Rename) > 0 || c.Invalid != ""
+}
+
+func (c JSONConfig) validate() error {
+	switch c.Invalid {
+	case "", jsonInvalidKeep, jsonInvalidDrop:
+	default:
+		return fmt.Errorf("invalid must be %q or %q, got %q", jsonInvalidKeep, jsonInvalidDrop, c.Invalid)
+	}
+	for _, field := range c.Fields {
+		if field == "" || strings.HasPrefix(field, ".") || strings.HasSuffix(field, ".") || strings.Contains(field, "..") {
+			return fmt.Errorf("invalid field %q", field)
+		}
+	}
+	return nil
+}
+
+type jsonStage struct {
+	config JSONConfig
+	paths  [][]string
+}
+
+func newJSONStage(config JSONConfig) *jsonStage {
+	s := &jsonStage{config: config}
+	for _, field := range config.Fields {
+		s.paths = append(s.paths, strings.Split(field, "."))
+	}
+	return s
+}
+
+func (s *jsonStage) apply(event logEvent, out []logEvent) []logEvent {
+	fields, ok := parseJSONObject(event.Message)
+	if !ok {
+		if s.config.Invalid == jsonInvalidDrop {
+			return out
+		}
+		return append(out, event)
+	}
+	if len(s.paths) > 0 {
+		selected := make(map[string]any, len(s.paths))
+		for i, path := range s.paths {
+			if value, ok := lookupField(fields, path); ok {
+				if s.config.Flatten {
+					selected[s.config.Fields[i]] = value
+				} else {
+					setField(selected, path, value)
+				}
+			}
+		}
+		fields = selected
+	}
+	if s.config.Flatten {
+		fields = flattenFields(fields)
+	}
+	for from, to := range s.config.Rename {
+		if value, ok := fields[from]; ok {
+			delete(fields, from)
+			fields[to] = value
+		}
+	}
+	event.Fields = fields
+	return append(out, event)
+}
+
+// parseJSONObject decodes a message holding exactly one JSON object. Numbers
+// are kept as json.Number so large IDs survive re-encoding unchanged.
+func parseJSONObject(message string) (map[string]any, bool) {
+	trimmed := strings.TrimSpace(message)
+	if !strings.HasPrefix(trimmed, "{") {
+		return nil, false
+	}
+	dec := json.NewDecoder(strings.NewReader(trimmed))
+	dec.UseNumber()
+	var fields map[string]any
+	if err := dec.Decode(&fields); err != nil || dec.More() {
+		return nil, false
+	}
+	return fields, true
+}
+
+func lookupField(fields map[string]any, path []string) (any, bool) {
+	var value any = fields
+	for _, key := range path {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func setField(fields map[string]any, path []string, value any) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := fields[key].(map[string]any)
+		if !ok {
+			next = make(map[string]any)
+			fields[key] = next
+		}
+		fields = next
+	}
+	fields[path[len(path)-1]] = value
+}
+
+func flattenFields(fields map[string]any) map[string]any {
+	flat := make(map[string]any, len(fields))
+	var walk func(prefix string, object map[string]any)
+	walk = func(prefix string, object map[string]any) {
+		for key, value := range object {
+			if nested, ok := value.(map[string]any); ok && len(nested) > 0 {
+				walk(prefix+key+".", nested)
+				continue
+			}
+			flat[prefix+key] = value
+		}
+	}
+	walk("", fields)
+	return flat
+}
+
+// encodeFields renders parsed fields as the message of an event, with keys
+// in sorted order and without escaping HTML characters.
+func encodeFields(fields map[string]any) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(fields); err != nil {
+		// values come from decoding JSON, so this does not happen
+		return fmt.Sprint(fields)
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
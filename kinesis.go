@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	sourcePoll    = "poll"
+	sourceKinesis = "kinesis"
+
+	kinesisIdleDelay  = time.Second
+	kinesisErrorDelay = 10 * time.Second
+)
+
+type KinesisConfig struct {
+	StreamName    string `yaml:"stream_name"`
+	StartPosition string `yaml:"start_position"`
+}
+
+// subscriptionPayload is the gzipped JSON document CloudWatch Logs puts on
+// the Kinesis stream for a subscription filter.
+type subscriptionPayload struct {
+	MessageType string `json:"messageType"`
+	Owner       string `json:"owner"`
+	LogGroup    string `json:"logGroup"`
+	LogStream   string `json:"logStream"`
+	LogEvents   []struct {
+		ID        string `json:"id"`
+		Timestamp int64  `json:"timestamp"`
+		Message   string `json:"message"`
+	} `json:"logEvents"`
+}
+
+func decodeSubscriptionPayload(data []byte) (*subscriptionPayload, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	raw, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	var payload subscriptionPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, err
+	}
+	return &payload, nil
+}
+
+// kinesisConsumer reads every shard of a Kinesis stream fed by CloudWatch
+// subscription filters. The last processed sequence number of each shard is
+// kept in Consul under the service's KV path.
+type kinesisConsumer struct {
+	ctx          context.Context
+	mu           sync.Mutex
+	running      map[string]bool
+	client       *kinesis.Kinesis
+	service      ServiceConfig
+	consulClient *api.Client
+	offsets      offsetPaths
+	cluster      *cluster
+	runOnce      bool
+	wg           sync.WaitGroup
+}
+
+func newKinesisConsumer(ctx context.Context, sess *session.Session, cluster *cluster, service ServiceConfig, consulClient *api.Client, offsets offsetPaths, runOnce bool) *kinesisConsumer {
+	return &kinesisConsumer{
+		ctx:          ctx,
+		cluster:      cluster,
+		runOnce:      runOnce,
+		running:      make(map[string]bool),
+		client:       kinesis.New(sess),
+		service:      service,
+		consulClient: consulClient,
+		offsets:      offsets,
+	}
+}
+
+// syncShards starts a reader for shards that appeared since the last call,
+// e.g. after the stream was resharded.
+func (c *kinesisConsumer) syncShards() error {
+	var shards []*kinesis.Shard
+	input := &kinesis.ListShardsInput{StreamName: aws.String(c.service.Kinesis.StreamName)}
+	for {
+		resp, err := c.client.ListShardsWithContext(c.ctx, input)
+		if err != nil {
+			return err
+		}
+		shards = append(shards, resp.Shards...)
+		if resp.NextToken == nil {
+			break
+		}
+		input = &kinesis.ListShardsInput{NextToken: resp.NextToken}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, shard := range shards {
+		shardID := *shard.ShardId
+		key := c.shardKey(shardID)
+		if c.running[shardID] || !c.cluster.owns(key) || !c.cluster.claim(key) {
+			continue
+		}
+		c.running[shardID] = true
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			done := c.readShard(shardID)
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.cluster.release(key)
+			forgetStream(key)
+			if !done {
+				// handed over to another cluster member, which may
+				// hand it back later
+				delete(c.running, shardID)
+			}
+		}()
+	}
+	return nil
+}
+
+// shardKey identifies a shard when streams are partitioned across a cluster.
+func (c *kinesisConsumer) shardKey(shardID string) string {
+	return c.service.Name + "|kinesis|" + shardID
+}
+
+func (c *kinesisConsumer) discoverPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.cluster.memberChanges():
+		}
+		if err := c.syncShards(); err != nil && c.ctx.Err() == nil {
+			kinesisLog.Errorf("Error listing shards of %s: %v", c.service.Kinesis.StreamName, err)
+		}
+	}
+}
+
+func (c *kinesisConsumer) shardIterator(shardID string, kvPath string) (*string, error) {
+	input := &kinesis.GetShardIteratorInput{
+		StreamName: aws.String(c.service.Kinesis.StreamName),
+		ShardId:    aws.String(shardID),
+	}
+	kvPair, _, err := c.consulClient.KV().Get(kvPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if kvPair != nil {
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+		input.StartingSequenceNumber = aws.String(string(kvPair.Value))
+	} else if c.service.Kinesis.StartPosition == kinesis.ShardIteratorTypeTrimHorizon {
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeTrimHorizon)
+	} else {
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeLatest)
+	}
+
+	resp, err := c.client.GetShardIteratorWithContext(c.ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return resp.ShardIterator, nil
+}
+
+// readShard reads the shard until it is closed, caught up in run-once mode or
+// the context is cancelled, and returns false if it stopped because another
+// cluster member took the shard over or the cluster session was lost.
+func (c *kinesisConsumer) readShard(shardID string) bool {
+	kvPath := c.offsets.base(c.service, "") + "/kinesis/" + shardID
+	log := streamLogger(kinesisLog, c.service.Name, c.service.Kinesis.StreamName, shardID)
+	log.Infof("Starting to read shard %s of %s", shardID, c.service.Kinesis.StreamName)
+
+	lost := c.cluster.sessionLoss()
+	var iterator *string
+	var events []logEvent
+	failures := 0
+	for c.ctx.Err() == nil {
+		if !c.cluster.owns(c.shardKey(shardID)) {
+			log.Infof("Handing shard %s of %s over to another cluster member", shardID, c.service.Kinesis.StreamName)
+			return false
+		}
+		select {
+		case <-lost:
+			log.Errorf("Cluster session lost, stopping reader of shard %s", shardID)
+			return false
+		default:
+		}
+		if iterator == nil {
+			var err error
+			iterator, err = c.shardIterator(shardID, kvPath)
+			if err != nil {
+				log.Errorf("Error getting iterator for shard %s: %v", shardID, err)
+				recordShardError(c.shardKey(shardID), c.service, shardID, err)
+				if failures++; giveUp(c.runOnce, failures) {
+					log.Errorf("Giving up on shard %s after %d failed calls", shardID, failures)
+					return true
+				}
+				sleepContext(c.ctx, kinesisErrorDelay)
+				continue
+			}
+		}
+
+		resp, err := c.client.GetRecordsWithContext(c.ctx, &kinesis.GetRecordsInput{ShardIterator: iterator})
+		if err != nil && c.ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			// expired iterators are recreated from the stored checkpoint
+			log.Errorf("Error getting records from shard %s: %v", shardID, err)
+			recordShardError(c.shardKey(shardID), c.service, shardID, err)
+			if failures++; giveUp(c.runOnce, failures) {
+				log.Errorf("Giving up on shard %s after %d failed calls", shardID, failures)
+				return true
+			}
+			iterator = nil
+			sleepContext(c.ctx, kinesisErrorDelay)
+			continue
+		}
+
+		failures = 0
+		events = events[:0]
+		for _, record := range resp.Records {
+			payload, err := decodeSubscriptionPayload(record.Data)
+			if err != nil {
+				log.Warnf("Skipping undecodable record %s in shard %s: %v", *record.SequenceNumber, shardID, err)
+				continue
+			}
+			// CONTROL_MESSAGE records are sent by CloudWatch to check the
+			// destination is reachable and carry no log events.
+			if payload.MessageType != "DATA_MESSAGE" {
+				continue
+			}
+			for _, event := range payload.LogEvents {
+				events = append(events, logEvent{
+					LogGroup:  payload.LogGroup,
+					LogStream: payload.LogStream,
+					Timestamp: event.Timestamp,
+					Message:   event.Message,
+					Account:   payload.Owner,
+				})
+			}
+		}
+		writeEvents(c.service, events)
+		var sequence string
+		if len(resp.Records) > 0 {
+			sequence = *resp.Records[len(resp.Records)-1].SequenceNumber
+		}
+		recordShardFetch(c.shardKey(shardID), c.service, shardID, sequence, aws.Int64Value(resp.MillisBehindLatest), len(resp.Records))
+		if sequence != "" {
+			if _, err := c.consulClient.KV().Put(&api.KVPair{Key: kvPath, Value: []byte(sequence)}, nil); err != nil {
+				log.Errorf("Error saving shard checkpoint to Consul: %v", err)
+			}
+		}
+
+		if resp.NextShardIterator == nil {
+			log.Infof("Shard %s of %s is closed, stopping reader", shardID, c.service.Kinesis.StreamName)
+			return true
+		}
+		iterator = resp.NextShardIterator
+		if c.runOnce && len(resp.Records) == 0 && aws.Int64Value(resp.MillisBehindLatest) == 0 {
+			log.Infof("Shard %s of %s is caught up", shardID, c.service.Kinesis.StreamName)
+			return true
+		}
+		if len(resp.Records) == 0 {
+			sleepContext(c.ctx, kinesisIdleDelay)
+		}
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// kvPathVars are the variables available in a templated consul_kv_path, e.g.
+// "cwsync/{{.Region}}/{{.Service}}{{.LogGroup}}".
+type kvPathVars struct {
+	Service  string
+	LogGroup string
+	Region   string
+}
+
+func expandKVPath(path string, vars kvPathVars) (string, error) {
+	if !strings.Contains(path, "{{") {
+		return path, nil
+	}
+	tmpl, err := template.New("consul_kv_path").Option("missingkey=error").Parse(path)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, vars); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// offsetPaths builds the Consul key under which a service stores its offsets:
+// the expanded consul_kv_path below the global consul.kv_prefix.
+type offsetPaths struct {
+	prefix string
+	region string
+}
+
+func newOffsetPaths(config Config, sess *session.Session) offsetPaths {
+	return offsetPaths{
+		prefix: strings.Trim(config.Consul.KVPrefix, "/"),
+		region: aws.StringValue(sess.Config.Region),
+	}
+}
+
+// base returns the offset key prefix of a log group of the service (the log
+// group is empty for kinesis services). consul_kv_path was validated when
+// loading the config, so it always expands.
+func (p offsetPaths) base(service ServiceConfig, logGroup string) string {
+	path, err := expandKVPath(service.ConsulKVPath, kvPathVars{Service: service.Name, LogGroup: logGroup, Region: p.region})
+	if err != nil {
+		path = service.ConsulKVPath
+	}
+	if p.prefix == "" {
+		return path
+	}
+	return p.prefix + "/" + strings.TrimPrefix(path, "/")
+}
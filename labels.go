@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// labelName is what label names are limited to, the names Loki and
+// Prometheus accept.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func validateLabels(labels map[string]string) error {
+	for _, name := range sortedLabels(labels) {
+		if !labelName.MatchString(name) {
+			return fmt.Errorf("invalid label name %q, expected letters, digits and underscores", name)
+		}
+		if slices.Contains(enrichFields, name) {
+			return fmt.Errorf("label %q is reserved for enrich", name)
+		}
+	}
+	return nil
+}
+
+// sortedLabels returns the names of labels in the order they are written.
+func sortedLabels(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	lambdaStart  = regexp.MustCompile(`^START RequestId: (\S+)(?: Version: (\S+))?`)
+	lambdaEnd    = regexp.MustCompile(`^END RequestId: (\S+)`)
+	lambdaReport = regexp.MustCompile(`^REPORT RequestId: (\S+)`)
+	// lambdaLine is a line of the text format of the Lambda runtimes:
+	// timestamp, request ID, level and message separated by tabs
+	lambdaLine = regexp.MustCompile(`^(\d{4}-\d\d-\d\dT[\d:.]+Z)\t([0-9a-f-]{36})\t([A-Z]+)\t`)
+)
+
+// lambdaReportFields maps the fields of a REPORT line to the names they are
+// stored as.
+var lambdaReportFields = map[string]string{
+	"Duration":         "duration_ms",
+	"Billed Duration":  "billed_duration_ms",
+	"Memory Size":      "memory_size_mb",
+	"Max Memory Used":  "max_memory_used_mb",
+	"Init Duration":    "init_duration_ms",
+	"Restore Duration": "restore_duration_ms",
+	"XRAY TraceId":     "xray_trace_id",
+	"SegmentId":        "xray_segment_id",
+	"Sampled":          "xray_sampled",
+}
+
+// lambdaPreset parses the START, END and REPORT lines Lambda writes for
+// every invocation, and the lines of the runtimes' text format.
+type lambdaPreset struct{}
+
+func newLambdaPreset(ServiceConfig) stage { return lambdaPreset{} }
+
+func (lambdaPreset) apply(event logEvent, out []logEvent) []logEvent {
+	if event.Fields != nil {
+		return append(out, event)
+	}
+	message := strings.TrimRight(event.Message, "\n")
+	var fields map[string]any
+	if m := lambdaStart.FindStringSubmatch(message); m != nil {
+		fields = map[string]any{"type": "start", "request_id": m[1]}
+		if m[2] != "" {
+			fields["version"] = m[2]
+		}
+	} else if m := lambdaEnd.FindStringSubmatch(message); m != nil {
+		fields = map[string]any{"type": "end", "request_id": m[1]}
+	} else if m := lambdaReport.FindStringSubmatch(message); m != nil {
+		fields = map[string]any{"type": "report", "request_id": m[1], "cold_start": false}
+		// the fields are "Name: value unit", separated by tabs
+		for _, part := range strings.FieldsFunc(message[len(m[0]):], func(r rune) bool { return r == '\t' || r == '\n' }) {
+			key, value, ok := strings.Cut(part, ": ")
+			name, known := lambdaReportFields[strings.TrimSpace(key)]
+			if !ok || !known {
+				continue
+			}
+			if number, ok := strings.CutSuffix(value, " ms"); ok {
+				fields[name] = presetNumber(number)
+			} else if number, ok := strings.CutSuffix(value, " MB"); ok {
+				fields[name] = presetNumber(number)
+			} else {
+				fields[name] = value
+			}
+		}
+		// only cold starts initialize the function
+		_, fields["cold_start"] = fields["init_duration_ms"]
+	} else if m := lambdaLine.FindStringSubmatch(message); m != nil {
+		fields = map[string]any{
+			"timestamp":  m[1],
+			"request_id": m[2],
+			"level":      m[3],
+			"message":    message[len(m[0]):],
+		}
+	} else {
+		return append(out, event)
+	}
+	event.Fields = fields
+	return append(out, event)
+}
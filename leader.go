@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// leaderMonitorRetries is how often a failed check of the lock is retried
+// before leadership is given up, so a single Consul hiccup does not fail over.
+const leaderMonitorRetries = 3
+
+// leadership is the Consul lock held by the active instance of a singleton
+// deployment.
+type leadership struct {
+	lock    *api.Lock
+	client  *api.Client
+	session string
+	// lost is closed when the lock is lost, e.g. because the session
+	// could not be renewed
+	lost <-chan struct{}
+}
+
+// acquireLeadership blocks until this instance holds the leader lock below
+// cluster.kv_prefix, or returns nil once ctx is cancelled. The lock's session
+// has no health checks, only a TTL, so a leader that dies is replaced within
+// about session_ttl.
+func acquireLeadership(ctx context.Context, client *api.Client, config ClusterConfig) (*leadership, error) {
+	prefix := strings.Trim(config.KVPrefix, "/")
+	if prefix == "" {
+		prefix = defaultClusterKVPrefix
+	}
+	id := config.InstanceID
+	if id == "" {
+		id, _ = os.Hostname()
+	}
+	ttl := time.Duration(config.SessionTTL)
+	if ttl <= 0 {
+		ttl = defaultClusterTTL
+	}
+
+	session, _, err := client.Session().CreateNoChecks(&api.SessionEntry{
+		Name:      "cwsync leader " + id,
+		TTL:       ttl.String(),
+		LockDelay: clusterLockDelay,
+	}, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Consul session: %v", err)
+	}
+	go client.Session().RenewPeriodic(ttl.String(), session, nil, ctx.Done())
+
+	lock, err := client.LockOpts(&api.LockOptions{
+		Key:            prefix + "/leader",
+		Value:          []byte(id),
+		Session:        session,
+		MonitorRetries: leaderMonitorRetries,
+	})
+	if err != nil {
+		return nil, err
+	}
+	clusterLog.Infof("Waiting for leadership at %s/leader as %s", prefix, id)
+	lost, err := lock.Lock(ctx.Done())
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire the leader lock: %v", err)
+	}
+	if lost == nil {
+		return nil, nil
+	}
+	clusterLog.Infof("Acquired leadership as %s", id)
+	return &leadership{lock: lock, client: client, session: session, lost: lost}, nil
+}
+
+// resign releases the lock so a standby takes over right away instead of
+// after the session TTL.
+func (l *leadership) resign() {
+	if err := l.lock.Unlock(); err != nil && err != api.ErrLockNotHeld {
+		clusterLog.Errorf("Error releasing the leader lock: %v", err)
+	}
+	l.client.Session().Destroy(l.session, nil)
+}
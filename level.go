@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const metricLevelFilteredEvents = "cwsync_level_filtered_events_total"
+
+func init() {
+	metrics.describe(metricLevelFilteredEvents, "counter", "Events dropped by min_level.")
+}
+
+// levelNames are the levels in ascending severity, as written in Level.
+var levelNames = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+
+// levelAliases maps the spellings found in logs to an index of levelNames.
+var levelAliases = map[string]int{
+	"trace": 0, "debug": 1, "dbg": 1, "info": 2, "information": 2, "notice": 2,
+	"warn": 3, "warning": 3, "error": 4, "err": 4,
+	"fatal": 5, "critical": 5, "crit": 5, "panic": 5, "alert": 5, "emerg": 5, "emergency": 5,
+}
+
+// levelSearchBytes bounds how far into a text message the level is looked
+// for, a level word further in is more likely part of the message.
+const levelSearchBytes = 200
+
+var (
+	defaultLevelFieldPattern = regexp.MustCompile(`(?i)"(?:level|severity|lvl|levelname|log\.level)"\s*:\s*"?(\w+)`)
+	levelWordPattern         = regexp.MustCompile(`(?i)\b(trace|debug|dbg|info|notice|warn|warning|error|err|fatal|critical|crit|panic)\b`)
+)
+
+func parseLevel(name string) (int, bool) {
+	level, ok := levelAliases[strings.ToLower(name)]
+	return level, ok
+}
+
+// levelFieldPattern matches the JSON field holding the level, level_field
+// if the service sets one.
+func levelFieldPattern(field string) *regexp.Regexp {
+	if field == "" {
+		return defaultLevelFieldPattern
+	}
+	return regexp.MustCompile(`"` + regexp.QuoteMeta(field) + `"\s*:\s*"?(\w+)`)
+}
+
+// detectLevel finds the level of a message: the level field of a JSON
+// message, which may also be a numeric bunyan or pino level, or else the
+// first level word near the start of the message, as in "ERROR ...",
+// "[warn] ..." or "level=info".
+func detectLevel(message string, field *regexp.Regexp) (int, bool) {
+	if strings.HasPrefix(strings.TrimSpace(message), "{") {
+		if m := field.FindStringSubmatch(message); m != nil {
+			if n, err := strconv.Atoi(m[1]); err == nil {
+				// bunyan and pino levels go from 10 for trace to 60 for fatal
+				if n >= 10 && n <= 60 {
+					return n/10 - 1, true
+				}
+				return 0, false
+			}
+			return parseLevel(m[1])
+		}
+		// words in the values of a JSON message are not its level
+		return 0, false
+	}
+	if len(message) > levelSearchBytes {
+		message = message[:levelSearchBytes]
+	}
+	if m := levelWordPattern.FindStringSubmatch(message); m != nil {
+		return parseLevel(m[1])
+	}
+	return 0, false
+}
+
+// levelStage sets the level of every event and drops those below min_level.
+// Events without a recognizable level are kept.
+type levelStage struct {
+	field   *regexp.Regexp
+	min     int
+	service string
+}
+
+func newLevelStage(service ServiceConfig) *levelStage {
+	s := &levelStage{field: levelFieldPattern(service.LevelField), service: service.Name}
+	if service.MinLevel != "" {
+		// min_level was validated when loading the config
+		s.min, _ = parseLevel(service.MinLevel)
+	}
+	return s
+}
+
+func (s *levelStage) apply(event logEvent, out []logEvent) []logEvent {
+	level, ok := detectLevel(event.Message, s.field)
+	if !ok {
+		return append(out, event)
+	}
+	if level < s.min {
+		metrics.Add(metricLevelFilteredEvents, 1, "service", s.service)
+		return out
+	}
+	event.Level = levelNames[level]
+	return append(out, event)
+}
+
+func validateMinLevel(name string) error {
+	if _, ok := parseLevel(name); !ok {
+		return fmt.Errorf("unknown level %q, expected one of %s", name, strings.Join(levelNames, ", "))
+	}
+	return nil
+}
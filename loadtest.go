@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	loadTestTick      = 100 * time.Millisecond
+	loadTestMaxPage   = 1000
+	loadTestLogPeriod = 10 * time.Second
+)
+
+// runLoadTest feeds synthetic events through the pipeline of a configured
+// service, bypassing CloudWatch and Consul, to benchmark its destination and
+// watch backpressure. It is not listed in the usage on purpose.
+func runLoadTest(args []string) {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	configPath := fs.String("config", configPathFromEnv(), "path to the config file")
+	serviceName := fs.String("service", "", "service whose destination and pipeline settings are used, default the first one")
+	rate := fs.Float64("rate", 1000, "events per second across all streams")
+	streams := fs.Int("streams", 10, "number of synthetic log streams")
+	size := fs.Int("size", 200, "message size in bytes")
+	duration := fs.Duration("duration", time.Minute, "how long to generate events, 0 runs until interrupted")
+	fs.Parse(args)
+
+	if *rate <= 0 || *streams <= 0 || *size <= 0 {
+		fmt.Fprintln(os.Stderr, "usage: cwsync loadtest [-config <path>] [-service <name>] [-rate <events/s>] [-streams <n>] [-size <bytes>] [-duration <d>]")
+		os.Exit(2)
+	}
+	config := loadConfig(*configPath, nil)
+	if err := setLogLevel(config.LogLevel); err != nil {
+		mainLog.Fatalf("%v", err)
+	}
+	if err := setLogFormat(config.LogFormat); err != nil {
+		mainLog.Fatalf("%v", err)
+	}
+	var service ServiceConfig
+	for _, candidate := range config.Services {
+		if *serviceName == "" || candidate.Name == *serviceName {
+			service = candidate
+			break
+		}
+	}
+	if service.Name == "" {
+		mainLog.Fatalf("service %q not found in %s", *serviceName, *configPath)
+	}
+	buffered = newByteBudget(config.MaxBufferedBytes)
+	if config.MetricsAddr != "" {
+		go serveMetrics(config.MetricsAddr)
+	}
+	if config.StatsD.Address != "" {
+		defer startStatsD(config.StatsD)()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	mainLog.Infof("Generating %.0f events/s of %d bytes in %d streams for %s", *rate, *size, *streams, service.Name)
+	var sent atomic.Int64
+	started := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *streams; i++ {
+		wg.Add(1)
+		go func(stream string) {
+			defer wg.Done()
+			generateLoad(ctx, service, stream, *rate/float64(*streams), *size, &sent)
+		}(fmt.Sprintf("synthetic-%d", i))
+	}
+	go func() {
+		ticker := time.NewTicker(loadTestLogPeriod)
+		defer ticker.Stop()
+		last := int64(0)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			total := sent.Load()
+			behind := int64(*rate*time.Since(started).Seconds()) - total
+			mainLog.Infof("Generated %d events (%.0f/s), %d behind schedule, %d bytes buffered", total, float64(total-last)/loadTestLogPeriod.Seconds(), max(behind, 0), buffered.usedBytes())
+			last = total
+		}
+	}()
+	wg.Wait()
+	generated := time.Since(started)
+	drainPipelines()
+	elapsed := time.Since(started)
+	total := sent.Load()
+	mainLog.Infof("Wrote %d events in %s (%.0f/s), generating took %s", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds(), generated.Round(time.Millisecond))
+}
+
+// generateLoad writes the events of one synthetic stream at rate per second.
+// Events owed while writeEvents was blocked are made up in larger pages, like
+// a tail that fell behind.
+func generateLoad(ctx context.Context, service ServiceConfig, stream string, rate float64, size int, sent *atomic.Int64) {
+	padding := strings.Repeat("x", size)
+	start := time.Now()
+	ticker := time.NewTicker(loadTestTick)
+	defer ticker.Stop()
+	// pages stay small so a stopped test does not wait for a big backlog,
+	// but large enough for the rate
+	maxPage := max(int64(rate*loadTestTick.Seconds())+1, loadTestMaxPage)
+	var seq int64
+	var events []logEvent
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		owed := int64(time.Since(start).Seconds()*rate) - seq
+		if owed <= 0 {
+			continue
+		}
+		page := min(owed, maxPage)
+		events = events[:0]
+		now := time.Now().UnixMilli()
+		for i := int64(0); i < page; i++ {
+			seq++
+			message := stream + " " + strconv.FormatInt(seq, 10) + " "
+			if len(message) < size {
+				message += padding[:size-len(message)]
+			}
+			events = append(events, logEvent{
+				LogGroup:      "/cwsync/loadtest",
+				LogStream:     stream,
+				Timestamp:     now,
+				IngestionTime: now,
+				Message:       message,
+			})
+		}
+		writeEvents(service, events)
+		sent.Add(page)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logLevel is the level of cwsync's own messages, set by log_level. Synced
+// log events are written through OutputLogger and never affected by it.
+var logLevel = new(slog.LevelVar)
+
+// logHandler writes the messages of every logger, replaced by setLogFormat.
+var logHandler slog.Handler = newLevelSplitHandler(logFormatText, os.Stdout, os.Stderr)
+
+// logger writes printf style messages through slog with the component they
+// come from as attribute, and the attributes added by with.
+type logger struct {
+	component string
+	attrs     []any
+}
+
+// The loggers of the parts of cwsync.
+var (
+	mainLog       = logger{component: "main"}
+	configLog     = logger{component: "config"}
+	supervisorLog = logger{component: "supervisor"}
+	tailLog       = logger{component: "tail"}
+	kinesisLog    = logger{component: "kinesis"}
+	clusterLog    = logger{component: "cluster"}
+	consulLog     = logger{component: "consul"}
+	pipelineLog   = logger{component: "pipeline"}
+	awsLog        = logger{component: "aws"}
+	serverLog     = logger{component: "server"}
+)
+
+// with returns a logger adding attrs, key value pairs as taken by slog, to
+// every message.
+func (l logger) with(attrs ...any) logger {
+	l.attrs = append(slices.Clip(l.attrs), attrs...)
+	return l
+}
+
+// streamLogger returns the logger of the tail of a stream, or of a group
+// tail if stream is empty.
+func streamLogger(l logger, service, group, stream string) logger {
+	l = l.with("service", service, "log_group", group)
+	if stream != "" {
+		l = l.with("log_stream", stream)
+	}
+	return l
+}
+
+func (l logger) logf(level slog.Level, format string, args ...any) {
+	ctx := context.Background()
+	if !logHandler.Enabled(ctx, level) {
+		return
+	}
+	record := slog.NewRecord(time.Now(), level, fmt.Sprintf(format, args...), 0)
+	record.AddAttrs(slog.String("component", l.component))
+	record.Add(l.attrs...)
+	logHandler.Handle(ctx, record)
+}
+
+func (l logger) Debugf(format string, args ...any) { l.logf(slog.LevelDebug, format, args...) }
+func (l logger) Infof(format string, args ...any)  { l.logf(slog.LevelInfo, format, args...) }
+func (l logger) Warnf(format string, args ...any)  { l.logf(slog.LevelWarn, format, args...) }
+func (l logger) Errorf(format string, args ...any) { l.logf(slog.LevelError, format, args...) }
+
+// Fatalf logs at error level, which is never turned off, makes a last push
+// to statsd and exits.
+func (l logger) Fatalf(format string, args ...any) {
+	l.logf(slog.LevelError, format, args...)
+	flushStatsD()
+	os.Exit(1)
+}
+
+// setLogLevel sets the level of cwsync's own messages.
+func setLogLevel(level string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(l)
+	return nil
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q", level)
+}
+
+// setLogFormat switches the messages to text or JSON lines.
+func setLogFormat(format string) error {
+	switch format {
+	case "", logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("invalid log format %q, expected %s or %s", format, logFormatText, logFormatJSON)
+	}
+	logHandler = newLevelSplitHandler(format, os.Stdout, os.Stderr)
+	return nil
+}
+
+// levelSplitHandler writes debug and info messages to one writer and
+// warnings and errors to another, stdout and stderr as cwsync always did.
+type levelSplitHandler struct {
+	low, high slog.Handler
+}
+
+func newLevelSplitHandler(format string, low, high io.Writer) slog.Handler {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if format == logFormatJSON {
+		return levelSplitHandler{low: slog.NewJSONHandler(low, opts), high: slog.NewJSONHandler(high, opts)}
+	}
+	return levelSplitHandler{low: slog.NewTextHandler(low, opts), high: slog.NewTextHandler(high, opts)}
+}
+
+func (h levelSplitHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.low.Enabled(ctx, level)
+}
+
+func (h levelSplitHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelWarn {
+		return h.high.Handle(ctx, record)
+	}
+	return h.low.Handle(ctx, record)
+}
+
+func (h levelSplitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelSplitHandler{low: h.low.WithAttrs(attrs), high: h.high.WithAttrs(attrs)}
+}
+
+func (h levelSplitHandler) WithGroup(name string) slog.Handler {
+	return levelSplitHandler{low: h.low.WithGroup(name), high: h.high.WithGroup(name)}
+}
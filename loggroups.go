@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+const regexLogGroupPrefix = "regex:"
+
+// logGroupMatcher matches log group names for a log_group_name that is either
+// a glob ("/aws/lambda/payments-*") or a regex ("regex:^/aws/lambda/(a|b)$").
+// listPrefix is the literal part that can be sent to DescribeLogGroups to
+// narrow the listing.
+type logGroupMatcher struct {
+	re         *regexp.Regexp
+	listPrefix string
+}
+
+func isLogGroupPattern(name string) bool {
+	return strings.HasPrefix(name, regexLogGroupPrefix) || strings.ContainsAny(name, "*?")
+}
+
+func newLogGroupMatcher(name string) (*logGroupMatcher, error) {
+	if strings.HasPrefix(name, regexLogGroupPrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(name, regexLogGroupPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid log group regex %q: %v", name, err)
+		}
+		prefix, _ := re.LiteralPrefix()
+		if !strings.HasPrefix(re.String(), "^") {
+			prefix = ""
+		}
+		return &logGroupMatcher{re: re, listPrefix: prefix}, nil
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range name {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+
+	return &logGroupMatcher{
+		re:         regexp.MustCompile(expr.String()),
+		listPrefix: name[:strings.IndexAny(name, "*?")],
+	}, nil
+}
+
+// logGroupTagCache avoids calling ListTagsForResource for every group on every
+// discovery pass; tags rarely change, so a few minutes of staleness is fine.
+type logGroupTagCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedTags
+}
+
+type cachedTags struct {
+	tags    map[string]*string
+	fetched time.Time
+}
+
+const tagCacheTTL = 10 * time.Minute
+
+var tagCache = &logGroupTagCache{entries: make(map[string]cachedTags)}
+
+func (c *logGroupTagCache) get(ctx context.Context, cwLogs *cloudwatchlogs.CloudWatchLogs, arn string) (map[string]*string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[arn]
+	c.mu.Unlock()
+	if ok && time.Since(entry.fetched) < tagCacheTTL {
+		return entry.tags, nil
+	}
+
+	resp, err := cwLogs.ListTagsForResourceWithContext(ctx, &cloudwatchlogs.ListTagsForResourceInput{
+		ResourceArn: aws.String(arn),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[arn] = cachedTags{tags: resp.Tags, fetched: time.Now()}
+	c.mu.Unlock()
+	return resp.Tags, nil
+}
+
+func tagsMatch(tags map[string]*string, want map[string]string) bool {
+	for key, value := range want {
+		got, ok := tags[key]
+		if !ok || aws.StringValue(got) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveLogGroups expands a log config into the concrete log group names it
+// refers to. Plain names without tag filters are returned as-is without an
+// API call. When log_group_tags is set, log_group_name is optional and only
+// narrows the groups whose tags are checked.
+func resolveLogGroups(ctx context.Context, cwLogs *cloudwatchlogs.CloudWatchLogs, logConfig LogConfig) ([]string, error) {
+	name := logConfig.LogGroupName
+	if !isLogGroupPattern(name) && len(logConfig.LogGroupTags) == 0 {
+		return []string{name}, nil
+	}
+
+	input := &cloudwatchlogs.DescribeLogGroupsInput{}
+	var matcher *logGroupMatcher
+	if isLogGroupPattern(name) {
+		var err error
+		if matcher, err = newLogGroupMatcher(name); err != nil {
+			return nil, err
+		}
+		if matcher.listPrefix != "" {
+			input.LogGroupNamePrefix = aws.String(matcher.listPrefix)
+		}
+	} else if name != "" {
+		input.LogGroupNamePrefix = aws.String(name)
+	}
+
+	var candidates []*cloudwatchlogs.LogGroup
+	err := cwLogs.DescribeLogGroupsPagesWithContext(ctx, input, func(page *cloudwatchlogs.DescribeLogGroupsOutput, lastPage bool) bool {
+		for _, group := range page.LogGroups {
+			groupName := *group.LogGroupName
+			if matcher != nil && !matcher.re.MatchString(groupName) {
+				continue
+			}
+			if matcher == nil && name != "" && groupName != name {
+				continue
+			}
+			candidates = append(candidates, group)
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var logGroups []string
+	for _, group := range candidates {
+		if len(logConfig.LogGroupTags) > 0 {
+			// DescribeLogGroups returns the ARN with a trailing ":*", which
+			// ListTagsForResource does not accept.
+			tags, err := tagCache.get(ctx, cwLogs, strings.TrimSuffix(aws.StringValue(group.Arn), ":*"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to list tags for %s: %v", *group.LogGroupName, err)
+			}
+			if !tagsMatch(tags, logConfig.LogGroupTags) {
+				continue
+			}
+		}
+		logGroups = append(logGroups, *group.LogGroupName)
+	}
+	return logGroups, nil
+}
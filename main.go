@@ -1,132 +1,631 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/hashicorp/consul/api"
-	"gopkg.in/yaml.v2"
 )
 
-var (
-	InfoLogger  *log.Logger
-	ErrorLogger *log.Logger
-	FatalLogger *log.Logger
-)
+// OutputLogger writes the synced log events of the stdout sink.
+var OutputLogger *log.Logger
 
 type Config struct {
-	Consul                 ConsulConfig    `yaml:"consul"`
-	AWSRegion              string          `yaml:"aws_region"`
-	AWSProfile             string          `yaml:"aws_profile"`
-	AWSRoleARN             string          `yaml:"aws_role_arn"`
-	AWSAccessKey           string          `yaml:"aws_access_key"`
-	AWSSecretKey           string          `yaml:"aws_secret_key"`
-	Services               []ServiceConfig `yaml:"services"`
-	OffsetFallbackDuration time.Duration   `yaml:"offset_fallback_duration"`
+	Consul                 ConsulConfig              `yaml:"consul"`
+	AWSRegion              string                    `yaml:"aws_region"`
+	AWSProfile             string                    `yaml:"aws_profile"`
+	AWSRoleARN             string                    `yaml:"aws_role_arn"`
+	AWSRoleSessionName     string                    `yaml:"aws_role_session_name"`
+	AWSMFASerial           string                    `yaml:"aws_mfa_serial"`
+	AWSMFATokenCommand     string                    `yaml:"aws_mfa_token_command"`
+	AWSUseWebIdentity      bool                      `yaml:"aws_use_web_identity"`
+	AWSWebIdentityToken    string                    `yaml:"aws_web_identity_token_file"`
+	AWSAccessKey           string                    `yaml:"aws_access_key"`
+	AWSSecretKey           string                    `yaml:"aws_secret_key"`
+	AWSEndpointURL         string                    `yaml:"aws_endpoint_url"`
+	AWSDisableSSL          bool                      `yaml:"aws_disable_ssl"`
+	AWSPartition           string                    `yaml:"aws_partition"`
+	AWSUseFIPSEndpoint     bool                      `yaml:"aws_use_fips_endpoint"`
+	Services               []ServiceConfig           `yaml:"services"`
+	OffsetFallbackDuration Duration                  `yaml:"offset_fallback_duration"`
+	APIRateLimits          RateLimitConfig           `yaml:"api_rate_limits"`
+	DiscoveryInterval      Duration                  `yaml:"discovery_interval"`
+	StreamIdleTimeout      Duration                  `yaml:"stream_idle_timeout"`
+	MaxConcurrentDiscovery int                       `yaml:"max_concurrent_discovery"`
+	StartupJitter          Duration                  `yaml:"startup_jitter"`
+	MaxConcurrentTails     int                       `yaml:"max_concurrent_tails"`
+	MaxBufferedBytes       int64                     `yaml:"max_buffered_bytes"`
+	Cluster                ClusterConfig             `yaml:"cluster"`
+	RunOnce                bool                      `yaml:"run_once"`
+	MetricsAddr            string                    `yaml:"metrics_addr"`
+	StatsD                 StatsDConfig              `yaml:"statsd"`
+	AdminAddr              string                    `yaml:"admin_addr"`
+	AdminToken             string                    `yaml:"admin_token"`
+	PprofAddr              string                    `yaml:"pprof_addr"`
+	PprofToken             string                    `yaml:"pprof_token"`
+	UsageSummaryInterval   Duration                  `yaml:"usage_summary_interval"`
+	APITimeout             Duration                  `yaml:"api_timeout"`
+	LogLevel               string                    `yaml:"log_level"`
+	LogFormat              string                    `yaml:"log_format"`
+	Color                  string                    `yaml:"color"`
+	WatchConfig            bool                      `yaml:"watch_config"`
+	WatchDebounce          Duration                  `yaml:"watch_debounce"`
+	ProxyURL               string                    `yaml:"proxy_url"`
+	CABundle               string                    `yaml:"ca_bundle"`
+	Defaults               ServiceDefaults           `yaml:"defaults"`
+	Include                []string                  `yaml:"include"`
+	Profiles               map[string]map[string]any `yaml:"profiles"`
 }
 
 type ConsulConfig struct {
-	Address string `yaml:"address"`
-	Token   string `yaml:"token"`
+	Address          string `yaml:"address"`
+	Token            string `yaml:"token"`
+	ServicesKVPrefix string `yaml:"services_kv_prefix"`
+	KVPrefix         string `yaml:"kv_prefix"`
+	Scheme           string `yaml:"scheme"`
+	Datacenter       string `yaml:"datacenter"`
+	Namespace        string `yaml:"namespace"`
+	CAFile           string `yaml:"ca_file"`
+	CertFile         string `yaml:"cert_file"`
+	KeyFile          string `yaml:"key_file"`
+	TLSServerName    string `yaml:"tls_server_name"`
 }
 
 type ServiceConfig struct {
-	Name         string      `yaml:"name"`
-	ConsulKVPath string      `yaml:"consul_kv_path"`
-	LogConfigs   []LogConfig `yaml:"log_configs"`
-	Destination  Destination `yaml:"destination"`
+	Name         string        `yaml:"name"`
+	ConsulKVPath string        `yaml:"consul_kv_path"`
+	Source       string        `yaml:"source"`
+	Kinesis      KinesisConfig `yaml:"kinesis"`
+	LogConfigs   []LogConfig   `yaml:"log_configs"`
+	Destination  Destination   `yaml:"destination"`
+	// Routes send some of the events to other destinations, see RouteConfig
+	Routes []RouteConfig `yaml:"routes"`
+	// events buffered between fetching and writing, per pipeline stage
+	OutputBuffer int `yaml:"output_buffer"`
+
+	DeleteOffsetOnStreamGone bool     `yaml:"delete_offset_on_stream_gone"`
+	TailFromLatest           bool     `yaml:"tail_from_latest"`
+	CheckpointBy             string   `yaml:"checkpoint_by"`
+	EndTime                  string   `yaml:"end_time"`
+	LateEventWindow          Duration `yaml:"late_event_window"`
+	MergeStreams             bool     `yaml:"merge_streams"`
+	MergeWindow              Duration `yaml:"merge_window"`
+	IngestionLookback        Duration `yaml:"ingestion_lookback"`
+	OffsetFallbackDuration   Duration `yaml:"offset_fallback_duration"`
+	MaxEventAge              Duration `yaml:"max_event_age"`
+	// Priority is high, normal or low, see priority
+	Priority string         `yaml:"priority"`
+	Schedule ScheduleConfig `yaml:"schedule"`
+
+	Multiline MultilineConfig `yaml:"multiline"`
+	// events whose message does not pass these patterns are dropped
+	MessageInclude []string `yaml:"message_include"`
+	MessageExclude []string `yaml:"message_exclude"`
+	// CollapseRepeats is how long repeats of a message are waited for, see
+	// repeatsStage
+	CollapseRepeats Duration `yaml:"collapse_repeats"`
+	// MinLevel drops events of a lower level, see detectLevel
+	MinLevel   string `yaml:"min_level"`
+	LevelField string `yaml:"level_field"`
+	// EMF extracts embedded metrics, see EMFConfig
+	EMF   EMFConfig   `yaml:"emf"`
+	JSON  JSONConfig  `yaml:"json"`
+	Parse ParseConfig `yaml:"parse"`
+	// Preset parses the log format of an AWS service, see presets
+	Preset        string         `yaml:"preset"`
+	FlowLogFormat string         `yaml:"flow_log_format"`
+	FieldMappings []FieldMapping `yaml:"field_mappings"`
+	Wasm          WasmConfig     `yaml:"wasm"`
+	// JSONSchema checks the parsed events, see JSONSchemaConfig
+	JSONSchema JSONSchemaConfig `yaml:"json_schema"`
+	// Filter is an expression events must match, see filterEnv
+	Filter string       `yaml:"filter"`
+	Redact []RedactRule `yaml:"redact"`
+	// fraction of events kept, see sampleStage
+	SampleRate  float64      `yaml:"sample_rate"`
+	SampleRules []SampleRule `yaml:"sample_rules"`
+	// Enrich attaches the source of every event, see EnrichConfig
+	Enrich EnrichConfig `yaml:"enrich"`
+	// Labels are static attributes of every event, such as env=prod
+	Labels map[string]string `yaml:"labels"`
+
+	// poll settings of the service, inherited by its log configs
+	PollInterval    Duration `yaml:"poll_interval"`
+	MaxPollInterval Duration `yaml:"max_poll_interval"`
+	FetchLimit      int64    `yaml:"fetch_limit"`
+	ErrorBackoff    Duration `yaml:"error_backoff"`
+
+	// AWS settings of the service, see serviceAWSConfig
+	AWSRegion          string `yaml:"aws_region"`
+	AWSProfile         string `yaml:"aws_profile"`
+	AWSRoleARN         string `yaml:"aws_role_arn"`
+	AWSRoleSessionName string `yaml:"aws_role_session_name"`
+	AWSAccessKey       string `yaml:"aws_access_key"`
+	AWSSecretKey       string `yaml:"aws_secret_key"`
+
+	// Paused services are kept in the config but not run.
+	Paused bool `yaml:"paused"`
+
+	// origin is the included file or Consul key the service was read from,
+	// empty for services of the main config file
+	origin string
+}
+
+const (
+	checkpointByTimestamp     = "timestamp"
+	checkpointByIngestionTime = "ingestion_time"
+
+	defaultIngestionLookback = 15 * time.Minute
+)
+
+func (s ServiceConfig) ingestionLookback() time.Duration {
+	if s.IngestionLookback <= 0 {
+		return defaultIngestionLookback
+	}
+	return time.Duration(s.IngestionLookback)
+}
+
+// oldestTimestamp returns the timestamp in milliseconds events must not be
+// older than by max_event_age, 0 without it.
+func (s ServiceConfig) oldestTimestamp(now time.Time) int64 {
+	if s.MaxEventAge <= 0 {
+		return 0
+	}
+	return now.Add(-time.Duration(s.MaxEventAge)).UnixMilli()
 }
 
 type LogConfig struct {
-	LogGroupName    string `yaml:"log_group_name"`
-	LogStreamPrefix string `yaml:"log_stream_prefix"`
+	LogGroupName    string            `yaml:"log_group_name"`
+	LogGroupTags    map[string]string `yaml:"log_group_tags"`
+	LogStreamPrefix string            `yaml:"log_stream_prefix"`
+	// regexes on stream names, applied after the prefix
+	LogStreamInclude []string `yaml:"log_stream_include"`
+	LogStreamExclude []string `yaml:"log_stream_exclude"`
+	PollInterval     Duration `yaml:"poll_interval"`
+	MaxPollInterval  Duration `yaml:"max_poll_interval"`
+	FetchLimit       int64    `yaml:"fetch_limit"`
+
+	MaxConcurrentFetches int `yaml:"max_concurrent_fetches"`
+	// streams (default) or group, see groupTail
+	FetchMode string `yaml:"fetch_mode"`
+}
+
+const (
+	defaultPollInterval    = 10 * time.Second
+	defaultMaxPollInterval = 5 * time.Minute
+	defaultFetchLimit      = 500
+	maxFetchLimit          = 10000
+)
+
+// pollSettings returns the poll cadence for the log config of service,
+// falling back to the service and then the defaults for unset values. The
+// poll interval doubles up to the max while a stream has no new events.
+func (l LogConfig) pollSettings(service ServiceConfig) (time.Duration, time.Duration, int64) {
+	pollInterval := time.Duration(cmp.Or(l.PollInterval, service.PollInterval))
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+	maxPollInterval := time.Duration(cmp.Or(l.MaxPollInterval, service.MaxPollInterval))
+	if maxPollInterval <= 0 {
+		maxPollInterval = defaultMaxPollInterval
+	}
+	if maxPollInterval < pollInterval {
+		maxPollInterval = pollInterval
+	}
+	fetchLimit := cmp.Or(l.FetchLimit, service.FetchLimit)
+	if fetchLimit <= 0 {
+		fetchLimit = defaultFetchLimit
+	}
+	if fetchLimit > maxFetchLimit {
+		fetchLimit = maxFetchLimit
+	}
+	return pollInterval, maxPollInterval, fetchLimit
 }
 
 type Destination struct {
 	Type     string `yaml:"type"`
 	FilePath string `yaml:"file_path"`
 	FileName string `yaml:"file_name"`
+
+	BatchSize     int      `yaml:"batch_size"`
+	BatchBytes    int      `yaml:"batch_bytes"`
+	BatchInterval Duration `yaml:"batch_interval"`
+
+	MaxEventsPerSecond float64 `yaml:"max_events_per_second"`
+	MaxBytesPerSecond  float64 `yaml:"max_bytes_per_second"`
+
+	// messages longer than MaxMessageBytes are split or truncated, see fit
+	MaxMessageBytes int    `yaml:"max_message_bytes"`
+	Oversized       string `yaml:"oversized"`
+
+	// Template is a text/template rendering each event, see templateEvent
+	Template  string          `yaml:"template"`
+	Timestamp TimestampConfig `yaml:"timestamp"`
+	// Prefix is a text/template replacing the "[stream] " of the default
+	// lines, see prefixEvent, or none to omit it
+	Prefix string `yaml:"prefix"`
 }
 
 func init() {
-	InfoLogger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
-	ErrorLogger = log.New(os.Stderr, "", log.Ldate|log.Ltime)
-	FatalLogger = log.New(os.Stderr, "", log.Ldate|log.Ltime)
+	OutputLogger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
 }
 
 func main() {
-	configPath := os.Getenv("CONFIG_PATH")
-	if configPath == "" {
-		configPath = "config.yaml"
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "validate":
+			runValidate(os.Args[2:])
+			return
+		case "init":
+			runInit(os.Args[2:])
+			return
+		case "config":
+			runConfig(os.Args[2:])
+			return
+		case "config-schema":
+			runConfigSchema(os.Args[2:])
+			return
+		case "loadtest":
+			runLoadTest(os.Args[2:])
+			return
+		case "status":
+			runStatus(os.Args[2:])
+			return
+		}
+	}
+
+	flags := parseFlags(os.Args[1:])
+	config := loadConfig(flags.configPath, flags)
+	if err := setLogLevel(config.LogLevel); err != nil {
+		mainLog.Fatalf("%v", err)
+	}
+	if err := setLogFormat(config.LogFormat); err != nil {
+		mainLog.Fatalf("%v", err)
+	}
+	if err := setColor(config.Color); err != nil {
+		mainLog.Fatalf("%v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	effective, err := renderEffectiveConfig(config)
+	if err != nil {
+		mainLog.Fatalf("failed to render config: %v", err)
 	}
-	config := loadConfig(configPath)
 	sess := createAWSSession(config)
-	consulClient := setupConsulClient(config.Consul)
-	OffsetFallbackDuration := config.OffsetFallbackDuration
+	if err := resolveSecrets(ctx, sess, &config); err != nil {
+		mainLog.Fatalf("%v", err)
+	}
+	consulClient := setupConsulClient(config)
+	limiter := newAPILimiter(config.APIRateLimits)
+
+	if config.MetricsAddr != "" {
+		go serveMetrics(config.MetricsAddr)
+	}
+	if config.StatsD.Address != "" {
+		defer startStatsD(config.StatsD)()
+	}
+	if config.PprofAddr != "" {
+		go serveDebug(config.PprofAddr, config.PprofToken)
+	}
+	usageSummaryInterval := time.Duration(config.UsageSummaryInterval)
+	if usageSummaryInterval <= 0 {
+		usageSummaryInterval = defaultUsageSummaryInterval
+	}
+	if !config.RunOnce {
+		go logUsageSummary(usageSummaryInterval)
+	}
 
-	for _, service := range config.Services {
-		cwLogs := cloudwatchlogs.New(sess)
+	// registered before waiting for leadership: the default action of
+	// SIGHUP kills a standby, a reload requested meanwhile is queued
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
-		for _, logConfig := range service.LogConfigs {
-			logStreams, err := listLogStreams(cwLogs, logConfig.LogGroupName, logConfig.LogStreamPrefix)
-			if err != nil {
-				FatalLogger.Fatalf("failed to list log streams for %s: %v", service.Name, err)
+	var leader *leadership
+	if config.Cluster.LeaderElect {
+		leader, err = acquireLeadership(ctx, consulClient, config.Cluster)
+		if err != nil {
+			mainLog.Fatalf("%v", err)
+		}
+		if leader == nil {
+			return
+		}
+		defer leader.resign()
+		go func() {
+			select {
+			case <-leader.lost:
+				mainLog.Errorf("Lost leadership, stopping")
+				stop()
+			case <-ctx.Done():
 			}
+		}()
+	}
 
-			for _, stream := range logStreams {
-				go tailLogStream(cwLogs, service, logConfig, stream, consulClient, OffsetFallbackDuration)
-			}
+	buffered = newByteBudget(config.MaxBufferedBytes)
+	discoverySlots = newDiscoverySlots(config.MaxConcurrentDiscovery)
+	member, err := joinCluster(ctx, consulClient, config.Cluster)
+	if err != nil {
+		mainLog.Fatalf("failed to join cluster: %v", err)
+	}
+	sup := newSupervisor(ctx, config, sess, consulClient, limiter, member)
+	sup.setEffective(effective)
+	var consulServicesIndex uint64
+	if prefix := config.Consul.ServicesKVPrefix; prefix != "" {
+		services, index, err := loadConsulServices(ctx, consulClient, prefix, 0)
+		if err != nil {
+			mainLog.Fatalf("failed to load services from Consul at %s: %v", prefix, err)
 		}
+		consulServicesIndex = index
+		sup.setSource(serviceSourceConsul, services)
+	}
+	if err := sup.update(serviceSourceFile, config.Services); err != nil {
+		mainLog.Fatalf("%v", err)
+	}
+
+	if config.AdminAddr != "" && !config.RunOnce {
+		go serveAdmin(config.AdminAddr, &adminAPI{
+			sup:    sup,
+			kv:     consulClient.KV(),
+			prefix: config.Consul.ServicesKVPrefix,
+			token:  config.AdminToken,
+		})
+	}
+
+	if config.RunOnce {
+		// a single catch-up pass, e.g. from a lambda or a cron schedule
+		sup.wait()
+		if n := runOnceFailures.Load(); n > 0 {
+			mainLog.Fatalf("Gave up on %d streams after %d failed fetches in a row", n, runOnceMaxFailures)
+		}
+		mainLog.Infof("All streams caught up, exiting")
+		return
 	}
 
-	select {}
+	if prefix := config.Consul.ServicesKVPrefix; prefix != "" {
+		go watchConsulServices(ctx, consulClient, prefix, consulServicesIndex, sup)
+	}
+	fileChanged := make(chan struct{}, 1)
+	if !config.WatchConfig && isConfigMapMount(flags.configPath) {
+		mainLog.Infof("%s is mounted from a Kubernetes ConfigMap, set watch_config to reload it on updates", flags.configPath)
+	}
+	if config.WatchConfig {
+		debounce := time.Duration(config.WatchDebounce)
+		if debounce <= 0 {
+			debounce = defaultWatchDebounce
+		}
+		go watchConfigFile(ctx, flags.configPath, debounce, fileChanged)
+	}
+	for ctx.Err() == nil {
+		select {
+		case <-hup:
+			reloadConfig(sup, flags)
+		case <-fileChanged:
+			reloadConfig(sup, flags)
+		case <-ctx.Done():
+		}
+	}
+	mainLog.Infof("Shutting down, waiting for tailers to stop")
+	sup.wait()
+	if leader != nil {
+		select {
+		case <-leader.lost:
+			// exit non-zero so the instance is restarted as a standby
+			leader.resign()
+			flushStatsD()
+			os.Exit(1)
+		default:
+		}
+	}
 }
 
-func loadConfig(path string) Config {
-	data, err := os.ReadFile(path)
+// reloadConfig re-reads the config file and reconciles the running services.
+// An invalid config is reported and the current one is kept.
+func reloadConfig(sup *supervisor, flags *cliFlags) {
+	mainLog.Infof("Reloading configuration from %s", flags.configPath)
+	config, data, err := readConfig(flags.configPath, flags.configProfile)
 	if err != nil {
-		FatalLogger.Fatalf("failed to read config file: %v", err)
+		mainLog.Errorf("Reload failed, keeping the current configuration: %v", err)
+		return
+	}
+	flags.apply(&config)
+	if errs := validateConfig(config); len(errs) > 0 {
+		lines := locateConfigPaths(data)
+		for _, e := range errs {
+			mainLog.Errorf("%s", e.format(flags.configPath, lines))
+		}
+		mainLog.Errorf("Reload failed, keeping the current configuration")
+		return
+	}
+	effective, err := renderEffectiveConfig(config)
+	if err != nil {
+		mainLog.Errorf("Reload failed, keeping the current configuration: %v", err)
+		return
+	}
+	if err := resolveSecrets(sup.ctx, sup.sess, &config); err != nil {
+		mainLog.Errorf("Reload failed, keeping the current configuration: %v", err)
+		return
+	}
+	sup.warnGlobalChanges(config)
+	sup.setEffective(effective)
+	if err := sup.update(serviceSourceFile, config.Services); err != nil {
+		mainLog.Errorf("Reload: %v", err)
+	}
+}
+
+const defaultAPITimeout = 30 * time.Second
+
+func (c Config) apiTimeout() time.Duration {
+	if c.APITimeout <= 0 {
+		return defaultAPITimeout
 	}
+	return time.Duration(c.APITimeout)
+}
 
+func configPathFromEnv() string {
+	configPath := os.Getenv("CONFIG_PATH")
+	if configPath == "" {
+		configPath = "config.yaml"
+	}
+	return configPath
+}
+
+// readConfig reads, interpolates and decodes the config file. The returned
+// bytes are the interpolated document, used to locate validation errors.
+// YAML, JSON and TOML files are supported, SOPS encrypted YAML and JSON
+// files are decrypted first. A non-empty profile is overlaid on the result.
+func readConfig(path, profile string) (Config, []byte, error) {
 	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		FatalLogger.Fatalf("failed to unmarshal config file: %v", err)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	format, err := configFormat(path)
+	if err != nil {
+		return config, nil, err
+	}
+	if data, err = decryptSOPS(path, data, format); err != nil {
+		return config, nil, err
+	}
+	data, err = interpolateEnv(data)
+	if err != nil {
+		return config, nil, fmt.Errorf("failed to interpolate config file: %v", err)
+	}
+	if err := decodeConfig(data, format, &config); err != nil {
+		return config, nil, fmt.Errorf("failed to unmarshal config file:\n%s", strings.Join(decodeErrors(path, format != configFormatTOML, err), "\n"))
+	}
+	if err := loadIncludes(path, &config); err != nil {
+		return config, nil, err
+	}
+	if err := applyProfile(&config, profile); err != nil {
+		return config, nil, err
+	}
+	config.applyDefaults()
+	if format == configFormatTOML {
+		// line numbers of validation errors are only known for YAML and JSON
+		data = nil
+	}
+	return config, data, nil
+}
+
+// loadConfig reads the config, applies command line overrides (flags may be
+// nil) and exits with every validation error if the result is not usable.
+func loadConfig(path string, flags *cliFlags) Config {
+	profile := profileFromEnv()
+	if flags != nil {
+		profile = flags.configProfile
+	}
+	config, data, err := readConfig(path, profile)
+	if err != nil {
+		mainLog.Fatalf("%v", err)
+	}
+	if flags != nil {
+		flags.apply(&config)
+	}
+	if errs := validateConfig(config); len(errs) > 0 {
+		lines := locateConfigPaths(data)
+		for _, e := range errs {
+			mainLog.Errorf("%s", e.format(path, lines))
+		}
+		mainLog.Fatalf("invalid config file %s", path)
 	}
 	return config
 }
 
-func setupConsulClient(consulConfig ConsulConfig) *api.Client {
-	config := api.DefaultConfig()
-	config.Address = consulConfig.Address
-	config.Token = consulConfig.Token
-	client, err := api.NewClient(config)
+// setupConsulClient builds the Consul client. Settings left empty keep the
+// values of the standard CONSUL_* environment variables.
+func setupConsulClient(config Config) *api.Client {
+	consulConfig := api.DefaultConfig()
+	consulConfig.Address = config.Consul.Address
+	consulConfig.Token = config.Consul.Token
+	setIfNotEmpty(&consulConfig.Scheme, config.Consul.Scheme)
+	setIfNotEmpty(&consulConfig.Datacenter, config.Consul.Datacenter)
+	setIfNotEmpty(&consulConfig.Namespace, config.Consul.Namespace)
+	setIfNotEmpty(&consulConfig.TLSConfig.CAFile, config.Consul.CAFile)
+	setIfNotEmpty(&consulConfig.TLSConfig.CertFile, config.Consul.CertFile)
+	setIfNotEmpty(&consulConfig.TLSConfig.KeyFile, config.Consul.KeyFile)
+	setIfNotEmpty(&consulConfig.TLSConfig.Address, config.Consul.TLSServerName)
+
+	transport := newHTTPTransport(config)
+	if transport.TLSClientConfig != nil {
+		// the consul client ignores TLSConfig for transports that already
+		// have a TLS config, which ours has once ca_bundle is set
+		tlsConfig, err := api.SetupTLSConfig(&consulConfig.TLSConfig)
+		if err != nil {
+			mainLog.Fatalf("invalid Consul TLS settings: %v", err)
+		}
+		if consulConfig.TLSConfig.CAFile == "" && consulConfig.TLSConfig.CAPath == "" {
+			tlsConfig.RootCAs = transport.TLSClientConfig.RootCAs
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	consulConfig.Transport = transport
+	client, err := api.NewClient(consulConfig)
 	if err != nil {
-		FatalLogger.Fatalf("failed to create Consul client: %v", err)
+		mainLog.Fatalf("failed to create Consul client: %v", err)
 	}
 	return client
 }
 
+func setIfNotEmpty(dst *string, value string) {
+	if value != "" {
+		*dst = value
+	}
+}
+
 func createAWSSession(config Config) *session.Session {
+	checkAWSPartition(config)
 	sessOptions := session.Options{
 		Config: aws.Config{
 			Region: aws.String(config.AWSRegion),
+			// regional STS keeps assume-role inside the region's partition,
+			// the global endpoint only exists in the aws partition
+			STSRegionalEndpoint: endpoints.RegionalSTSEndpoint,
+			// bounds every single HTTP attempt so a hung call cannot wedge
+			// a tailer; cancellation on shutdown comes from the contexts
+			HTTPClient: &http.Client{
+				Transport: newHTTPTransport(config),
+				Timeout:   config.apiTimeout(),
+			},
 		},
 	}
+	if config.AWSUseFIPSEndpoint {
+		sessOptions.Config.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
 	// I used profile for local testing
 	if config.AWSProfile != "" {
 		sessOptions.Profile = config.AWSProfile
+	} else if config.AWSUseWebIdentity || config.AWSWebIdentityToken != "" {
+		sessOptions.Config.Credentials = webIdentityCredentials(config, sessOptions.Config)
 	} else if config.AWSRoleARN != "" {
 		sess := session.Must(session.NewSession(&sessOptions.Config))
-		creds := stscreds.NewCredentials(sess, config.AWSRoleARN)
+		creds := stscreds.NewCredentials(sess, config.AWSRoleARN, func(p *stscreds.AssumeRoleProvider) {
+			if config.AWSRoleSessionName != "" {
+				p.RoleSessionName = config.AWSRoleSessionName
+			}
+			if config.AWSMFASerial != "" {
+				p.SerialNumber = aws.String(config.AWSMFASerial)
+				p.TokenProvider = mfaTokenProvider(config.AWSMFATokenCommand)
+			}
+		})
 		sessOptions.Config.Credentials = creds
 	} else if config.AWSAccessKey != "" && config.AWSSecretKey != "" {
 		sessOptions.Config.Credentials = credentials.NewStaticCredentials(
@@ -140,15 +639,118 @@ func createAWSSession(config Config) *session.Session {
 	return session.Must(session.NewSessionWithOptions(sessOptions))
 }
 
-func listLogStreams(cwLogs *cloudwatchlogs.CloudWatchLogs, logGroupName, logStreamPrefix string) ([]string, error) {
-	var logStreams []string
-	err := cwLogs.DescribeLogStreamsPages(&cloudwatchlogs.DescribeLogStreamsInput{
+// serviceAWSConfig returns the config to build the AWS session of a service
+// from. A service that sets a profile, role or access keys replaces the
+// global credential settings entirely instead of layering on top of them, so
+// it can read from an account the global credentials have no access to.
+func serviceAWSConfig(config Config, service ServiceConfig) Config {
+	if service.AWSRegion != "" {
+		config.AWSRegion = service.AWSRegion
+	}
+	if service.AWSProfile == "" && service.AWSRoleARN == "" && service.AWSAccessKey == "" {
+		return config
+	}
+	config.AWSProfile = service.AWSProfile
+	config.AWSRoleARN = service.AWSRoleARN
+	config.AWSRoleSessionName = service.AWSRoleSessionName
+	config.AWSAccessKey = service.AWSAccessKey
+	config.AWSSecretKey = service.AWSSecretKey
+	config.AWSUseWebIdentity = false
+	config.AWSWebIdentityToken = ""
+	config.AWSMFASerial = ""
+	return config
+}
+
+func hasOwnAWSConfig(service ServiceConfig) bool {
+	return service.AWSRegion != "" || service.AWSProfile != "" || service.AWSRoleARN != "" || service.AWSAccessKey != ""
+}
+
+// mfaTokenProvider returns the MFA code for role assumption, either from an
+// external command (e.g. a password manager CLI) or by prompting on stdin.
+func mfaTokenProvider(command string) func() (string, error) {
+	if command == "" {
+		return stscreds.StdinTokenProvider
+	}
+	return func() (string, error) {
+		out, err := exec.Command("sh", "-c", command).Output()
+		if err != nil {
+			return "", fmt.Errorf("mfa token command failed: %v", err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+}
+
+// webIdentityCredentials assumes a role with an OIDC token (EKS IRSA). The
+// role and token file default to the variables injected by the EKS pod
+// identity webhook, but can be overridden in the config.
+func webIdentityCredentials(config Config, awsConfig aws.Config) *credentials.Credentials {
+	roleARN := config.AWSRoleARN
+	if roleARN == "" {
+		roleARN = os.Getenv("AWS_ROLE_ARN")
+	}
+	tokenFile := config.AWSWebIdentityToken
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if roleARN == "" || tokenFile == "" {
+		mainLog.Fatalf("web identity auth needs aws_role_arn and aws_web_identity_token_file (or AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE)")
+	}
+	sessionName := config.AWSRoleSessionName
+	if sessionName == "" {
+		sessionName = "cwsync"
+	}
+
+	sess := session.Must(session.NewSession(&awsConfig))
+	return stscreds.NewWebIdentityCredentials(sess, roleARN, sessionName, tokenFile)
+}
+
+// checkAWSPartition fails fast when the region, the configured partition and
+// the role ARN disagree, which otherwise surfaces as opaque auth errors.
+func checkAWSPartition(config Config) {
+	partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), config.AWSRegion)
+	if !ok {
+		if config.AWSPartition == "" {
+			return
+		}
+		mainLog.Fatalf("unknown aws region %q for partition %q", config.AWSRegion, config.AWSPartition)
+	}
+	if config.AWSPartition != "" && config.AWSPartition != partition.ID() {
+		mainLog.Fatalf("aws region %s belongs to partition %s, not %s", config.AWSRegion, partition.ID(), config.AWSPartition)
+	}
+	if config.AWSRoleARN != "" {
+		roleARN, err := arn.Parse(config.AWSRoleARN)
+		if err != nil {
+			mainLog.Fatalf("invalid aws_role_arn: %v", err)
+		}
+		if roleARN.Partition != partition.ID() {
+			mainLog.Fatalf("aws_role_arn is in partition %s but region %s is in %s", roleARN.Partition, config.AWSRegion, partition.ID())
+		}
+	}
+}
+
+func newCloudWatchLogsClient(sess *session.Session, config Config, limiter *apiLimiter) *cloudwatchlogs.CloudWatchLogs {
+	clientConfig := aws.NewConfig()
+	// endpoint override is meant for localstack/moto in CI and local dev
+	if config.AWSEndpointURL != "" {
+		clientConfig = clientConfig.WithEndpoint(config.AWSEndpointURL)
+	}
+	if config.AWSDisableSSL {
+		clientConfig = clientConfig.WithDisableSSL(true)
+	}
+	cwLogs := cloudwatchlogs.New(sess, clientConfig)
+	cwLogs.Handlers.Sign.PushFrontNamed(limiter.Handler())
+	return cwLogs
+}
+
+func listLogStreams(ctx context.Context, cwLogs *cloudwatchlogs.CloudWatchLogs, logGroupName, logStreamPrefix string) ([]*cloudwatchlogs.LogStream, error) {
+	var logStreams []*cloudwatchlogs.LogStream
+	err := cwLogs.DescribeLogStreamsPagesWithContext(ctx, &cloudwatchlogs.DescribeLogStreamsInput{
 		LogGroupName:        aws.String(logGroupName),
 		LogStreamNamePrefix: aws.String(logStreamPrefix),
 	}, func(page *cloudwatchlogs.DescribeLogStreamsOutput, lastPage bool) bool {
 		for _, stream := range page.LogStreams {
 			if strings.HasPrefix(*stream.LogStreamName, logStreamPrefix) {
-				logStreams = append(logStreams, *stream.LogStreamName)
+				logStreams = append(logStreams, stream)
 			}
 		}
 		return !lastPage
@@ -160,86 +762,46 @@ func listLogStreams(cwLogs *cloudwatchlogs.CloudWatchLogs, logGroupName, logStre
 	return logStreams, nil
 }
 
-func tailLogStream(cwLogs *cloudwatchlogs.CloudWatchLogs, service ServiceConfig, logConfig LogConfig, logStreamName string, consulClient *api.Client, OffsetFallbackDuration time.Duration) {
-	OffsetPath := service.ConsulKVPath + "/" + logStreamName
-	lastTimestamp := loadOffsetFromConsul(consulClient, OffsetPath, OffsetFallbackDuration)
-	//InfoLogger.Printf("Starting to tail log stream %s from timestamp %d", logStreamName, lastTimestamp)
-	InfoLogger.Printf("Starting to tail log stream %s from timestamp %d (%s)", logStreamName, lastTimestamp, time.Unix(lastTimestamp/1000, 0).Format(time.RFC3339))
-	retryDelay := 10 * time.Second
-	maxRetryDelay := 5 * time.Minute
-
-	var nextToken *string
-
-	for {
-		params := &cloudwatchlogs.GetLogEventsInput{
-			LogGroupName:  aws.String(logConfig.LogGroupName),
-			LogStreamName: aws.String(logStreamName),
-			StartTime:     aws.Int64(lastTimestamp),
-			StartFromHead: aws.Bool(true),
-			Limit:         aws.Int64(500),
-			NextToken:     nextToken,
-		}
-
-		resp, err := cwLogs.GetLogEvents(params)
-
-		if err != nil {
-			ErrorLogger.Printf("Error getting log events for stream %s: %v", logStreamName, err)
-			time.Sleep(60 * time.Second)
-			continue
-		}
-
-		if len(resp.Events) > 0 {
-			for _, event := range resp.Events {
-				InfoLogger.Printf("[%s] %s\n", logStreamName, *event.Message)
-			}
-			lastTimestamp = *resp.Events[len(resp.Events)-1].Timestamp
-			err = saveOffsetToConsul(consulClient, OffsetPath, lastTimestamp)
-			if err != nil {
-				FatalLogger.Printf("Error saving offset to Consul: %v", err)
-			}
-			nextToken = resp.NextForwardToken
-			retryDelay = 10 * time.Second
-		} else {
-			if nextToken != nil && *resp.NextForwardToken == *nextToken {
-				lastTimestamp += 1
-				nextToken = nil
-			} else {
-				nextToken = resp.NextForwardToken
-				continue
-			}
-			time.Sleep(retryDelay)
-			if retryDelay < maxRetryDelay {
-				retryDelay *= 2
-			}
-		}
+// saveOffsetToConsul stores lastTimestamp followed by the IDs of the events
+// written at exactly that timestamp, e.g. "1700000000123 id1,id2", so a
+// restart can skip them when it reads that millisecond again.
+func saveOffsetToConsul(consulClient *api.Client, kvPath string, lastTimestamp int64, boundary []string) error {
+	value := strconv.FormatInt(lastTimestamp, 10)
+	if len(boundary) > 0 {
+		value += " " + strings.Join(boundary, ",")
 	}
-}
-
-func saveOffsetToConsul(consulClient *api.Client, kvPath string, lastTimestamp int64) error {
 	kvPair := &api.KVPair{
 		Key:   kvPath,
-		Value: []byte(fmt.Sprintf("%d", lastTimestamp)),
+		Value: []byte(value),
 	}
 	_, err := consulClient.KV().Put(kvPair, nil)
 	return err
 }
 
-func loadOffsetFromConsul(consulClient *api.Client, kvPath string, OffsetFallbackDuration time.Duration) int64 {
+func deleteOffsetFromConsul(consulClient *api.Client, kvPath string) error {
+	_, err := consulClient.KV().Delete(kvPath, nil)
+	return err
+}
+
+func loadOffsetFromConsul(consulClient *api.Client, kvPath string, OffsetFallbackDuration time.Duration) (int64, []string) {
 	var lastTimestamp int64
 	kvPair, _, err := consulClient.KV().Get(kvPath, nil)
 	if err != nil {
-		FatalLogger.Fatalf("Failed to load offset from Consul: %v", err)
+		mainLog.Fatalf("Failed to load offset from Consul: %v", err)
 	}
 
 	if kvPair == nil {
-		InfoLogger.Printf("Offset not found in Consul, using default timestamp of %s", OffsetFallbackDuration)
-		return time.Now().UTC().Add(-OffsetFallbackDuration).UnixMilli()
-	} else {
-		lastTimestamp, err = strconv.ParseInt(string(kvPair.Value), 10, 64)
-		if err != nil {
-			FatalLogger.Fatalf("Failed to parse offset from Consul: %v", err)
-		}
+		mainLog.Infof("Offset not found in Consul, using default timestamp of %s", OffsetFallbackDuration)
+		return time.Now().UTC().Add(-OffsetFallbackDuration).UnixMilli(), nil
 	}
-
-	return lastTimestamp
+	// offsets written before boundary IDs were stored are a bare timestamp
+	value, ids, _ := strings.Cut(string(kvPair.Value), " ")
+	lastTimestamp, err = strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		mainLog.Fatalf("Failed to parse offset from Consul: %v", err)
+	}
+	if ids == "" {
+		return lastTimestamp, nil
+	}
+	return lastTimestamp, strings.Split(ids, ",")
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldMapping is one step of field_mappings: moving the field From to To,
+// which renames it within the same object, or deleting the field Delete.
+// Paths are dotted, like the fields of the json settings.
+type FieldMapping struct {
+	From   string `yaml:"from"`
+	To     string `yaml:"to"`
+	Delete string `yaml:"delete"`
+}
+
+func validateFieldMappings(mappings []FieldMapping) error {
+	for i, m := range mappings {
+		switch {
+		case m.Delete != "" && (m.From != "" || m.To != ""):
+			return fmt.Errorf("mapping %d: delete cannot be combined with from and to", i)
+		case m.Delete == "" && (m.From == "" || m.To == ""):
+			return fmt.Errorf("mapping %d: needs from and to, or delete", i)
+		}
+		for _, path := range []string{m.From, m.To, m.Delete} {
+			if strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+				return fmt.Errorf("mapping %d: invalid field %q", i, path)
+			}
+		}
+	}
+	return nil
+}
+
+type fieldMapping struct {
+	from, to   []string
+	fromName   string
+	deleteOnly bool
+}
+
+// mappingStage applies field_mappings in order to the fields of JSON
+// messages, e.g. to rename them to the fields of a downstream schema.
+type mappingStage struct {
+	mappings []fieldMapping
+}
+
+func newMappingStage(mappings []FieldMapping) *mappingStage {
+	s := &mappingStage{}
+	for _, m := range mappings {
+		if m.Delete != "" {
+			s.mappings = append(s.mappings, fieldMapping{from: strings.Split(m.Delete, "."), fromName: m.Delete, deleteOnly: true})
+			continue
+		}
+		s.mappings = append(s.mappings, fieldMapping{from: strings.Split(m.From, "."), fromName: m.From, to: strings.Split(m.To, ".")})
+	}
+	return s
+}
+
+func (s *mappingStage) apply(event logEvent, out []logEvent) []logEvent {
+	fields := event.Fields
+	if fields == nil {
+		var ok bool
+		if fields, ok = parseJSONObject(event.Message); !ok {
+			return append(out, event)
+		}
+	}
+	changed := false
+	for _, m := range s.mappings {
+		value, ok := removeField(fields, m.fromName, m.from)
+		if !ok {
+			continue
+		}
+		if !m.deleteOnly {
+			setField(fields, m.to, value)
+		}
+		changed = true
+	}
+	if changed {
+		event.Fields = fields
+	}
+	return append(out, event)
+}
+
+// removeField deletes a field found like fieldParent does and returns its
+// value. Objects left empty by it are removed too.
+func removeField(fields map[string]any, field string, path []string) (any, bool) {
+	if value, ok := fields[field]; ok {
+		delete(fields, field)
+		return value, true
+	}
+	if len(path) < 2 {
+		return nil, false
+	}
+	nested, ok := fields[path[0]].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	value, ok := removeField(nested, strings.Join(path[1:], "."), path[1:])
+	if ok && len(nested) == 0 {
+		delete(fields, path[0])
+	}
+	return value, ok
+}
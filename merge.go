@@ -0,0 +1,112 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+const defaultMergeWindow = 5 * time.Second
+
+// streamMerger buffers the events of all streams of one log group and emits
+// them in timestamp order. Every event is held for the merge window after it
+// arrived, so events from streams that are polled a little later can still be
+// sorted in front of it.
+type streamMerger struct {
+	done    chan struct{}
+	mu      sync.Mutex
+	service ServiceConfig
+	window  time.Duration
+	pending mergeHeap
+}
+
+type pendingEvent struct {
+	event   logEvent
+	arrived time.Time
+}
+
+type mergeHeap []pendingEvent
+
+func (h mergeHeap) Len() int           { return len(h) }
+func (h mergeHeap) Less(i, j int) bool { return h[i].event.Timestamp < h[j].event.Timestamp }
+func (h mergeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)        { *h = append(*h, x.(pendingEvent)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+var (
+	mergersMu sync.Mutex
+	mergers   = make(map[string]*streamMerger)
+)
+
+func mergerFor(service ServiceConfig, logGroup string) *streamMerger {
+	key := service.Name + "|" + logGroup
+
+	mergersMu.Lock()
+	defer mergersMu.Unlock()
+	if m, ok := mergers[key]; ok {
+		return m
+	}
+	window := time.Duration(service.MergeWindow)
+	if window <= 0 {
+		window = defaultMergeWindow
+	}
+	m := &streamMerger{service: service, window: window, done: make(chan struct{})}
+	mergers[key] = m
+	go m.run()
+	return m
+}
+
+func (m *streamMerger) add(event logEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	heap.Push(&m.pending, pendingEvent{event: event, arrived: time.Now()})
+}
+
+func (m *streamMerger) run() {
+	tick := m.window / 10
+	if tick < 100*time.Millisecond {
+		tick = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.flush(time.Now().Add(-m.window))
+		}
+	}
+}
+
+// flush emits buffered events in timestamp order for as long as the oldest
+// one has waited out the merge window, i.e. arrived before cutoff.
+func (m *streamMerger) flush(cutoff time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.pending.Len() > 0 && !m.pending[0].arrived.After(cutoff) {
+		item := heap.Pop(&m.pending).(pendingEvent)
+		emitEvent(m.service, item.event)
+	}
+}
+
+// dropMergers flushes and removes the mergers of a service that is stopped,
+// so a restarted service gets mergers with its new settings.
+func dropMergers(serviceName string) {
+	mergersMu.Lock()
+	defer mergersMu.Unlock()
+	for key, m := range mergers {
+		if m.service.Name != serviceName {
+			continue
+		}
+		close(m.done)
+		m.flush(time.Now().Add(time.Hour))
+		delete(mergers, key)
+	}
+}
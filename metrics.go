@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metricsRegistry is a tiny Prometheus-compatible registry for counters and
+// gauges. Series are identified by name plus an ordered list of label pairs.
+type metricsRegistry struct {
+	mu     sync.Mutex
+	kinds  map[string]string
+	help   map[string]string
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	name   string
+	labels []string
+	value  float64
+}
+
+var metrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		kinds:  make(map[string]string),
+		help:   make(map[string]string),
+		series: make(map[string]*metricSeries),
+	}
+}
+
+func (r *metricsRegistry) describe(name, kind, help string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.kinds[name] = kind
+	r.help[name] = help
+}
+
+func seriesKey(name string, labels []string) string {
+	return name + "{" + strings.Join(labels, "\x00") + "}"
+}
+
+func (r *metricsRegistry) get(name string, labels []string) *metricSeries {
+	key := seriesKey(name, labels)
+	s, ok := r.series[key]
+	if !ok {
+		s = &metricSeries{name: name, labels: labels}
+		r.series[key] = s
+	}
+	return s
+}
+
+// Add increments a counter. labels are alternating key/value pairs.
+func (r *metricsRegistry) Add(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.get(name, labels).value += value
+}
+
+// Set sets a gauge. labels are alternating key/value pairs.
+func (r *metricsRegistry) Set(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.get(name, labels).value = value
+}
+
+// Delete removes a series, e.g. the gauge of a stream that is no longer
+// tailed.
+func (r *metricsRegistry) Delete(name string, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.series, seriesKey(name, labels))
+}
+
+// Snapshot returns a copy of all series sorted by name and labels.
+func (r *metricsRegistry) Snapshot() []metricSeries {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]metricSeries, 0, len(r.series))
+	for _, s := range r.series {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].name != out[j].name {
+			return out[i].name < out[j].name
+		}
+		return strings.Join(out[i].labels, ",") < strings.Join(out[j].labels, ",")
+	})
+	return out
+}
+
+func (r *metricsRegistry) kind(name string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if kind, ok := r.kinds[name]; ok {
+		return kind
+	}
+	return "untyped"
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	last := ""
+	for _, s := range r.Snapshot() {
+		if s.name != last {
+			r.mu.Lock()
+			help := r.help[s.name]
+			r.mu.Unlock()
+			if help != "" {
+				fmt.Fprintf(w, "# HELP %s %s\n", s.name, help)
+			}
+			fmt.Fprintf(w, "# TYPE %s %s\n", s.name, r.kind(s.name))
+			last = s.name
+		}
+		fmt.Fprintf(w, "%s%s %g\n", s.name, formatLabels(s.labels), s.value)
+	}
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "%s=%q", labels[i], labels[i+1])
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	serverLog.Infof("Serving metrics on %s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		serverLog.Fatalf("metrics server failed: %v", err)
+	}
+}
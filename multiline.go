@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMultilineTimeout  = 2 * time.Second
+	defaultMultilineMaxLines = 500
+	defaultMultilineMaxBytes = 256 << 10
+)
+
+// MultilineConfig joins events that belong together, such as the lines of a
+// stack trace written as separate CloudWatch events. Either Start matches the
+// first line of every record, or Continuation matches the lines appended to
+// the previous one.
+type MultilineConfig struct {
+	Start        string `yaml:"start"`
+	Continuation string `yaml:"continuation"`
+	// Timeout is how long a record waits for more lines
+	Timeout  Duration `yaml:"timeout"`
+	MaxLines int      `yaml:"max_lines"`
+	MaxBytes int      `yaml:"max_bytes"`
+}
+
+func (c MultilineConfig) enabled() bool {
+	return c.Start != "" || c.Continuation != ""
+}
+
+func (c MultilineConfig) validate() error {
+	if c.Start != "" && c.Continuation != "" {
+		return fmt.Errorf("start and continuation cannot be combined")
+	}
+	for key, pattern := range map[string]string{"start": c.Start, "continuation": c.Continuation} {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid %s pattern %q: %v", key, pattern, err)
+		}
+	}
+	if c.Timeout < 0 || c.MaxLines < 0 || c.MaxBytes < 0 {
+		return fmt.Errorf("timeout, max_lines and max_bytes cannot be negative")
+	}
+	return nil
+}
+
+// flusher is a stage that holds events back across calls of apply. The chain
+// calls flush periodically for the events that are due, and with force when
+// the pipeline drains. Such a stage keeps the max_buffered_bytes share of
+// the events it holds and hands it on with the events it emits.
+type flusher interface {
+	stage
+	flush(now time.Time, force bool, out []logEvent) []logEvent
+	flushInterval() time.Duration
+}
+
+type multilineStage struct {
+	start, continuation *regexp.Regexp
+	timeout             time.Duration
+	maxLines, maxBytes  int
+	// pending is the record being joined per log stream
+	pending map[string]*multilineRecord
+}
+
+type multilineRecord struct {
+	event logEvent
+	lines int
+	parts strings.Builder
+	last  time.Time
+}
+
+func newMultilineStage(config MultilineConfig) *multilineStage {
+	s := &multilineStage{
+		timeout:  time.Duration(config.Timeout),
+		maxLines: config.MaxLines,
+		maxBytes: config.MaxBytes,
+		pending:  make(map[string]*multilineRecord),
+	}
+	// the patterns were validated when loading the config
+	if config.Start != "" {
+		s.start = regexp.MustCompile(config.Start)
+	} else {
+		s.continuation = regexp.MustCompile(config.Continuation)
+	}
+	if s.timeout <= 0 {
+		s.timeout = defaultMultilineTimeout
+	}
+	if s.maxLines <= 0 {
+		s.maxLines = defaultMultilineMaxLines
+	}
+	if s.maxBytes <= 0 {
+		s.maxBytes = defaultMultilineMaxBytes
+	}
+	return s
+}
+
+func (s *multilineStage) apply(event logEvent, out []logEvent) []logEvent {
+	line := strings.TrimRight(event.Message, "\r\n")
+	key := event.LogGroup + "\x00" + event.LogStream
+	continues := s.continuation != nil && s.continuation.MatchString(line) ||
+		s.start != nil && !s.start.MatchString(line)
+	r := s.pending[key]
+	if r != nil && continues && r.lines < s.maxLines && r.parts.Len()+1+len(line) <= s.maxBytes {
+		r.parts.WriteByte('\n')
+		r.parts.WriteString(line)
+		r.lines++
+		r.event.buffered += event.buffered
+		r.last = time.Now()
+		return out
+	}
+	if r != nil {
+		out = append(out, r.record())
+	}
+	// a continuation without a record to join, e.g. the first line after a
+	// restart, starts a record of its own
+	r = &multilineRecord{event: event, lines: 1, last: time.Now()}
+	r.parts.WriteString(line)
+	s.pending[key] = r
+	return out
+}
+
+func (r *multilineRecord) record() logEvent {
+	event := r.event
+	event.Message = r.parts.String()
+	return event
+}
+
+func (s *multilineStage) flush(now time.Time, force bool, out []logEvent) []logEvent {
+	for key, r := range s.pending {
+		if force || now.Sub(r.last) >= s.timeout {
+			out = append(out, r.record())
+			delete(s.pending, key)
+		}
+	}
+	return out
+}
+
+func (s *multilineStage) flushInterval() time.Duration {
+	return max(s.timeout/4, 100*time.Millisecond)
+}
@@ -0,0 +1,47 @@
+package main
+
+// logEvent is a single CloudWatch log event on its way to a destination.
+type logEvent struct {
+	LogGroup      string
+	LogStream     string
+	Timestamp     int64
+	IngestionTime int64
+	Message       string
+	// Level is the detected level, one of levelNames, if the service
+	// detects levels
+	Level string
+	// Account is the account the log group belongs to, if the source
+	// tells
+	Account string
+	// Fields holds what a parser such as the json stage extracted from the
+	// message; the message is re-encoded from it by the encode stage
+	Fields map[string]any
+	// buffered is the share of max_buffered_bytes the event holds until it
+	// is written
+	buffered int64
+}
+
+// writeEvents hands the events of one fetched page to the service's
+// pipeline, blocking while the pipeline is full or max_buffered_bytes is used
+// up. Both the CloudWatch poller and the Kinesis consumer go through here so
+// they produce identical output. The slice may be reused once it returns.
+func writeEvents(service ServiceConfig, events []logEvent) {
+	if len(events) == 0 {
+		return
+	}
+	var size int
+	for i := range events {
+		size += len(events[i].Message)
+	}
+	buffered.acquire(int64(size), service.priority())
+	p := pipelineFor(service)
+	for _, event := range events {
+		event.buffered = int64(len(event.Message))
+		p.fetched <- event
+	}
+}
+
+// emitEvent queues a transformed event for writing, used by the mergers.
+func emitEvent(service ServiceConfig, event logEvent) {
+	pipelineFor(service).send(event)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultOutputBuffer = 1000
+
+// pipeline carries the events of one service from the fetchers through the
+// transform stage to the writer, which delivers them to the destination in
+// batches. Both hops are bounded channels, so a
+// destination that cannot keep up blocks writeEvents and with it the fetchers,
+// instead of events piling up in memory.
+type pipeline struct {
+	service     ServiceConfig
+	fetched     chan logEvent
+	transformed chan logEvent
+	// routes have a writer each, fed by send
+	routes      []*eventRoute
+	transformWG sync.WaitGroup
+	writeWG     sync.WaitGroup
+	draining    atomic.Bool
+}
+
+var (
+	pipelinesMu sync.Mutex
+	pipelines   = make(map[string]*pipeline)
+)
+
+func pipelineFor(service ServiceConfig) *pipeline {
+	pipelinesMu.Lock()
+	defer pipelinesMu.Unlock()
+	if p, ok := pipelines[service.Name]; ok {
+		return p
+	}
+	size := service.OutputBuffer
+	if size <= 0 {
+		size = defaultOutputBuffer
+	}
+	p := &pipeline{
+		service:     service,
+		fetched:     make(chan logEvent, size),
+		transformed: make(chan logEvent, size),
+		routes:      newRoutes(service, size),
+	}
+	p.transformWG.Add(1)
+	go p.transform()
+	p.writeWG.Add(1 + len(p.routes))
+	go p.write(p.service, p.transformed)
+	for _, r := range p.routes {
+		go p.write(r.service, r.events)
+	}
+	pipelines[service.Name] = p
+	return p
+}
+
+func (p *pipeline) transform() {
+	defer p.transformWG.Done()
+	chain := newTransformChain(p.service)
+	defer chain.close()
+	var tick <-chan time.Time
+	if chain.tick > 0 {
+		ticker := time.NewTicker(chain.tick)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		var events []logEvent
+		select {
+		case event, ok := <-p.fetched:
+			if !ok {
+				p.emit(chain.flush(true))
+				return
+			}
+			events = chain.run(event)
+		case <-tick:
+			events = chain.flush(false)
+		}
+		p.emit(events)
+	}
+}
+
+// emit hands transformed events to the merger of their log group or the
+// writer.
+func (p *pipeline) emit(events []logEvent) {
+	for _, event := range events {
+		if p.service.MergeStreams {
+			mergerFor(p.service, event.LogGroup).add(event)
+			continue
+		}
+		p.send(event)
+	}
+}
+
+// send queues a transformed event for the writer of the first route it
+// matches, or the service's destination. A route that continues gets a copy,
+// the share of max_buffered_bytes stays with the event.
+func (p *pipeline) send(event logEvent) {
+	for _, r := range p.routes {
+		if !r.match(&event) {
+			continue
+		}
+		metrics.Add(metricRoutedEvents, 1, "service", p.service.Name, "route", r.config.Name)
+		if !r.config.Continue {
+			r.events <- event
+			return
+		}
+		routed := event
+		routed.buffered = 0
+		r.events <- routed
+	}
+	p.transformed <- event
+}
+
+// write collects the events of one destination, the service's or a route's
+// as set in service, into batches and delivers them to its sink.
+func (p *pipeline) write(service ServiceConfig, events <-chan logEvent) {
+	defer p.writeWG.Done()
+	out := newSink(service)
+	defer out.close()
+	maxSize, maxBytes, interval := service.Destination.batchSettings()
+	throttle := newOutputThrottle(service.Destination)
+
+	var batch []logEvent
+	// size is the message bytes of the batch, held its share of
+	// max_buffered_bytes, which differ once messages were split or cut
+	size := 0
+	var held int64
+	timer := time.NewTimer(interval)
+	timer.Stop()
+	for {
+		var full <-chan struct{}
+		if len(batch) > 0 {
+			full = buffered.fullCh()
+		}
+		select {
+		case event, ok := <-events:
+			if !ok {
+				p.wait(throttle.delay(len(batch), size))
+				p.deliver(out, batch)
+				buffered.release(held)
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(interval)
+			}
+			n := len(batch)
+			batch = service.Destination.fit(service.Name, event, batch)
+			for _, chunk := range batch[n:] {
+				size += len(chunk.Message)
+			}
+			held += event.buffered
+			if len(batch) < maxSize && size < maxBytes {
+				continue
+			}
+			timer.Stop()
+		case <-timer.C:
+		case <-full:
+			timer.Stop()
+		}
+		p.wait(throttle.delay(len(batch), size))
+		p.deliver(out, batch)
+		buffered.release(held)
+		batch, size, held = batch[:0], 0, 0
+	}
+}
+
+// wait holds the writer back for the destination's rate limits. Events are
+// left queued meanwhile, so fetching pauses once the queues are full. A
+// draining pipeline stops waiting, so shutdown is not stretched by a low
+// limit.
+func (p *pipeline) wait(d time.Duration) {
+	if d <= 0 || p.draining.Load() {
+		return
+	}
+	metrics.Add(metricOutputThrottled, d.Seconds(), "service", p.service.Name)
+	for d > 0 && !p.draining.Load() {
+		step := min(d, time.Second)
+		time.Sleep(step)
+		d -= step
+	}
+}
+
+// deliver writes a batch, retrying until it succeeds so a failing destination
+// holds back fetching rather than losing events. Once the pipeline is
+// draining a failed batch is dropped, so a broken destination cannot block
+// shutdown.
+func (p *pipeline) deliver(out sink, batch []logEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	for {
+		err := out.write(batch)
+		if err == nil {
+			return
+		}
+		if p.draining.Load() {
+			pipelineLog.with("service", p.service.Name).Errorf("Dropping %d events of %s: %v", len(batch), p.service.Name, err)
+			return
+		}
+		pipelineLog.with("service", p.service.Name).Warnf("Error writing events of %s, retrying: %v", p.service.Name, err)
+		time.Sleep(sinkRetryDelay)
+	}
+}
+
+// drain waits until every event of the service is written, including the
+// ones held back by its mergers. The fetchers of the service must have
+// stopped.
+func (p *pipeline) drain() {
+	close(p.fetched)
+	p.transformWG.Wait()
+	dropMergers(p.service.Name)
+	p.draining.Store(true)
+	close(p.transformed)
+	for _, r := range p.routes {
+		close(r.events)
+	}
+	p.writeWG.Wait()
+}
+
+// dropPipeline writes out the buffered events of a stopped service and
+// removes its pipeline, so a restarted service gets one with its new
+// settings.
+func dropPipeline(serviceName string) {
+	pipelinesMu.Lock()
+	p, ok := pipelines[serviceName]
+	pipelinesMu.Unlock()
+	if !ok {
+		return
+	}
+	p.drain()
+	pipelinesMu.Lock()
+	delete(pipelines, serviceName)
+	pipelinesMu.Unlock()
+}
+
+// drainPipelines writes out the buffered events of every service, used on
+// shutdown once all fetchers returned.
+func drainPipelines() {
+	pipelinesMu.Lock()
+	names := make([]string, 0, len(pipelines))
+	for name := range pipelines {
+		names = append(names, name)
+	}
+	pipelinesMu.Unlock()
+	for _, name := range names {
+		dropPipeline(name)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+const defaultMaxConcurrentTails = 64
+
+// tailPool drives every stream tail of the process with a fixed number of
+// workers. A tail that has to wait for its next poll holds no goroutine, only
+// a place in the due heap, and a single scheduler goroutine hands tails to
+// the workers when their poll is due. Ready tails are served in FIFO order
+// within their service's priority, higher priorities first.
+type tailPool struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	ready [numPriorities][]*streamTail
+	due   dueHeap
+	seq   uint64
+	wake  chan struct{}
+}
+
+func newTailPool(workers int) *tailPool {
+	if workers <= 0 {
+		workers = defaultMaxConcurrentTails
+	}
+	p := &tailPool{wake: make(chan struct{}, 1)}
+	p.cond = sync.NewCond(&p.mu)
+	go p.scheduler()
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *tailPool) push(t *streamTail) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readyLocked(t)
+}
+
+func (p *tailPool) next() *streamTail {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		for i := range p.ready {
+			if ready := p.ready[i]; len(ready) > 0 {
+				t := ready[0]
+				ready[0] = nil
+				p.ready[i] = ready[1:]
+				return t
+			}
+		}
+		p.cond.Wait()
+	}
+}
+
+func (p *tailPool) work() {
+	for {
+		t := p.next()
+		delay, err := t.step()
+		if err != nil {
+			t.m.finish(t, err)
+			continue
+		}
+		p.schedule(t, delay)
+	}
+}
+
+// schedule queues the tail again after delay by adding it to the due heap.
+// Stopping the tail's context queues it right away, so a stopped tail finishes
+// without waiting out its poll interval.
+func (p *tailPool) schedule(t *streamTail, delay time.Duration) {
+	if delay <= 0 {
+		p.push(t)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	item := &dueTail{t: t, due: time.Now().Add(delay), seq: p.seq}
+	p.seq++
+	heap.Push(&p.due, item)
+	item.stop = context.AfterFunc(t.ctx, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if item.index >= 0 {
+			heap.Remove(&p.due, item.index)
+			p.readyLocked(t)
+		}
+	})
+	if item.index == 0 {
+		// the new tail is due before everything else, move the
+		// scheduler's timer forward
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// readyLocked queues a tail for the workers. p.mu must be held.
+func (p *tailPool) readyLocked(t *streamTail) {
+	priority := t.service.priority()
+	p.ready[priority] = append(p.ready[priority], t)
+	p.cond.Signal()
+}
+
+// scheduler moves tails whose poll is due from the heap to the ready queue.
+// One timer, set to the earliest due time, serves every waiting tail.
+func (p *tailPool) scheduler() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		p.mu.Lock()
+		now := time.Now()
+		for p.due.Len() > 0 && !p.due[0].due.After(now) {
+			item := heap.Pop(&p.due).(*dueTail)
+			item.stop()
+			p.readyLocked(item.t)
+		}
+		wait := time.Hour
+		if p.due.Len() > 0 {
+			wait = p.due[0].due.Sub(now)
+		}
+		p.mu.Unlock()
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-p.wake:
+		}
+	}
+}
+
+// dueTail is a tail waiting in the heap for its next poll. Tails due at the
+// same time keep the order they were scheduled in.
+type dueTail struct {
+	t     *streamTail
+	due   time.Time
+	seq   uint64
+	index int
+	// stop unregisters the context callback once the tail left the heap
+	stop func() bool
+}
+
+type dueHeap []*dueTail
+
+func (h dueHeap) Len() int { return len(h) }
+func (h dueHeap) Less(i, j int) bool {
+	if h[i].due.Equal(h[j].due) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].due.Before(h[j].due)
+}
+func (h dueHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *dueHeap) Push(x any) {
+	item := x.(*dueTail)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *dueHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	item.index = -1
+	*h = old[:len(old)-1]
+	return item
+}
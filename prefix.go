@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+)
+
+// prefixNone omits the stream prefix of the default lines.
+const prefixNone = "none"
+
+// maxCachedPrefixes bounds the rendered prefixes kept per destination.
+const maxCachedPrefixes = 10000
+
+// prefixEvent is what a destination prefix is executed with.
+type prefixEvent struct {
+	Service     string
+	Group       string
+	Stream      string
+	ShortStream string
+}
+
+// shortStream shortens a stream name to its last part, without the
+// [version] of Lambda streams and cut to 8 characters if it is a long ID:
+// "2024/01/15/[$LATEST]0123456789abcdef" becomes "01234567".
+func shortStream(stream string) string {
+	short := stream[strings.LastIndexByte(stream, '/')+1:]
+	if strings.HasPrefix(short, "[") {
+		if end := strings.IndexByte(short, ']'); end >= 0 {
+			short = short[end+1:]
+		}
+	}
+	if len(short) > 12 {
+		short = short[:8]
+	}
+	return short
+}
+
+func checkPrefixTemplate(text string) error {
+	if text == "" || text == prefixNone {
+		return nil
+	}
+	tmpl, err := template.New("prefix").Parse(text)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(io.Discard, prefixEvent{})
+}
+
+// linePrefix renders destination.prefix, which replaces the "[stream] " of
+// the default lines. A prefix only depends on the group and stream, so it is
+// rendered once per stream.
+type linePrefix struct {
+	tmpl     *template.Template
+	service  string
+	rendered map[string]string
+}
+
+func newLinePrefix(service ServiceConfig) *linePrefix {
+	text := service.Destination.Prefix
+	if text == "" {
+		return nil
+	}
+	p := &linePrefix{service: service.Name, rendered: make(map[string]string)}
+	if text != prefixNone {
+		// the prefix was validated when loading the config
+		p.tmpl, _ = template.New("prefix").Parse(text)
+	}
+	return p
+}
+
+func (p *linePrefix) render(event *logEvent) string {
+	if p.tmpl == nil {
+		return ""
+	}
+	key := event.LogGroup + "\x00" + event.LogStream
+	if prefix, ok := p.rendered[key]; ok {
+		return prefix
+	}
+	var b strings.Builder
+	err := p.tmpl.Execute(&b, prefixEvent{
+		Service:     p.service,
+		Group:       event.LogGroup,
+		Stream:      event.LogStream,
+		ShortStream: shortStream(event.LogStream),
+	})
+	prefix := b.String()
+	if err != nil {
+		pipelineLog.with("service", p.service).Errorf("Error executing the destination prefix of %s: %v", p.service, err)
+		prefix = fmt.Sprintf("[%s] ", event.LogStream)
+	}
+	if len(p.rendered) >= maxCachedPrefixes {
+		clear(p.rendered)
+	}
+	p.rendered[key] = prefix
+	return prefix
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// presets are the built-in parsers for the log formats of AWS services,
+// selected by the preset of a service. Each sets the fields of the events it
+// recognizes and passes the others on unchanged.
+var presets = map[string]func(ServiceConfig) stage{
+	"alb":         newALBPreset,
+	"api_gateway": newAPIGatewayPreset,
+	"awslogs":     newAWSLogsPreset,
+	"cloudtrail":  newCloudTrailPreset,
+	"fluentbit":   newFluentBitPreset,
+	"lambda":      newLambdaPreset,
+	"mysql":       newMySQLPreset,
+	"postgres":    newPostgresPreset,
+	"vpc_flow":    newVPCFlowPreset,
+}
+
+func validatePreset(name string) error {
+	if _, ok := presets[name]; !ok {
+		names := make([]string, 0, len(presets))
+		for name := range presets {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("unknown preset %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// presetNumber stores value as a number like those of parsed JSON messages,
+// or as it is if it is not one.
+func presetNumber(value string) any {
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return value
+	}
+	return json.Number(value)
+}
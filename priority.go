@@ -0,0 +1,38 @@
+package main
+
+import "context"
+
+// Service priorities. Lower values are served first wherever services compete:
+// for pool workers, API tokens and the max_buffered_bytes budget.
+const (
+	priorityHigh = iota
+	priorityNormal
+	priorityLow
+	numPriorities
+)
+
+func (s ServiceConfig) priority() int {
+	switch s.Priority {
+	case "high":
+		return priorityHigh
+	case "low":
+		return priorityLow
+	default:
+		return priorityNormal
+	}
+}
+
+type priorityKey struct{}
+
+// withPriority tags ctx with a service priority, so the API rate limiter can
+// tell the calls of different services apart.
+func withPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+func priorityFrom(ctx context.Context) int {
+	if priority, ok := ctx.Value(priorityKey{}).(int); ok {
+		return priority
+	}
+	return priorityNormal
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// profileFromEnv is the default of --config-profile.
+func profileFromEnv() string {
+	return os.Getenv("CWSYNC_PROFILE")
+}
+
+// applyProfile overlays the named profile on the config. A profile holds any
+// top-level settings (aws_region, aws_role_arn, consul, defaults, ...), which
+// replace the base values key by key; nested blocks such as consul are
+// merged. The profile-only key destination replaces the destination of every
+// service.
+func applyProfile(config *Config, name string) error {
+	if name == "" {
+		return nil
+	}
+	overlay, ok := config.Profiles[name]
+	if !ok {
+		var names []string
+		for profile := range config.Profiles {
+			names = append(names, profile)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown config profile %q, the config defines: %s", name, strings.Join(names, ", "))
+	}
+
+	rest := make(map[string]any, len(overlay))
+	for key, value := range overlay {
+		rest[key] = value
+	}
+	destinationValue, hasDestination := rest["destination"]
+	delete(rest, "destination")
+	if _, ok := rest["profiles"]; ok {
+		return fmt.Errorf("config profile %s: profiles cannot be nested", name)
+	}
+
+	data, err := yaml.Marshal(rest)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return fmt.Errorf("%s", strings.Join(decodeErrors("profiles."+name, false, err), "\n"))
+	}
+	if hasDestination {
+		data, err := yaml.Marshal(destinationValue)
+		if err != nil {
+			return err
+		}
+		var destination Destination
+		if err := yaml.UnmarshalStrict(data, &destination); err != nil {
+			return fmt.Errorf("%s", strings.Join(decodeErrors("profiles."+name+".destination", false, err), "\n"))
+		}
+		for i := range config.Services {
+			config.Services[i].Destination = destination
+		}
+		config.Defaults.Destination = destination
+	}
+	return nil
+}
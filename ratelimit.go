@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	defaultGetLogEventsTPS       = 20
+	defaultDescribeLogStreamsTPS = 5
+	defaultDescribeLogGroupsTPS  = 5
+	defaultListTagsTPS           = 5
+	// the AWS quota of FilterLogEvents is 5 per second per account and region
+	defaultFilterLogEventsTPS = 5
+)
+
+type RateLimitConfig struct {
+	GetLogEvents       float64 `yaml:"get_log_events"`
+	DescribeLogStreams float64 `yaml:"describe_log_streams"`
+	DescribeLogGroups  float64 `yaml:"describe_log_groups"`
+	ListTags           float64 `yaml:"list_tags"`
+	FilterLogEvents    float64 `yaml:"filter_log_events"`
+	Burst              int     `yaml:"burst"`
+}
+
+// tokenBucket is a minimal token-bucket limiter. Tokens refill continuously at
+// rate per second up to burst; Wait blocks until one token is available.
+// Callers of a higher priority get tokens first.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// waiting counts the callers blocked in Wait by priority
+	waiting [numPriorities]int
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token for a caller of the given priority, unless callers
+// of a higher priority are waiting for one.
+func (b *tokenBucket) reserve(priority int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	for higher := 0; higher < priority; higher++ {
+		if b.waiting[higher] > 0 {
+			return time.Duration(float64(time.Second) / b.rate)
+		}
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// reserveN takes n tokens, going into debt if there are fewer, and returns
+// how long it takes until the debt is paid back.
+func (b *tokenBucket) reserveN(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait takes a token, with the priority ctx was tagged with by withPriority.
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	priority := priorityFrom(ctx)
+	wait := b.reserve(priority)
+	if wait == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	b.waiting[priority]++
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.waiting[priority]--
+		b.mu.Unlock()
+	}()
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if wait = b.reserve(priority); wait == 0 {
+			return nil
+		}
+	}
+}
+
+// apiLimiter holds one bucket per CloudWatch Logs operation. It is shared by
+// every client in the process so the configured TPS is a global ceiling no
+// matter how many streams are being tailed.
+type apiLimiter struct {
+	buckets map[string]*tokenBucket
+}
+
+func newAPILimiter(config RateLimitConfig) *apiLimiter {
+	getLogEvents := config.GetLogEvents
+	if getLogEvents <= 0 {
+		getLogEvents = defaultGetLogEventsTPS
+	}
+	describeLogStreams := config.DescribeLogStreams
+	if describeLogStreams <= 0 {
+		describeLogStreams = defaultDescribeLogStreamsTPS
+	}
+	describeLogGroups := config.DescribeLogGroups
+	if describeLogGroups <= 0 {
+		describeLogGroups = defaultDescribeLogGroupsTPS
+	}
+	listTags := config.ListTags
+	if listTags <= 0 {
+		listTags = defaultListTagsTPS
+	}
+	filterLogEvents := config.FilterLogEvents
+	if filterLogEvents <= 0 {
+		filterLogEvents = defaultFilterLogEventsTPS
+	}
+	return &apiLimiter{
+		buckets: map[string]*tokenBucket{
+			"GetLogEvents":        newTokenBucket(getLogEvents, config.Burst),
+			"DescribeLogStreams":  newTokenBucket(describeLogStreams, config.Burst),
+			"DescribeLogGroups":   newTokenBucket(describeLogGroups, config.Burst),
+			"ListTagsForResource": newTokenBucket(listTags, config.Burst),
+			"FilterLogEvents":     newTokenBucket(filterLogEvents, config.Burst),
+		},
+	}
+}
+
+// Handler is installed on the Sign phase so it also runs for every retry
+// attempt made by the SDK, not only the first call.
+func (l *apiLimiter) Handler() request.NamedHandler {
+	return request.NamedHandler{
+		Name: "cwsync.RateLimit",
+		Fn: func(r *request.Request) {
+			bucket, ok := l.buckets[r.Operation.Name]
+			if !ok {
+				return
+			}
+			if err := bucket.Wait(r.Context()); err != nil {
+				r.Error = err
+			}
+		},
+	}
+}
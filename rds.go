@@ -0,0 +1,146 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// postgresLine is a line of the default log_line_prefix of RDS,
+	// %t:%r:%u@%d:[%p]:, followed by the severity
+	postgresLine = regexp.MustCompile(`^(\d{4}-\d\d-\d\d \d\d:\d\d:\d\d(?:\.\d+)? [A-Z]+):(\S*?):(\S*?)@(\S*?):\[(\d+)\]:([A-Z0-9]+):\s+`)
+	// postgresStatement is a statement logged by log_statement or
+	// log_min_duration_statement, with the duration of the latter
+	postgresStatement = regexp.MustCompile(`(?s)^(?:duration: ([\d.]+) ms\s*)?(?:(?:statement|execute [^:]*): (.*))?$`)
+	// mysqlErrorLine is a line of the error log: timestamp, thread, severity
+	// and, from 8.0, error code and subsystem
+	mysqlErrorLine = regexp.MustCompile(`^(\d{4}-\d\d-\d\d[T ][\d:.]+(?:Z|[+-]\d\d:\d\d)?)\s+(\d+)\s+\[(\w+)\](?:\s+\[(MY-\d+)\])?(?:\s+\[(\w+)\])?\s*`)
+	mysqlUserHost  = regexp.MustCompile(`^# User@Host: (\S*?)\[[^\]]*\] @ (\S*) \[([^\]]*)\](?:\s+Id:\s+(\d+))?`)
+	mysqlSlowStat  = regexp.MustCompile(`(\w+): (\S+)`)
+)
+
+// postgresPreset parses the PostgreSQL log of RDS and Aurora.
+type postgresPreset struct{}
+
+func newPostgresPreset(ServiceConfig) stage { return postgresPreset{} }
+
+func (postgresPreset) apply(event logEvent, out []logEvent) []logEvent {
+	if event.Fields != nil {
+		return append(out, event)
+	}
+	message := strings.TrimRight(event.Message, "\n")
+	m := postgresLine.FindStringSubmatch(message)
+	if m == nil {
+		return append(out, event)
+	}
+	text := message[len(m[0]):]
+	fields := map[string]any{
+		"timestamp": m[1],
+		"pid":       presetNumber(m[5]),
+		"severity":  m[6],
+		"message":   text,
+	}
+	// the remote end is host(port), empty for background processes
+	if host, port, ok := strings.Cut(strings.TrimSuffix(m[2], ")"), "("); ok {
+		fields["remote_host"], fields["remote_port"] = host, presetNumber(port)
+	} else if m[2] != "" {
+		fields["remote_host"] = m[2]
+	}
+	if m[3] != "" {
+		fields["user"] = m[3]
+	}
+	if m[4] != "" {
+		fields["database"] = m[4]
+	}
+	if m[6] == "STATEMENT" {
+		fields["statement"] = text
+	} else if s := postgresStatement.FindStringSubmatch(text); s != nil && m[6] == "LOG" {
+		if s[1] != "" {
+			fields["duration_ms"] = presetNumber(s[1])
+		}
+		if s[2] != "" {
+			fields["statement"] = s[2]
+		}
+	}
+	event.Fields = fields
+	return append(out, event)
+}
+
+// mysqlPreset parses the error log and the slow query log of MySQL and
+// MariaDB on RDS and Aurora.
+type mysqlPreset struct{}
+
+func newMySQLPreset(ServiceConfig) stage { return mysqlPreset{} }
+
+func (mysqlPreset) apply(event logEvent, out []logEvent) []logEvent {
+	if event.Fields != nil {
+		return append(out, event)
+	}
+	message := strings.TrimRight(event.Message, "\n")
+	if strings.HasPrefix(message, "# Time: ") || strings.HasPrefix(message, "# User@Host: ") {
+		event.Fields = mysqlSlowQuery(message)
+		return append(out, event)
+	}
+	m := mysqlErrorLine.FindStringSubmatch(message)
+	if m == nil {
+		return append(out, event)
+	}
+	fields := map[string]any{
+		"timestamp": m[1],
+		"thread_id": presetNumber(m[2]),
+		"severity":  m[3],
+		"message":   message[len(m[0]):],
+	}
+	if m[4] != "" {
+		fields["error_code"] = m[4]
+	}
+	if m[5] != "" {
+		fields["subsystem"] = m[5]
+	}
+	event.Fields = fields
+	return append(out, event)
+}
+
+// mysqlSlowQuery parses an entry of the slow query log, which RDS publishes
+// as one event: the # header lines, then the statement.
+func mysqlSlowQuery(entry string) map[string]any {
+	fields := map[string]any{"type": "slow_query"}
+	var statement []string
+	for _, line := range strings.Split(entry, "\n") {
+		switch {
+		case strings.HasPrefix(line, "# Time: "):
+			fields["timestamp"] = strings.TrimSpace(line[len("# Time: "):])
+		case strings.HasPrefix(line, "# User@Host: "):
+			if m := mysqlUserHost.FindStringSubmatch(line); m != nil {
+				fields["user"] = m[1]
+				if m[2] != "" {
+					fields["host"] = m[2]
+				}
+				if m[3] != "" {
+					fields["client_ip"] = m[3]
+				}
+				if m[4] != "" {
+					fields["thread_id"] = presetNumber(m[4])
+				}
+			}
+		case strings.HasPrefix(line, "# "):
+			// Query_time: 2.000123  Lock_time: 0.000100 Rows_sent: 1 ...
+			for _, m := range mysqlSlowStat.FindAllStringSubmatch(line, -1) {
+				fields[strings.ToLower(m[1])] = presetNumber(m[2])
+			}
+		case strings.HasPrefix(line, "SET timestamp="):
+			if ts, err := strconv.ParseInt(strings.TrimSuffix(line[len("SET timestamp="):], ";"), 10, 64); err == nil {
+				fields["query_start"] = ts
+			}
+		case strings.HasPrefix(line, "use ") && len(statement) == 0:
+			fields["database"] = strings.TrimSuffix(line[len("use "):], ";")
+		default:
+			statement = append(statement, line)
+		}
+	}
+	if len(statement) > 0 {
+		fields["statement"] = strings.Join(statement, "\n")
+	}
+	return fields
+}
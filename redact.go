@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const metricRedactedEvents = "cwsync_redacted_events_total"
+
+func init() {
+	metrics.describe(metricRedactedEvents, "counter", "Events changed by a redact rule.")
+}
+
+// RedactRule masks sensitive data before events leave cwsync. A rule with a
+// pattern replaces what it matches, in the message or, for JSON messages, in
+// every string value; a rule with a field replaces the value of that field,
+// or only what the pattern matches in it if both are set.
+type RedactRule struct {
+	// Name identifies the rule in metrics. Without pattern and field it
+	// names one of the builtinRedactRules.
+	Name    string `yaml:"name"`
+	Pattern string `yaml:"pattern"`
+	// Field is a dotted path into the JSON object of the message
+	Field string `yaml:"field"`
+	// Replacement may refer to groups of the pattern as ${1}, default
+	// [REDACTED:<name>]
+	Replacement string `yaml:"replacement"`
+}
+
+// builtinRedactRules are the rules that only need a name.
+var builtinRedactRules = map[string]struct {
+	pattern, replacement string
+	// check confirms a match, the pattern alone is too broad
+	check func(string) bool
+}{
+	"email":          {pattern: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`},
+	"credit_card":    {pattern: `\b(?:\d[ -]?){12,18}\d\b`, check: luhnValid},
+	"aws_access_key": {pattern: `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`},
+	"bearer_token":   {pattern: `(?i)\b(bearer\s+)[A-Za-z0-9._~+/-]+=*`, replacement: "${1}[REDACTED:bearer_token]"},
+	"jwt":            {pattern: `\beyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`},
+}
+
+// luhnValid reports whether the digits of s pass the Luhn checksum of card
+// numbers.
+func luhnValid(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+type redactRule struct {
+	name        string
+	re          *regexp.Regexp
+	check       func(string) bool
+	path        []string
+	field       string
+	replacement string
+}
+
+func compileRedactRules(rules []RedactRule) ([]redactRule, error) {
+	var out []redactRule
+	names := make(map[string]bool)
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate rule %q", rule.Name)
+		}
+		names[rule.Name] = true
+		r := redactRule{name: rule.Name, field: rule.Field, replacement: rule.Replacement}
+		pattern := rule.Pattern
+		if pattern == "" && rule.Field == "" {
+			builtin, ok := builtinRedactRules[rule.Name]
+			if !ok {
+				return nil, fmt.Errorf("rule %q needs a pattern or field, or one of the builtin names email, credit_card, aws_access_key, bearer_token and jwt", rule.Name)
+			}
+			pattern, r.check = builtin.pattern, builtin.check
+			if r.replacement == "" {
+				r.replacement = builtin.replacement
+			}
+		}
+		if pattern != "" {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q of rule %q: %v", pattern, rule.Name, err)
+			}
+			r.re = re
+		}
+		if rule.Field != "" {
+			if strings.HasPrefix(rule.Field, ".") || strings.HasSuffix(rule.Field, ".") || strings.Contains(rule.Field, "..") {
+				return nil, fmt.Errorf("invalid field %q of rule %q", rule.Field, rule.Name)
+			}
+			r.path = strings.Split(rule.Field, ".")
+		}
+		if r.replacement == "" {
+			r.replacement = "[REDACTED:" + rule.Name + "]"
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// redact applies the rule's pattern to s and reports whether it changed.
+func (r *redactRule) redact(s string) (string, bool) {
+	if r.re == nil {
+		return r.replacement, true
+	}
+	var redacted string
+	if r.check != nil {
+		redacted = r.re.ReplaceAllStringFunc(s, func(match string) string {
+			if !r.check(match) {
+				return match
+			}
+			return r.replacement
+		})
+	} else {
+		redacted = r.re.ReplaceAllString(s, r.replacement)
+	}
+	return redacted, redacted != s
+}
+
+// redactStage runs before the fields of an event are encoded, so JSON
+// messages are redacted value by value and stay valid JSON. Rules without a
+// field then run once more against the whole message, catching what spans
+// keys and values.
+type redactStage struct {
+	rules   []redactRule
+	service string
+	matched []bool
+}
+
+func newRedactStage(service ServiceConfig) *redactStage {
+	// the rules were validated when loading the config
+	rules, _ := compileRedactRules(service.Redact)
+	return &redactStage{rules: rules, service: service.Name, matched: make([]bool, len(rules))}
+}
+
+func (s *redactStage) apply(event logEvent, out []logEvent) []logEvent {
+	clear(s.matched)
+	fields := event.Fields
+	if fields == nil {
+		// JSON messages without json settings are redacted value by value
+		// too, and only re-encoded if a rule matched
+		fields, _ = parseJSONObject(event.Message)
+	}
+	if fields != nil {
+		changed := s.redactFields(fields)
+		if changed && event.Fields == nil {
+			event.Fields = fields
+		}
+		text := event.Message
+		if event.Fields != nil {
+			text = encodeFields(fields)
+		}
+		if redacted, ok := s.redactMessage(text); ok {
+			// a match left in the encoded message is redacted there,
+			// even if that makes it invalid JSON
+			event.Message, event.Fields = redacted, nil
+		}
+	} else {
+		event.Message, _ = s.redactMessage(event.Message)
+	}
+	for i, matched := range s.matched {
+		if matched {
+			metrics.Add(metricRedactedEvents, 1, "service", s.service, "rule", s.rules[i].name)
+		}
+	}
+	return append(out, event)
+}
+
+// redactMessage applies the rules without a field to text and reports
+// whether any of them matched.
+func (s *redactStage) redactMessage(text string) (string, bool) {
+	changed := false
+	for i := range s.rules {
+		if s.rules[i].path != nil {
+			continue
+		}
+		var matched bool
+		if text, matched = s.rules[i].redact(text); matched {
+			s.matched[i], changed = true, true
+		}
+	}
+	return text, changed
+}
+
+// redactFields applies every rule to fields in place and reports whether
+// any of them matched.
+func (s *redactStage) redactFields(fields map[string]any) bool {
+	changed := false
+	for i := range s.rules {
+		rule := &s.rules[i]
+		if rule.path == nil {
+			s.matched[i] = redactValues(rule, fields)
+		} else if parent, key, ok := fieldParent(fields, rule.field, rule.path); ok {
+			if value, isString := parent[key].(string); isString && rule.re != nil {
+				parent[key], s.matched[i] = rule.redact(value)
+			} else if rule.re == nil {
+				parent[key], s.matched[i] = rule.replacement, true
+			}
+		}
+		changed = changed || s.matched[i]
+	}
+	return changed
+}
+
+// fieldParent returns the object holding field and its key there. Flattened
+// keys such as "request.id" are found as well as nested ones.
+func fieldParent(fields map[string]any, field string, path []string) (map[string]any, string, bool) {
+	if _, ok := fields[field]; ok {
+		return fields, field, true
+	}
+	if len(path) < 2 {
+		return nil, "", false
+	}
+	parent, ok := lookupField(fields, path[:len(path)-1])
+	if !ok {
+		return nil, "", false
+	}
+	object, ok := parent.(map[string]any)
+	if !ok {
+		return nil, "", false
+	}
+	key := path[len(path)-1]
+	if _, ok := object[key]; !ok {
+		return nil, "", false
+	}
+	return object, key, true
+}
+
+// redactValues applies the pattern of rule to every string and number in
+// value and to the keys of its objects. A redacted number becomes a string.
+func redactValues(rule *redactRule, value any) bool {
+	changed := false
+	switch v := value.(type) {
+	case map[string]any:
+		renamed := make(map[string]string)
+		for key, nested := range v {
+			if redacted, ok := redactScalar(rule, nested); ok {
+				v[key], changed = redacted, true
+			} else if redactValues(rule, nested) {
+				changed = true
+			}
+			if redacted, ok := rule.redact(key); ok {
+				renamed[key] = redacted
+			}
+		}
+		for key, redacted := range renamed {
+			v[redacted] = v[key]
+			delete(v, key)
+			changed = true
+		}
+	case []any:
+		for i, nested := range v {
+			if redacted, ok := redactScalar(rule, nested); ok {
+				v[i], changed = redacted, true
+			} else if redactValues(rule, nested) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// redactScalar applies the pattern of rule to a string or number and
+// returns the redacted string if it matched.
+func redactScalar(rule *redactRule, value any) (string, bool) {
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = v
+	case json.Number:
+		text = v.String()
+	case float64:
+		text = strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		text = strconv.Itoa(v)
+	case int64:
+		text = strconv.FormatInt(v, 10)
+	default:
+		return "", false
+	}
+	return rule.redact(text)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const metricCollapsedEvents = "cwsync_collapsed_events_total"
+
+func init() {
+	metrics.describe(metricCollapsedEvents, "counter", "Repeats of the previous message folded into it by collapse_repeats.")
+}
+
+// repeatsStage collapses runs of identical consecutive messages of a stream
+// into their first event, which tells how often it was seen. The last event
+// of every stream is held back until a different message arrives, or for at
+// most window, so a logging loop still shows up once per window.
+type repeatsStage struct {
+	window  time.Duration
+	service string
+	pending map[string]*repeatedEvent
+}
+
+type repeatedEvent struct {
+	event logEvent
+	count int
+	first time.Time
+}
+
+func newRepeatsStage(service ServiceConfig) *repeatsStage {
+	return &repeatsStage{
+		window:  time.Duration(service.CollapseRepeats),
+		service: service.Name,
+		pending: make(map[string]*repeatedEvent),
+	}
+}
+
+func (s *repeatsStage) apply(event logEvent, out []logEvent) []logEvent {
+	key := event.LogGroup + "\x00" + event.LogStream
+	r := s.pending[key]
+	if r != nil && r.event.Message == event.Message {
+		r.count++
+		// the repeat is dropped, only the held event is still buffered
+		buffered.release(event.buffered)
+		metrics.Add(metricCollapsedEvents, 1, "service", s.service)
+		return out
+	}
+	if r != nil {
+		out = append(out, r.collapsed())
+	}
+	s.pending[key] = &repeatedEvent{event: event, count: 1, first: time.Now()}
+	return out
+}
+
+// collapsed returns the event of a run, with a repeat_count field if it is
+// a JSON object or else " [seen N times]" appended if it was repeated.
+func (r *repeatedEvent) collapsed() logEvent {
+	event := r.event
+	if r.count == 1 {
+		return event
+	}
+	if fields, ok := parseJSONObject(event.Message); ok {
+		fields["repeat_count"] = r.count
+		event.Fields = fields
+		event.Message = encodeFields(fields)
+	} else {
+		event.Message += fmt.Sprintf(" [seen %d times]", r.count)
+	}
+	return event
+}
+
+func (s *repeatsStage) flush(now time.Time, force bool, out []logEvent) []logEvent {
+	for key, r := range s.pending {
+		if force || now.Sub(r.first) >= s.window {
+			out = append(out, r.collapsed())
+			delete(s.pending, key)
+		}
+	}
+	return out
+}
+
+func (s *repeatsStage) flushInterval() time.Duration {
+	return max(s.window/4, 100*time.Millisecond)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+const metricRoutedEvents = "cwsync_routed_events_total"
+
+func init() {
+	metrics.describe(metricRoutedEvents, "counter", "Events sent to the destination of a route.")
+}
+
+// RouteConfig sends the events of a service matching all of its conditions
+// to a destination of their own instead of the service's destination.
+// Routes are tried in order, the first match wins unless it continues.
+type RouteConfig struct {
+	// Name identifies the route in metrics and names its default file
+	Name string `yaml:"name"`
+	// MinLevel matches events of at least this level, see detectLevel
+	MinLevel string `yaml:"min_level"`
+	// Pattern is a regex on the message
+	Pattern string `yaml:"pattern"`
+	// Filter is an expression as the filter of a service, see filterEnv
+	Filter      string      `yaml:"filter"`
+	Destination Destination `yaml:"destination"`
+	// Continue also passes matching events on to the following routes and
+	// the service's destination
+	Continue bool `yaml:"continue"`
+}
+
+func validateRoute(prefix string, route RouteConfig, names map[string]bool) []configError {
+	var errs []configError
+	add := func(path, format string, args ...any) {
+		errs = append(errs, configError{path: path, msg: fmt.Sprintf(format, args...)})
+	}
+	switch {
+	case route.Name == "":
+		add(joinPath(prefix, "name"), "is required")
+	case !labelName.MatchString(route.Name):
+		add(joinPath(prefix, "name"), "must be letters, digits and underscores, got %q", route.Name)
+	case names[route.Name]:
+		add(joinPath(prefix, "name"), "duplicate route %q", route.Name)
+	}
+	names[route.Name] = true
+	if route.MinLevel == "" && route.Pattern == "" && route.Filter == "" {
+		add(prefix, "needs at least one of min_level, pattern and filter")
+	}
+	if route.MinLevel != "" {
+		if err := validateMinLevel(route.MinLevel); err != nil {
+			add(joinPath(prefix, "min_level"), "%v", err)
+		}
+	}
+	if _, err := regexp.Compile(route.Pattern); err != nil {
+		add(joinPath(prefix, "pattern"), "invalid pattern %q: %v", route.Pattern, err)
+	}
+	if route.Filter != "" {
+		if _, err := compileFilter(route.Filter); err != nil {
+			add(joinPath(prefix, "filter"), "%v", err)
+		}
+	}
+	return append(errs, validateDestination(joinPath(prefix, "destination"), route.Destination)...)
+}
+
+// eventRoute is a route of a running pipeline and the queue of its writer.
+type eventRoute struct {
+	config  RouteConfig
+	service ServiceConfig
+	// min is the index of min_level in levelNames, -1 without it
+	min     int
+	field   *regexp.Regexp
+	pattern *regexp.Regexp
+	program *vm.Program
+	events  chan logEvent
+}
+
+// newRoutes sets up the routes of a service. Each route writes like a
+// service of its own, with the route's destination; files are named
+// <service>-<route>.log by default.
+func newRoutes(service ServiceConfig, size int) []*eventRoute {
+	var routes []*eventRoute
+	// the routes were validated when loading the config
+	for _, config := range service.Routes {
+		r := &eventRoute{config: config, service: service, min: -1, field: levelFieldPattern(service.LevelField), events: make(chan logEvent, size)}
+		r.service.Destination = config.Destination
+		if r.service.Destination.FileName == "" {
+			r.service.Destination.FileName = service.Name + "-" + config.Name + ".log"
+		}
+		if config.MinLevel != "" {
+			r.min, _ = parseLevel(config.MinLevel)
+		}
+		if config.Pattern != "" {
+			r.pattern = regexp.MustCompile(config.Pattern)
+		}
+		if config.Filter != "" {
+			r.program, _ = compileFilter(config.Filter)
+		}
+		routes = append(routes, r)
+	}
+	return routes
+}
+
+// match reports whether event meets every condition of the route. Events
+// without a recognizable level never meet min_level, and an event the
+// filter fails on does not match it.
+func (r *eventRoute) match(event *logEvent) bool {
+	if r.min >= 0 {
+		level, ok := parseLevel(event.Level)
+		if !ok {
+			level, ok = detectLevel(event.Message, r.field)
+		}
+		if !ok || level < r.min {
+			return false
+		}
+	}
+	if r.pattern != nil && !r.pattern.MatchString(event.Message) {
+		return false
+	}
+	if r.program != nil {
+		// routes may be matched by several mergers at once, so every call
+		// gets a VM of its own
+		matched, err := expr.Run(r.program, &filterEnv{
+			Message:       event.Message,
+			Level:         event.Level,
+			LogGroup:      event.LogGroup,
+			LogStream:     event.LogStream,
+			Service:       r.service.Name,
+			Timestamp:     event.Timestamp,
+			IngestionTime: event.IngestionTime,
+			Fields:        filterFields(event.Fields),
+		})
+		if err != nil {
+			pipelineLog.with("service", r.service.Name).Debugf("Error evaluating the filter of route %s of %s: %v", r.config.Name, r.service.Name, err)
+			return false
+		}
+		return matched == true
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+)
+
+const metricSampledEvents = "cwsync_sampled_out_events_total"
+
+func init() {
+	metrics.describe(metricSampledEvents, "counter", "Events dropped by sample_rate and sample_rules.")
+}
+
+// SampleRule keeps the fraction Rate of the events whose message matches
+// Match.
+type SampleRule struct {
+	Match string  `yaml:"match"`
+	Rate  float64 `yaml:"rate"`
+}
+
+func validateSampleRules(rules []SampleRule) error {
+	for i, rule := range rules {
+		if rule.Match == "" {
+			return fmt.Errorf("rule %d has no match", i)
+		}
+		if _, err := regexp.Compile(rule.Match); err != nil {
+			return fmt.Errorf("invalid match %q of rule %d: %v", rule.Match, i, err)
+		}
+		if rule.Rate < 0 || rule.Rate > 1 {
+			return fmt.Errorf("rate of rule %d must be between 0 and 1, got %g", i, rule.Rate)
+		}
+	}
+	return nil
+}
+
+// sampleStage keeps each event with the rate of the first rule matching its
+// message, or the service's sample_rate if none does.
+type sampleStage struct {
+	rate     float64
+	patterns []*regexp.Regexp
+	rates    []float64
+	service  string
+}
+
+func newSampleStage(service ServiceConfig) *sampleStage {
+	s := &sampleStage{rate: service.SampleRate, service: service.Name}
+	if s.rate == 0 {
+		s.rate = 1
+	}
+	for _, rule := range service.SampleRules {
+		// the rules were validated when loading the config
+		s.patterns = append(s.patterns, regexp.MustCompile(rule.Match))
+		s.rates = append(s.rates, rule.Rate)
+	}
+	return s
+}
+
+func (s *sampleStage) apply(event logEvent, out []logEvent) []logEvent {
+	rate := s.rate
+	for i, re := range s.patterns {
+		if re.MatchString(event.Message) {
+			rate = s.rates[i]
+			break
+		}
+	}
+	if rate < 1 && rand.Float64() >= rate {
+		metrics.Add(metricSampledEvents, 1, "service", s.service)
+		return out
+	}
+	return append(out, event)
+}
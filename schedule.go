@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScheduleConfig restricts when a service syncs. With a window the service
+// tails as usual while inside it and is stopped outside; with cron every
+// trigger starts a catch-up pass that ends once all streams are caught up.
+type ScheduleConfig struct {
+	Window   string `yaml:"window"`
+	Cron     string `yaml:"cron"`
+	Timezone string `yaml:"timezone"`
+}
+
+func (c ScheduleConfig) enabled() bool {
+	return c.Window != "" || c.Cron != ""
+}
+
+// schedule is the parsed form of a ScheduleConfig.
+type schedule struct {
+	loc *time.Location
+	// window start and end as minutes after midnight; end may be before
+	// start for windows spanning midnight
+	start, end int
+	cron       *cronSpec
+}
+
+func parseSchedule(c ScheduleConfig) (*schedule, error) {
+	if !c.enabled() {
+		return nil, nil
+	}
+	if c.Window != "" && c.Cron != "" {
+		return nil, fmt.Errorf("window and cron cannot be combined")
+	}
+	s := &schedule{loc: time.Local}
+	if c.Timezone != "" {
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %v", c.Timezone, err)
+		}
+		s.loc = loc
+	}
+	if c.Cron != "" {
+		spec, err := parseCron(c.Cron)
+		if err != nil {
+			return nil, err
+		}
+		s.cron = spec
+		return s, nil
+	}
+	from, to, ok := strings.Cut(c.Window, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid window %q: expected HH:MM-HH:MM", c.Window)
+	}
+	var err error
+	if s.start, err = parseClock(from); err != nil {
+		return nil, fmt.Errorf("invalid window %q: %v", c.Window, err)
+	}
+	if s.end, err = parseClock(to); err != nil {
+		return nil, fmt.Errorf("invalid window %q: %v", c.Window, err)
+	}
+	if s.start == s.end {
+		return nil, fmt.Errorf("invalid window %q: start and end are the same", c.Window)
+	}
+	return s, nil
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a HH:MM time", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// next returns when the service runs next, at or after now. For a window that
+// is the start and end of the current or next window, for cron the next
+// trigger and a zero end, since a pass runs until it is caught up.
+func (s *schedule) next(now time.Time) (time.Time, time.Time) {
+	now = now.In(s.loc)
+	if s.cron != nil {
+		return s.cron.next(now), time.Time{}
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, s.loc)
+	// yesterday's window may still be open if it spans midnight
+	for day := -1; day <= 1; day++ {
+		start := midnight.AddDate(0, 0, day).Add(time.Duration(s.start) * time.Minute)
+		end := midnight.AddDate(0, 0, day).Add(time.Duration(s.end) * time.Minute)
+		if s.end < s.start {
+			end = end.AddDate(0, 0, 1)
+		}
+		if now.Before(end) {
+			return maxTime(start, now), end
+		}
+	}
+	// unreachable: tomorrow's window always ends after now
+	return now, now
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// cronSpec is a standard five field cron expression: minute, hour, day of
+// month, month and day of week. Like cron, a restricted day of month and day
+// of week match if either does.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	if alias, ok := cronAliases[strings.TrimSpace(expr)]; ok {
+		expr = alias
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron %q: expected 5 fields", expr)
+	}
+	var spec cronSpec
+	var err error
+	for i, field := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&spec.minute, 0, 59},
+		{&spec.hour, 0, 23},
+		{&spec.dom, 1, 31},
+		{&spec.month, 1, 12},
+		{&spec.dow, 0, 7},
+	} {
+		if *field.bits, err = parseCronField(fields[i], field.min, field.max); err != nil {
+			return nil, fmt.Errorf("invalid cron %q: %v", expr, err)
+		}
+	}
+	// 7 is another name for sunday
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	spec.domAny = fields[2] == "*"
+	spec.dowAny = fields[4] == "*"
+	return &spec, nil
+}
+
+// parseCronField parses lists of values, ranges and steps such as
+// "1,15,30", "9-17" or "*/10" into a bit set.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// next returns the first minute after now the expression matches. An
+// expression that never matches, e.g. on February 30th, gives up after five
+// years.
+func (c *cronSpec) next(now time.Time) time.Time {
+	t := now.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return limit
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// schemaKey is one entry of the config reference.
+type schemaKey struct {
+	Key     string `json:"key"`
+	Type    string `json:"type"`
+	Default string `json:"default,omitempty"`
+}
+
+// schemaDefaults are the values used for unset keys. They are spelled out
+// here because most defaults are applied where the setting is used rather
+// than stored in the structs.
+var schemaDefaults = map[string]string{
+	"aws_role_session_name":                           "cwsync",
+	"api_timeout":                                     durationDefault(defaultAPITimeout),
+	"discovery_interval":                              durationDefault(defaultDiscoveryInterval),
+	"usage_summary_interval":                          durationDefault(defaultUsageSummaryInterval),
+	"max_buffered_bytes":                              strconv.Itoa(defaultMaxBufferedBytes),
+	"max_concurrent_discovery":                        strconv.Itoa(defaultMaxConcurrentDiscovery),
+	"startup_jitter":                                  durationDefault(defaultStartupJitter),
+	"max_concurrent_tails":                            strconv.Itoa(defaultMaxConcurrentTails),
+	"watch_debounce":                                  durationDefault(defaultWatchDebounce),
+	"cluster.kv_prefix":                               defaultClusterKVPrefix,
+	"cluster.session_ttl":                             durationDefault(defaultClusterTTL),
+	"log_level":                                       "info",
+	"log_format":                                      "text",
+	"color":                                           colorAuto,
+	"statsd.format":                                   statsdFormatDogStatsD,
+	"statsd.interval":                                 durationDefault(defaultStatsDInterval),
+	"api_rate_limits.get_log_events":                  strconv.Itoa(defaultGetLogEventsTPS),
+	"api_rate_limits.describe_log_streams":            strconv.Itoa(defaultDescribeLogStreamsTPS),
+	"api_rate_limits.describe_log_groups":             strconv.Itoa(defaultDescribeLogGroupsTPS),
+	"api_rate_limits.list_tags":                       strconv.Itoa(defaultListTagsTPS),
+	"api_rate_limits.filter_log_events":               strconv.Itoa(defaultFilterLogEventsTPS),
+	"api_rate_limits.burst":                           "1",
+	"services[].source":                               sourcePoll,
+	"services[].checkpoint_by":                        checkpointByTimestamp,
+	"services[].emf.prefix":                           defaultEMFPrefix,
+	"services[].json.invalid":                         jsonInvalidKeep,
+	"services[].parse.unmatched":                      jsonInvalidKeep,
+	"services[].multiline.timeout":                    durationDefault(defaultMultilineTimeout),
+	"services[].multiline.max_lines":                  strconv.Itoa(defaultMultilineMaxLines),
+	"services[].multiline.max_bytes":                  strconv.Itoa(defaultMultilineMaxBytes),
+	"services[].wasm.timeout":                         durationDefault(defaultWasmTimeout),
+	"services[].json_schema.action":                   schemaActionTag,
+	"services[].json_schema.field":                    defaultSchemaField,
+	"services[].sample_rate":                          "1",
+	"services[].enrich.format":                        enrichFormatJSON,
+	"services[].priority":                             "normal",
+	"services[].ingestion_lookback":                   durationDefault(defaultIngestionLookback),
+	"services[].output_buffer":                        strconv.Itoa(defaultOutputBuffer),
+	"services[].merge_window":                         durationDefault(defaultMergeWindow),
+	"services[].error_backoff":                        durationDefault(baseErrorDelay),
+	"services[].kinesis.start_position":               "LATEST",
+	"services[].destination.type":                     "stdout",
+	"services[].destination.prefix":                   "[{{.Stream}}] ",
+	"services[].destination.batch_size":               strconv.Itoa(defaultBatchSize),
+	"services[].destination.batch_bytes":              strconv.Itoa(defaultBatchBytes),
+	"services[].destination.batch_interval":           durationDefault(defaultBatchInterval),
+	"services[].destination.oversized":                oversizedSplit,
+	"services[].log_configs[].poll_interval":          durationDefault(defaultPollInterval),
+	"services[].log_configs[].max_poll_interval":      durationDefault(defaultMaxPollInterval),
+	"services[].log_configs[].fetch_limit":            strconv.Itoa(defaultFetchLimit),
+	"services[].log_configs[].max_concurrent_fetches": strconv.Itoa(defaultMaxConcurrentFetches),
+	"services[].log_configs[].fetch_mode":             fetchModeStreams,
+}
+
+// durationDefault formats d the way it would be written in the config, "1h"
+// rather than "1h0m0s".
+func durationDefault(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// configSchema lists every config key of the Config struct, derived from its
+// yaml tags.
+func configSchema() []schemaKey {
+	var keys []schemaKey
+	var walk func(t reflect.Type, prefix string)
+	walk = func(t reflect.Type, prefix string) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if !field.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			key := prefix + name
+			keys = append(keys, schemaKey{Key: key, Type: schemaType(field.Type), Default: schemaDefaults[key]})
+			switch {
+			case field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(Duration(0)):
+				walk(field.Type, key+".")
+			case field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct:
+				walk(field.Type.Elem(), key+"[].")
+			}
+		}
+	}
+	walk(reflect.TypeOf(Config{}), "")
+	return keys
+}
+
+func schemaType(t reflect.Type) string {
+	if t == reflect.TypeOf(Duration(0)) {
+		return "duration"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int64:
+		return "int"
+	case reflect.Float64:
+		return "float"
+	case reflect.Struct:
+		return "object"
+	case reflect.Slice:
+		return "list of " + schemaType(t.Elem())
+	case reflect.Map:
+		return "map of " + schemaType(t.Key()) + " to " + schemaType(t.Elem())
+	case reflect.Interface:
+		return "any"
+	}
+	return t.Kind().String()
+}
+
+// runConfigSchema prints the config reference, as a table or as JSON.
+func runConfigSchema(args []string) {
+	fs := flag.NewFlagSet("config-schema", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the reference as JSON")
+	fs.Parse(args)
+
+	keys := configSchema()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(keys); err != nil {
+			mainLog.Fatalf("%v", err)
+		}
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tTYPE\tDEFAULT")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", key.Key, key.Type, key.Default)
+	}
+	w.Flush()
+}
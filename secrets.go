@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+const (
+	ssmScheme            = "ssm://"
+	secretsManagerScheme = "secretsmanager://"
+)
+
+// secretResolver replaces ssm:// and secretsmanager:// references in config
+// values with the referenced parameter or secret. The same reference is only
+// fetched once per resolve pass.
+type secretResolver struct {
+	ctx            context.Context
+	ssm            *ssm.SSM
+	secretsManager *secretsmanager.SecretsManager
+	cache          map[string]string
+}
+
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, ssmScheme) || strings.HasPrefix(value, secretsManagerScheme)
+}
+
+// resolveSecrets walks every string in the config and resolves secret
+// references in place. It runs after the AWS session exists, so the AWS
+// credential settings themselves cannot be references.
+func resolveSecrets(ctx context.Context, sess *session.Session, config *Config) error {
+	r := &secretResolver{
+		ctx:            ctx,
+		ssm:            ssm.New(sess),
+		secretsManager: secretsmanager.New(sess),
+		cache:          make(map[string]string),
+	}
+	return r.walk(reflect.ValueOf(config).Elem())
+}
+
+func (r *secretResolver) walk(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		if !isSecretRef(v.String()) {
+			return nil
+		}
+		resolved, err := r.resolve(v.String())
+		if err != nil {
+			return err
+		}
+		v.SetString(resolved)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				if err := r.walk(v.Field(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := r.walk(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return r.walk(v.Elem())
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		for _, key := range v.MapKeys() {
+			value := v.MapIndex(key).String()
+			if !isSecretRef(value) {
+				continue
+			}
+			resolved, err := r.resolve(value)
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(key, reflect.ValueOf(resolved))
+		}
+	}
+	return nil
+}
+
+// resolve fetches one reference. ssm://<parameter name> reads a (decrypted)
+// SSM parameter; secretsmanager://<secret id>[#<json key>] reads a secret and
+// optionally picks one key of a JSON secret.
+func (r *secretResolver) resolve(ref string) (string, error) {
+	if value, ok := r.cache[ref]; ok {
+		return value, nil
+	}
+
+	var value string
+	switch {
+	case strings.HasPrefix(ref, ssmScheme):
+		name := strings.TrimPrefix(ref, ssmScheme)
+		resp, err := r.ssm.GetParameterWithContext(r.ctx, &ssm.GetParameterInput{
+			Name:           aws.String(name),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve %s: %v", ref, err)
+		}
+		value = aws.StringValue(resp.Parameter.Value)
+	default:
+		id, key, _ := strings.Cut(strings.TrimPrefix(ref, secretsManagerScheme), "#")
+		resp, err := r.secretsManager.GetSecretValueWithContext(r.ctx, &secretsmanager.GetSecretValueInput{
+			SecretId: aws.String(id),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve %s: %v", ref, err)
+		}
+		value = aws.StringValue(resp.SecretString)
+		if key != "" {
+			var fields map[string]any
+			if err := json.Unmarshal([]byte(value), &fields); err != nil {
+				return "", fmt.Errorf("secret %s is not a JSON object: %v", id, err)
+			}
+			field, ok := fields[key]
+			if !ok {
+				return "", fmt.Errorf("secret %s has no key %q", id, key)
+			}
+			value = fmt.Sprint(field)
+		}
+	}
+
+	r.cache[ref] = value
+	return value, nil
+}
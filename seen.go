@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// seenEvents remembers events that were already written so that re-reading a
+// time window does not emit them twice. GetLogEvents does not return event
+// IDs, so events are identified by timestamp, ingestion time and a hash of
+// the message.
+type seenEvents struct {
+	byKey map[seenKey]struct{}
+}
+
+type seenKey struct {
+	timestamp     int64
+	ingestionTime int64
+	message       uint64
+	// id is set instead of the other fields for FilterLogEvents results,
+	// which carry an event ID
+	id string
+}
+
+func newSeenEvents() *seenEvents {
+	return &seenEvents{byKey: make(map[seenKey]struct{})}
+}
+
+func eventKey(event *cloudwatchlogs.OutputLogEvent) seenKey {
+	h := fnv.New64a()
+	h.Write([]byte(*event.Message))
+	return seenKey{
+		timestamp:     *event.Timestamp,
+		ingestionTime: *event.IngestionTime,
+		message:       h.Sum64(),
+	}
+}
+
+// add records the event and reports whether it was new.
+func (s *seenEvents) add(event *cloudwatchlogs.OutputLogEvent) bool {
+	key := eventKey(event)
+	if _, ok := s.byKey[key]; ok {
+		return false
+	}
+	s.byKey[key] = struct{}{}
+	return true
+}
+
+// addID records an event by its ID and reports whether it was new.
+func (s *seenEvents) addID(id string, timestamp int64) bool {
+	key := seenKey{timestamp: timestamp, id: id}
+	if _, ok := s.byKey[key]; ok {
+		return false
+	}
+	s.byKey[key] = struct{}{}
+	return true
+}
+
+// prune forgets events older than the given timestamp; they will not be read
+// again.
+func (s *seenEvents) prune(before int64) {
+	for key := range s.byKey {
+		if key.timestamp < before {
+			delete(s.byKey, key)
+		}
+	}
+}
+
+// resumeCutoff keeps the first late event rescan after a restart from
+// writing the window behind the stored offset again: seenEvents starts empty,
+// but an event older than the offset the tail resumed from that was ingested
+// before the tail started was written by the previous run. Events ingested
+// since are late ones and still written.
+type resumeCutoff struct {
+	checkpoint, started int64
+}
+
+// newResumeCutoff returns the cutoff of a tail resuming from checkpoint.
+// Ingestion time checkpoints already skip what was ingested before them.
+func newResumeCutoff(checkpoint int64, byIngestion bool) resumeCutoff {
+	if byIngestion {
+		return resumeCutoff{}
+	}
+	return resumeCutoff{checkpoint: checkpoint, started: time.Now().UnixMilli()}
+}
+
+// written reports whether the previous run already wrote the event.
+func (c resumeCutoff) written(timestamp, ingestionTime int64) bool {
+	return timestamp < c.checkpoint && ingestionTime < c.started
+}
+
+// maxBoundaryIDs bounds the IDs stored with an offset. Events of a busy
+// millisecond beyond it may be written again after a restart.
+const maxBoundaryIDs = 1000
+
+// resumeBoundary tracks the events written at the checkpoint, the newest
+// timestamp (or ingestion time) an offset is saved with. Tails resume at the
+// checkpoint itself, because more events of that millisecond may follow, and
+// skip the events the stored boundary lists instead of writing them again.
+type resumeBoundary struct {
+	at  int64
+	ids []string
+	// resumed holds the IDs stored with the offset the tail started from
+	resumedAt int64
+	resumed   map[string]struct{}
+}
+
+func newResumeBoundary(at int64, ids []string) *resumeBoundary {
+	b := &resumeBoundary{at: at, ids: ids, resumedAt: at}
+	if len(ids) > 0 {
+		b.resumed = make(map[string]struct{}, len(ids))
+		for _, id := range ids {
+			b.resumed[id] = struct{}{}
+		}
+	}
+	return b
+}
+
+// tracks reports whether an event at the given checkpoint time has to be
+// identified, because it may be at the boundary or written before the resume.
+func (b *resumeBoundary) tracks(at int64) bool {
+	return at >= b.at || (b.resumed != nil && at == b.resumedAt)
+}
+
+// written reports whether the event was written before the tail resumed.
+func (b *resumeBoundary) written(at int64, id string) bool {
+	if at != b.resumedAt || b.resumed == nil {
+		return false
+	}
+	_, ok := b.resumed[id]
+	return ok
+}
+
+// record notes that the event is being written.
+func (b *resumeBoundary) record(at int64, id string) {
+	if at > b.at {
+		b.at = at
+		b.ids = b.ids[:0]
+	}
+	if at == b.at && len(b.ids) < maxBoundaryIDs {
+		b.ids = append(b.ids, id)
+	}
+}
+
+// saved returns the IDs to store with an offset of checkpoint.
+func (b *resumeBoundary) saved(checkpoint int64) []string {
+	if b.at != checkpoint {
+		return nil
+	}
+	return b.ids
+}
+
+// streamEventID identifies a GetLogEvents result, which has no event ID, by
+// its timestamp, ingestion time and message.
+func streamEventID(event *cloudwatchlogs.OutputLogEvent) string {
+	h := fnv.New64a()
+	var times [16]byte
+	binary.LittleEndian.PutUint64(times[:8], uint64(*event.Timestamp))
+	binary.LittleEndian.PutUint64(times[8:], uint64(*event.IngestionTime))
+	h.Write(times[:])
+	h.Write([]byte(*event.Message))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchSize     = 500
+	defaultBatchBytes    = 1 << 20
+	defaultBatchInterval = time.Second
+
+	sinkRetryDelay = 5 * time.Second
+)
+
+// sink is a destination events are delivered to, one batch at a time. A
+// failed batch is retried as a whole, so write must not keep the slice.
+type sink interface {
+	write(events []logEvent) error
+	close() error
+}
+
+func newSink(service ServiceConfig) sink {
+	format := newLineFormat(service)
+	switch service.Destination.Type {
+	case "file":
+		name := service.Destination.FileName
+		if name == "" {
+			name = service.Name + ".log"
+		}
+		return &fileSink{path: filepath.Join(service.Destination.FilePath, name), format: format}
+	default:
+		format.color = colorOutput
+		return stdoutSink{format: format}
+	}
+}
+
+// batchSettings returns when a batch is delivered: once it holds size events
+// or bytes of messages, or interval after its first event arrived.
+func (d Destination) batchSettings() (int, int, time.Duration) {
+	size := d.BatchSize
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	maxBytes := d.BatchBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultBatchBytes
+	}
+	interval := time.Duration(d.BatchInterval)
+	if interval <= 0 {
+		interval = defaultBatchInterval
+	}
+	return size, maxBytes, interval
+}
+
+// batchBuffers are reused across batches so formatting does not allocate
+// once a pipeline is warmed up.
+var batchBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// lineFormat is how a destination renders events: the destination template,
+// the timestamp settings, or neither for the default OutputLogger lines.
+type lineFormat struct {
+	tmpl      *eventTemplate
+	timestamp *timestampFormat
+	prefix    *linePrefix
+	// color dims the header and colors the message by level, for terminals
+	color bool
+}
+
+func newLineFormat(service ServiceConfig) lineFormat {
+	// the timestamp settings were validated when loading the config
+	timestamp, _ := newTimestampFormat(service.Destination.Timestamp)
+	return lineFormat{tmpl: newEventTemplate(service, timestamp), timestamp: timestamp, prefix: newLinePrefix(service)}
+}
+
+// formatBatch renders events into a pooled buffer the way OutputLogger
+// prints a single event, or with the destination template or timestamp
+// settings if there are any, so a batch reaches the destination with one
+// write. The default header is formatted once per batch instead of once per
+// event. The buffer goes back with putBatchBuffer.
+func formatBatch(events []logEvent, format lineFormat) *bytes.Buffer {
+	buf := batchBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	now := time.Now()
+	if format.tmpl != nil {
+		for i := range events {
+			format.tmpl.format(buf, &events[i], now)
+		}
+		return buf
+	}
+	var header [64]byte
+	prefix := appendLogHeader(header[:0], OutputLogger, now)
+	for i := range events {
+		message := events[i].Message
+		if ts := format.timestamp; ts != nil {
+			prefix = append(ts.appendTime(header[:0], &events[i], now), ' ')
+			message = ts.message(message)
+		}
+		if format.color {
+			buf.WriteString(ansiDim)
+		}
+		buf.Write(prefix)
+		if format.prefix != nil {
+			buf.WriteString(format.prefix.render(&events[i]))
+		} else {
+			buf.WriteByte('[')
+			buf.WriteString(events[i].LogStream)
+			buf.WriteString("] ")
+		}
+		if format.color {
+			buf.WriteString(ansiReset)
+			if color := messageColor(&events[i]); color != "" {
+				buf.WriteString(color)
+				buf.WriteString(message)
+				buf.WriteString(ansiReset)
+			} else {
+				buf.WriteString(message)
+			}
+		} else {
+			buf.WriteString(message)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf
+}
+
+func putBatchBuffer(buf *bytes.Buffer) {
+	// huge batches would pin their memory in the pool
+	if buf.Cap() <= 4*defaultBatchBytes {
+		batchBuffers.Put(buf)
+	}
+}
+
+// appendLogHeader appends the prefix and timestamp the log package writes in
+// front of every line of logger.
+func appendLogHeader(dst []byte, logger *log.Logger, now time.Time) []byte {
+	flags := logger.Flags()
+	if flags&log.Lmsgprefix == 0 {
+		dst = append(dst, logger.Prefix()...)
+	}
+	if flags&log.LUTC != 0 {
+		now = now.UTC()
+	}
+	if flags&log.Ldate != 0 {
+		dst = now.AppendFormat(dst, "2006/01/02 ")
+	}
+	if flags&(log.Ltime|log.Lmicroseconds) != 0 {
+		if flags&log.Lmicroseconds != 0 {
+			dst = now.AppendFormat(dst, "15:04:05.000000 ")
+		} else {
+			dst = now.AppendFormat(dst, "15:04:05 ")
+		}
+	}
+	if flags&log.Lmsgprefix != 0 {
+		dst = append(dst, logger.Prefix()...)
+	}
+	return dst
+}
+
+type stdoutSink struct {
+	format lineFormat
+}
+
+func (s stdoutSink) write(events []logEvent) error {
+	buf := formatBatch(events, s.format)
+	defer putBatchBuffer(buf)
+	_, err := OutputLogger.Writer().Write(buf.Bytes())
+	return err
+}
+
+func (stdoutSink) close() error { return nil }
+
+// fileSink appends to a file, which is opened on the first batch and again
+// after a failed write.
+type fileSink struct {
+	path   string
+	format lineFormat
+	file   *os.File
+}
+
+func (s *fileSink) write(events []logEvent) error {
+	if s.file == nil {
+		file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		s.file = file
+	}
+	buf := formatBatch(events, s.format)
+	defer putBatchBuffer(buf)
+	if _, err := s.file.Write(buf.Bytes()); err != nil {
+		s.file.Close()
+		s.file = nil
+		return err
+	}
+	return nil
+}
+
+func (s *fileSink) close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// isSOPSEncrypted reports whether a YAML or JSON document was encrypted with
+// SOPS, which adds a top-level "sops" key holding the metadata and MAC.
+func isSOPSEncrypted(data []byte, format string) bool {
+	if format == configFormatTOML {
+		return false
+	}
+	var doc struct {
+		SOPS map[string]any `yaml:"sops"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false
+	}
+	_, ok := doc.SOPS["mac"]
+	return ok
+}
+
+// decryptSOPS returns the decrypted document if data is SOPS encrypted and
+// data unchanged otherwise. Decryption is left to the sops binary so every
+// key type it supports (age, PGP, AWS KMS, ...) works with the usual sops
+// environment, e.g. SOPS_AGE_KEY_FILE or the process's AWS credentials.
+func decryptSOPS(path string, data []byte, format string) ([]byte, error) {
+	if !isSOPSEncrypted(data, format) {
+		return data, nil
+	}
+	binary := os.Getenv("SOPS_BINARY")
+	if binary == "" {
+		binary = "sops"
+	}
+	if format == "yml" {
+		format = configFormatYAML
+	}
+	cmd := exec.Command(binary, "--decrypt", "--input-type", format, "--output-type", format, path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, fmt.Errorf("%s is SOPS encrypted but %s was not found in PATH", path, binary)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s with sops: %v: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
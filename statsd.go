@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statsdFormatStatsD    = "statsd"
+	statsdFormatDogStatsD = "dogstatsd"
+
+	defaultStatsDInterval = 10 * time.Second
+	// maxStatsDPacket keeps datagrams below the MTU of common networks
+	maxStatsDPacket = 1432
+)
+
+// StatsDConfig pushes the metrics of the registry to a StatsD or DogStatsD
+// agent, for environments without a Prometheus scraper.
+type StatsDConfig struct {
+	// Address is the host:port of the agent, metrics are sent over UDP
+	Address string `yaml:"address"`
+	// Format is statsd, with labels appended to the name, or dogstatsd,
+	// with labels as tags
+	Format   string   `yaml:"format"`
+	Prefix   string   `yaml:"prefix"`
+	Interval Duration `yaml:"interval"`
+	// Tags are added to every metric, dogstatsd only
+	Tags []string `yaml:"tags"`
+}
+
+func (c StatsDConfig) validate() error {
+	switch c.Format {
+	case "", statsdFormatStatsD, statsdFormatDogStatsD:
+	default:
+		return fmt.Errorf("format must be %q or %q, got %q", statsdFormatStatsD, statsdFormatDogStatsD, c.Format)
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("invalid address %q: %v", c.Address, err)
+	}
+	if len(c.Tags) > 0 && c.Format == statsdFormatStatsD {
+		return fmt.Errorf("tags require format %q", statsdFormatDogStatsD)
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("interval cannot be negative")
+	}
+	return nil
+}
+
+// statsdEmitter sends counters as the increase since the previous push and
+// gauges as their current value.
+type statsdEmitter struct {
+	conn     net.Conn
+	config   StatsDConfig
+	interval time.Duration
+	// sent is the value of every counter at the previous push
+	sent map[string]float64
+	buf  []byte
+}
+
+// flushStatsD stops the statsd emitter after a final push, if one runs. It
+// is called before os.Exit, which skips deferred calls.
+var flushStatsD = func() {}
+
+// startStatsD starts pushing metrics and returns the function that stops it
+// after a final push, which is also set as flushStatsD.
+func startStatsD(config StatsDConfig) func() {
+	e, err := newStatsDEmitter(config)
+	if err != nil {
+		serverLog.Fatalf("failed to set up statsd: %v", err)
+	}
+	serverLog.Infof("Sending metrics to statsd at %s every %s", config.Address, e.interval)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.run(ctx)
+	}()
+	var once sync.Once
+	flushStatsD = func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+	return flushStatsD
+}
+
+func newStatsDEmitter(config StatsDConfig) (*statsdEmitter, error) {
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(config.Interval)
+	if interval <= 0 {
+		interval = defaultStatsDInterval
+	}
+	if config.Format == "" {
+		config.Format = statsdFormatDogStatsD
+	}
+	return &statsdEmitter{conn: conn, config: config, interval: interval, sent: make(map[string]float64)}, nil
+}
+
+// run pushes the metrics every interval until ctx is cancelled, and once
+// more before it returns so the last increments are not lost.
+func (e *statsdEmitter) run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.push()
+		case <-ctx.Done():
+			e.push()
+			e.conn.Close()
+			return
+		}
+	}
+}
+
+func (e *statsdEmitter) push() {
+	e.buf = e.buf[:0]
+	for _, s := range metrics.Snapshot() {
+		value, kind := s.value, "g"
+		if metrics.kind(s.name) == "counter" {
+			key := seriesKey(s.name, s.labels)
+			value -= e.sent[key]
+			e.sent[key] = s.value
+			if value == 0 {
+				continue
+			}
+			kind = "c"
+		}
+		line := e.format(s, value, kind)
+		if len(e.buf) > 0 && len(e.buf)+1+len(line) > maxStatsDPacket {
+			e.send()
+		}
+		if len(e.buf) > 0 {
+			e.buf = append(e.buf, '\n')
+		}
+		e.buf = append(e.buf, line...)
+	}
+	if len(e.buf) > 0 {
+		e.send()
+	}
+}
+
+func (e *statsdEmitter) send() {
+	if _, err := e.conn.Write(e.buf); err != nil {
+		serverLog.Errorf("Error sending metrics to statsd at %s: %v", e.config.Address, err)
+	}
+	e.buf = e.buf[:0]
+}
+
+// format renders one metric line, e.g. cwsync_api_calls_total:3|c|#service:api
+// or, without tags, cwsync_api_calls_total.api:3|c.
+func (e *statsdEmitter) format(s metricSeries, value float64, kind string) string {
+	var b strings.Builder
+	b.WriteString(e.config.Prefix)
+	b.WriteString(s.name)
+	if e.config.Format == statsdFormatStatsD {
+		for i := 1; i < len(s.labels); i += 2 {
+			b.WriteByte('.')
+			b.WriteString(statsdName(s.labels[i]))
+		}
+	}
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	b.WriteByte('|')
+	b.WriteString(kind)
+	if e.config.Format == statsdFormatDogStatsD {
+		tags := slices.Clone(e.config.Tags)
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			tags = append(tags, s.labels[i]+":"+statsdTag(s.labels[i+1]))
+		}
+		if len(tags) > 0 {
+			b.WriteString("|#")
+			b.WriteString(strings.Join(tags, ","))
+		}
+	}
+	return b.String()
+}
+
+// statsdName makes a label value usable as a segment of a metric name.
+func statsdName(value string) string {
+	if value == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, value)
+}
+
+// statsdTag replaces the characters that separate tags and lines.
+func statsdTag(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '|', '#', '\n':
+			return '_'
+		}
+		return r
+	}, value)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const metricStreamLag = "cwsync_stream_lag_seconds"
+
+func init() {
+	metrics.describe(metricStreamLag, "gauge", "How far behind real time a tailed stream is: now minus the timestamp of the last event processed, 0 once caught up.")
+}
+
+// The states of a tailed stream: active while its fetches return events,
+// idle once it is caught up, and quarantined while it backs off after a
+// failed fetch.
+const (
+	streamActive      = "active"
+	streamIdle        = "idle"
+	streamQuarantined = "quarantined"
+)
+
+// streamStatus is what the admin API reports about a tail, as of its last
+// fetch.
+type streamStatus struct {
+	Service   string `json:"service"`
+	LogGroup  string `json:"log_group"`
+	LogStream string `json:"log_stream,omitempty"`
+	// Offset is the checkpoint in milliseconds, an event or ingestion
+	// time depending on checkpoint_by
+	Offset int64 `json:"offset,omitempty"`
+	// Sequence is the checkpoint of a kinesis shard instead
+	Sequence      string     `json:"sequence,omitempty"`
+	LagSeconds    float64    `json:"lag_seconds"`
+	State         string     `json:"state"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+	Updated       time.Time  `json:"updated"`
+}
+
+var (
+	streamsMu sync.Mutex
+	// streams is keyed by tailerKey, group tails have an empty stream
+	streams = make(map[string]*streamStatus)
+)
+
+// trackStream returns the status of the tail with key, creating it on its
+// first fetch. It is called with streamsMu held.
+func trackStream(key string, service ServiceConfig, group, stream string) *streamStatus {
+	s, ok := streams[key]
+	if !ok {
+		s = &streamStatus{Service: service.Name, LogGroup: group, LogStream: stream}
+		streams[key] = s
+	}
+	s.Updated = time.Now()
+	return s
+}
+
+// recordFetch updates the tail with key after a successful fetch. newest is
+// the timestamp of the newest event it processed; a tail that found no more
+// events is caught up, however old its last event is.
+func recordFetch(key string, service ServiceConfig, group, stream string, offset, newest int64, caughtUp bool) {
+	var lag time.Duration
+	state := streamIdle
+	if !caughtUp {
+		lag = max(time.Since(time.UnixMilli(newest)), 0)
+		state = streamActive
+	}
+	setLag(key, service, group, stream, offset, lag, state)
+}
+
+// recordShardFetch updates the kinesis shard with key after a GetRecords
+// call, whose MillisBehindLatest is the lag of the shard. Shards are listed
+// with the kinesis stream as group. sequence is the checkpoint, empty if the
+// call returned no records.
+func recordShardFetch(key string, service ServiceConfig, shard, sequence string, behind int64, records int) {
+	state := streamIdle
+	if behind > 0 || records > 0 {
+		state = streamActive
+	}
+	setLag(key, service, service.Kinesis.StreamName, shard, 0, time.Duration(behind)*time.Millisecond, state)
+	if sequence != "" {
+		streamsMu.Lock()
+		streams[key].Sequence = sequence
+		streamsMu.Unlock()
+	}
+}
+
+func setLag(key string, service ServiceConfig, group, stream string, offset int64, lag time.Duration, state string) {
+	streamsMu.Lock()
+	s := trackStream(key, service, group, stream)
+	s.Offset, s.LagSeconds, s.State = offset, lag.Seconds(), state
+	streamsMu.Unlock()
+	metrics.Set(metricStreamLag, lag.Seconds(), "service", service.Name, "log_group", group, "log_stream", stream)
+}
+
+// recordFetchError quarantines the tail with key until its next successful
+// fetch. The error is kept after that, for debugging.
+func recordFetchError(key string, service ServiceConfig, group, stream string, offset int64, err error) {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	s := trackStream(key, service, group, stream)
+	s.Offset = offset
+	s.quarantine(err)
+}
+
+// recordShardError quarantines the kinesis shard with key like
+// recordFetchError.
+func recordShardError(key string, service ServiceConfig, shard string, err error) {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	trackStream(key, service, service.Kinesis.StreamName, shard).quarantine(err)
+}
+
+func (s *streamStatus) quarantine(err error) {
+	at := s.Updated
+	s.State, s.LastError, s.LastErrorTime = streamQuarantined, err.Error(), &at
+}
+
+// forgetStream drops the status of a tail that ended.
+func forgetStream(key string) {
+	streamsMu.Lock()
+	s, ok := streams[key]
+	delete(streams, key)
+	streamsMu.Unlock()
+	if ok {
+		metrics.Delete(metricStreamLag, "service", s.Service, "log_group", s.LogGroup, "log_stream", s.LogStream)
+	}
+}
+
+// serviceLag returns the largest lag of the streams of service, and false if
+// none of them fetched yet.
+func serviceLag(service string) (time.Duration, bool) {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	var lag float64
+	found := false
+	for _, s := range streams {
+		if s.Service == service {
+			lag, found = max(lag, s.LagSeconds), true
+		}
+	}
+	return time.Duration(lag * float64(time.Second)), found
+}
+
+// streamStatuses returns a copy of the status of every tail, of one service
+// if service is set, sorted by service, group and stream.
+func streamStatuses(service string) []streamStatus {
+	streamsMu.Lock()
+	out := make([]streamStatus, 0, len(streams))
+	for _, s := range streams {
+		if service == "" || s.Service == service {
+			out = append(out, *s)
+		}
+	}
+	streamsMu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.LogGroup != b.LogGroup {
+			return a.LogGroup < b.LogGroup
+		}
+		return a.LogStream < b.LogStream
+	})
+	return out
+}
+
+// runStatus implements "cwsync status", which prints the streams of a
+// running instance as reported by its admin API.
+func runStatus(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	adminURL := fs.String("admin-url", "http://127.0.0.1:9091", "admin API of the running instance")
+	adminToken := fs.String("admin-token", os.Getenv("CWSYNC_ADMIN_TOKEN"), "admin API token (env CWSYNC_ADMIN_TOKEN)")
+	service := fs.String("service", "", "only list the streams of this service")
+	state := fs.String("state", "", "only list streams in this state (active, idle, quarantined)")
+	asJSON := fs.Bool("json", false, "print the streams as JSON")
+	fs.Parse(args)
+	switch *state {
+	case "", streamActive, streamIdle, streamQuarantined:
+	default:
+		fmt.Fprintf(os.Stderr, "invalid state %q, expected %s, %s or %s\n", *state, streamActive, streamIdle, streamQuarantined)
+		os.Exit(2)
+	}
+
+	path := "/admin/streams"
+	if *service != "" {
+		path += "?service=" + url.QueryEscape(*service)
+	}
+	body, err := fetchAdmin(*adminURL, *adminToken, path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to fetch the stream status: %v\n", err)
+		os.Exit(2)
+	}
+	var statuses []streamStatus
+	if err := json.Unmarshal(body, &statuses); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid response from the admin API: %v\n", err)
+		os.Exit(2)
+	}
+	if *state != "" {
+		statuses = slices.DeleteFunc(statuses, func(s streamStatus) bool { return s.State != *state })
+	}
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(statuses)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tLOG GROUP\tLOG STREAM\tSTATE\tOFFSET\tLAG\tLAST ERROR")
+	for _, s := range statuses {
+		stream := s.LogStream
+		if stream == "" {
+			stream = "*"
+		}
+		lastError := "-"
+		if s.LastErrorTime != nil {
+			lastError = s.LastErrorTime.Local().Format(time.DateTime) + " " + strings.ReplaceAll(s.LastError, "\n", " ")
+		}
+		offset := s.Sequence
+		if offset == "" {
+			offset = "-"
+			if s.Offset != 0 {
+				offset = time.UnixMilli(s.Offset).Local().Format(time.DateTime)
+			}
+		}
+		lag := time.Duration(s.LagSeconds * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Service, s.LogGroup, stream, s.State, offset, lag, lastError)
+	}
+	w.Flush()
+}
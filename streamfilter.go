@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// patternFilter applies a pair of include and exclude settings, such as
+// log_stream_include and log_stream_exclude to stream names. A value passes if
+// it matches any include pattern (or there are none) and no exclude pattern.
+type patternFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func newStreamFilter(logConfig LogConfig) (*patternFilter, error) {
+	return newPatternFilter("log_stream", logConfig.LogStreamInclude, logConfig.LogStreamExclude)
+}
+
+// newPatternFilter compiles the patterns of the <key>_include and
+// <key>_exclude settings.
+func newPatternFilter(key string, include, exclude []string) (*patternFilter, error) {
+	f := &patternFilter{}
+	var err error
+	if f.include, err = compilePatterns(key+"_include", include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compilePatterns(key+"_exclude", exclude); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func compilePatterns(key string, patterns []string) ([]*regexp.Regexp, error) {
+	var out []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %v", key, pattern, err)
+		}
+		out = append(out, re)
+	}
+	return out, nil
+}
+
+func (f *patternFilter) match(name string) bool {
+	for _, re := range f.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
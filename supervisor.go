@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/hashicorp/consul/api"
+)
+
+// supervisor owns the running services. update reconciles them against a
+// new list of service configs, which is how SIGHUP reloads are implemented:
+// new services are started, removed ones stopped and changed ones restarted.
+// Offsets live in Consul, so a restarted service resumes where it stopped.
+type supervisor struct {
+	ctx          context.Context
+	config       Config
+	sess         *session.Session
+	consulClient *api.Client
+	limiter      *apiLimiter
+	pool         *tailPool
+	cluster      *cluster
+
+	mu       sync.Mutex
+	services map[string]*serviceRunner
+	// sessions caches the AWS sessions of services with their own AWS
+	// settings, keyed by those settings
+	sessions map[string]*session.Session
+	applied  bool
+	// effective is the rendered config last applied from the file, served
+	// to "cwsync config diff"
+	effective []byte
+	// sources holds the service list of every config source (the config
+	// file and Consul KV); the running set is their union.
+	sources map[string][]ServiceConfig
+}
+
+type serviceRunner struct {
+	config   ServiceConfig
+	cancel   context.CancelFunc
+	manager  *tailerManager
+	consumer *kinesisConsumer
+	// done is closed once the schedule loop of a scheduled service returned
+	done chan struct{}
+}
+
+func newSupervisor(ctx context.Context, config Config, sess *session.Session, consulClient *api.Client, limiter *apiLimiter, cluster *cluster) *supervisor {
+	return &supervisor{
+		ctx:          ctx,
+		cluster:      cluster,
+		config:       config,
+		sess:         sess,
+		consulClient: consulClient,
+		limiter:      limiter,
+		pool:         newTailPool(config.MaxConcurrentTails),
+		services:     make(map[string]*serviceRunner),
+		sessions:     make(map[string]*session.Session),
+		sources:      make(map[string][]ServiceConfig),
+	}
+}
+
+func (s *supervisor) discoveryInterval() time.Duration {
+	if s.config.DiscoveryInterval <= 0 {
+		return defaultDiscoveryInterval
+	}
+	return time.Duration(s.config.DiscoveryInterval)
+}
+
+// startupJitter returns the window new tailers are spread over. A negative
+// startup_jitter starts them right away.
+func (s *supervisor) startupJitter() time.Duration {
+	if s.config.StartupJitter == 0 {
+		return defaultStartupJitter
+	}
+	return max(time.Duration(s.config.StartupJitter), 0)
+}
+
+// update replaces the services of one source and reconciles the union of all
+// sources. Services from the config file win over Consul services with the
+// same name.
+func (s *supervisor) update(source string, services []ServiceConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources[source] = services
+
+	var all []ServiceConfig
+	seen := make(map[string]bool)
+	for _, name := range []string{serviceSourceFile, serviceSourceConsul} {
+		for _, service := range s.sources[name] {
+			if seen[service.Name] {
+				supervisorLog.Warnf("Ignoring duplicate service %s from %s", service.Name, name)
+				continue
+			}
+			seen[service.Name] = true
+			if service.Paused {
+				if _, running := s.services[service.Name]; running {
+					supervisorLog.Infof("Service %s is paused, stopping it", service.Name)
+				}
+				continue
+			}
+			all = append(all, service)
+		}
+	}
+	return s.reconcile(all)
+}
+
+// listedService is a service of any source as reported by the admin API.
+type listedService struct {
+	ServiceConfig
+	source string
+}
+
+// list returns the services of all sources, including paused ones.
+func (s *supervisor) list() []listedService {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []listedService
+	seen := make(map[string]bool)
+	for _, source := range []string{serviceSourceFile, serviceSourceConsul} {
+		for _, service := range s.sources[source] {
+			if !seen[service.Name] {
+				seen[service.Name] = true
+				out = append(out, listedService{service, source})
+			}
+		}
+	}
+	return out
+}
+
+// lookup returns the effective definition of a service and its source.
+func (s *supervisor) lookup(name string) (ServiceConfig, string, bool) {
+	for _, service := range s.list() {
+		if service.Name == name {
+			return service.ServiceConfig, service.source, true
+		}
+	}
+	return ServiceConfig{}, "", false
+}
+
+// setEffective records the rendered config of the last successful load.
+func (s *supervisor) setEffective(rendered []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.effective = rendered
+}
+
+func (s *supervisor) effectiveConfig() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.effective
+}
+
+// setSource records the services of a source without reconciling, used to
+// seed sources before the first update.
+func (s *supervisor) setSource(source string, services []ServiceConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources[source] = services
+}
+
+// reconcile starts, stops and restarts services so that exactly the given
+// ones are running. Errors from the initial stream listing are returned; the
+// service keeps running and discovery retries on its next tick. s.mu must be
+// held.
+func (s *supervisor) reconcile(services []ServiceConfig) error {
+	wanted := make(map[string]bool)
+	var errs []error
+	for _, service := range services {
+		wanted[service.Name] = true
+		runner, ok := s.services[service.Name]
+		if ok && reflect.DeepEqual(runner.config, service) {
+			continue
+		}
+		if ok {
+			supervisorLog.Infof("Configuration of service %s changed, restarting it", service.Name)
+			s.stopRunner(runner)
+		} else if s.applied {
+			supervisorLog.Infof("Starting new service %s", service.Name)
+		}
+		runner, err := s.startRunner(service)
+		s.services[service.Name] = runner
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for name, runner := range s.services {
+		if !wanted[name] {
+			supervisorLog.Infof("Service %s was removed, stopping it", name)
+			s.stopRunner(runner)
+			delete(s.services, name)
+		}
+	}
+	s.applied = true
+	return errors.Join(errs...)
+}
+
+// sessionFor returns the AWS session and config a service talks to AWS with.
+// s.mu must be held.
+func (s *supervisor) sessionFor(service ServiceConfig) (*session.Session, Config) {
+	if !hasOwnAWSConfig(service) {
+		return s.sess, s.config
+	}
+	config := serviceAWSConfig(s.config, service)
+	key := fmt.Sprintf("%s|%s|%s|%s|%s|%s", config.AWSRegion, config.AWSProfile, config.AWSRoleARN, config.AWSRoleSessionName, config.AWSAccessKey, config.AWSSecretKey)
+	sess, ok := s.sessions[key]
+	if !ok {
+		sess = createAWSSession(config)
+		s.sessions[key] = sess
+	}
+	return sess, config
+}
+
+func (s *supervisor) startRunner(service ServiceConfig) (*serviceRunner, error) {
+	ctx, cancel := context.WithCancel(withPriority(s.ctx, service.priority()))
+	runner := &serviceRunner{config: service, cancel: cancel}
+	sess, awsConfig := s.sessionFor(service)
+	if service.Schedule.enabled() && !s.config.RunOnce {
+		runner.done = make(chan struct{})
+		go s.runSchedule(ctx, runner, sess, awsConfig)
+		return runner, nil
+	}
+	return runner, s.activate(ctx, runner, sess, awsConfig, s.config.RunOnce)
+}
+
+// activate starts fetching for the runner's service until ctx is cancelled
+// or, with runOnce, until every stream is caught up.
+func (s *supervisor) activate(ctx context.Context, runner *serviceRunner, sess *session.Session, awsConfig Config, runOnce bool) error {
+	service := runner.config
+	if service.Enrich.needsIdentity() {
+		resolveIdentity(service, sess)
+	}
+	if service.Enrich.needsCatalog() {
+		watchConsulCatalog(ctx, s.consulClient, service)
+	}
+	if service.Source == sourceKinesis {
+		runner.consumer = newKinesisConsumer(ctx, sess, s.cluster, service, s.consulClient, newOffsetPaths(s.config, sess), runOnce)
+		err := runner.consumer.syncShards()
+		if !runOnce {
+			go runner.consumer.discoverPeriodically(s.discoveryInterval())
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list shards for %s: %v", service.Name, err)
+		}
+		return nil
+	}
+
+	cwLogs := newCloudWatchLogsClient(sess, awsConfig, s.limiter)
+	instrumentClient(cwLogs, service.Name)
+	fallback := s.config.OffsetFallbackDuration
+	if service.OffsetFallbackDuration > 0 {
+		fallback = service.OffsetFallbackDuration
+	}
+	runner.manager = newTailerManager(ctx, s.pool, s.cluster, s.consulClient, newOffsetPaths(s.config, sess), time.Duration(fallback), time.Duration(s.config.StreamIdleTimeout), s.startupJitter(), runOnce)
+
+	var firstErr error
+	for _, logConfig := range service.LogConfigs {
+		if err := runner.manager.syncLogConfig(cwLogs, service, logConfig); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to list log streams for %s: %v", service.Name, err)
+		}
+		if !runOnce {
+			go runner.manager.discoverPeriodically(cwLogs, service, logConfig, s.discoveryInterval())
+		}
+	}
+	return firstErr
+}
+
+// runSchedule activates a scheduled service for each of its windows, or for
+// one catch-up pass per cron trigger, until ctx is cancelled.
+func (s *supervisor) runSchedule(ctx context.Context, runner *serviceRunner, sess *session.Session, awsConfig Config) {
+	defer close(runner.done)
+	service := runner.config
+	// the schedule was validated when loading the config
+	sched, _ := parseSchedule(service.Schedule)
+	for {
+		start, end := sched.next(time.Now())
+		if wait := time.Until(start); wait > 0 {
+			supervisorLog.Infof("Service %s is scheduled to run at %s", service.Name, start.Format(time.RFC3339))
+			if !sleepContext(ctx, wait) {
+				return
+			}
+		}
+		var activeCtx context.Context
+		var cancel context.CancelFunc
+		if end.IsZero() {
+			activeCtx, cancel = context.WithCancel(ctx)
+			supervisorLog.Infof("Service %s is starting its scheduled sync", service.Name)
+		} else {
+			activeCtx, cancel = context.WithDeadline(ctx, end)
+			supervisorLog.Infof("Service %s is in its sync window until %s", service.Name, end.Format(time.RFC3339))
+		}
+		active := &serviceRunner{config: service, cancel: cancel}
+		if err := s.activate(activeCtx, active, sess, awsConfig, end.IsZero()); err != nil {
+			supervisorLog.Errorf("Error starting scheduled sync of %s: %v", service.Name, err)
+		}
+		if !end.IsZero() {
+			<-activeCtx.Done()
+		}
+		active.wait()
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		supervisorLog.Infof("Service %s finished its scheduled sync", service.Name)
+	}
+}
+
+func (s *supervisor) stopRunner(runner *serviceRunner) {
+	runner.cancel()
+	runner.wait()
+	dropPipeline(runner.config.Name)
+}
+
+func (r *serviceRunner) wait() {
+	if r.done != nil {
+		<-r.done
+	}
+	if r.manager != nil {
+		r.manager.wg.Wait()
+	}
+	if r.consumer != nil {
+		r.consumer.wg.Wait()
+	}
+}
+
+// wait blocks until every tailer of every service has returned, either
+// because the context was cancelled or, in run_once mode, because all
+// streams are caught up.
+func (s *supervisor) wait() {
+	s.mu.Lock()
+	runners := make([]*serviceRunner, 0, len(s.services))
+	for _, runner := range s.services {
+		runners = append(runners, runner)
+	}
+	s.mu.Unlock()
+
+	for _, runner := range runners {
+		runner.wait()
+	}
+	drainPipelines()
+}
+
+// warnGlobalChanges logs settings that cannot be changed without a restart,
+// such as statsd, by their key in the config file.
+func (s *supervisor) warnGlobalChanges(config Config) {
+	old, updated := reflect.ValueOf(s.config), reflect.ValueOf(config)
+	var changed []string
+	for i := range old.NumField() {
+		key, _, _ := strings.Cut(old.Type().Field(i).Tag.Get("yaml"), ",")
+		if key == "services" {
+			continue
+		}
+		if !reflect.DeepEqual(old.Field(i).Interface(), updated.Field(i).Interface()) {
+			changed = append(changed, key)
+		}
+	}
+	if len(changed) > 0 {
+		supervisorLog.Errorf("Global settings changed in the reloaded config (%s); only services are reloaded, restart cwsync to apply the rest", strings.Join(changed, ", "))
+	}
+}
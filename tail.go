@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+var errStreamGone = errors.New("log stream no longer exists")
+
+var errTailDone = errors.New("log stream tail finished")
+
+// runOnceMaxFailures is how many fetches of a stream may fail in a row in
+// run-once mode before its tail gives up, so the pass ends.
+const runOnceMaxFailures = 5
+
+// runOnceFailures counts the tails that gave up, main exits non-zero if any
+// did.
+var runOnceFailures atomic.Int64
+
+// giveUp reports whether a tail that failed failures times in a row stops,
+// and counts it if so.
+func giveUp(runOnce bool, failures int) bool {
+	if !runOnce || failures < runOnceMaxFailures {
+		return false
+	}
+	runOnceFailures.Add(1)
+	return true
+}
+
+// streamTail is the state of tailing one log stream. Instead of owning a
+// goroutine, a tail is advanced one GetLogEvents call at a time by step, so a
+// bounded worker pool can drive any number of streams.
+type streamTail struct {
+	m         *tailerManager
+	ctx       context.Context
+	cwLogs    *cloudwatchlogs.CloudWatchLogs
+	service   ServiceConfig
+	logConfig LogConfig
+	name      string
+	key       string
+	t         *tailer
+	log       logger
+
+	started         bool
+	offsetPath      string
+	checkpoint      int64
+	lastTimestamp   int64
+	newestTimestamp int64
+	nextToken       *string
+	byIngestion     bool
+	end             *endBound
+	pollInterval    time.Duration
+	maxPollInterval time.Duration
+	fetchLimit      int64
+	retryDelay      time.Duration
+	baseDelay       time.Duration
+	maxDelay        time.Duration
+	errorDelay      time.Duration
+	failures        int
+	lateWindow      int64
+	seen            *seenEvents
+	boundary        *resumeBoundary
+	resumed         resumeCutoff
+	// events is reused for every page handed to writeEvents
+	events []logEvent
+	// prefetch delivers the next page, requested while the current one
+	// is being written
+	prefetch chan fetchResult
+}
+
+type fetchResult struct {
+	resp *cloudwatchlogs.GetLogEventsOutput
+	err  error
+}
+
+// init positions the tail at its stored offset (or the live end of the
+// stream) before the first fetch.
+func (t *streamTail) init() {
+	service, logConfig := t.service, t.logConfig
+	t.offsetPath = t.m.offsets.base(service, logConfig.LogGroupName) + "/" + t.name
+	var boundary []string
+	if service.TailFromLatest {
+		var err error
+		t.checkpoint, t.nextToken, err = latestPosition(t.ctx, t.cwLogs, logConfig, t.name)
+		if err != nil {
+			t.log.Errorf("Error finding the end of log stream %s, starting from now: %v", t.name, err)
+			t.checkpoint = time.Now().UnixMilli()
+		}
+	} else {
+		t.checkpoint, boundary = loadOffsetFromConsul(t.m.consulClient, t.offsetPath, t.m.offsetFallbackDuration)
+	}
+	t.boundary = newResumeBoundary(t.checkpoint, boundary)
+	t.lastTimestamp = t.checkpoint
+	// With ingestion time checkpoints the stored offset is the ingestion time
+	// of the last written event. GetLogEvents can only filter by event time,
+	// so resume a lookback window earlier and skip what was already ingested
+	// before the checkpoint; late events with older timestamps are kept.
+	t.byIngestion = service.CheckpointBy == checkpointByIngestionTime
+	if t.byIngestion && !service.TailFromLatest {
+		t.lastTimestamp = t.checkpoint - service.ingestionLookback().Milliseconds()
+	}
+	// events older than max_event_age are not even fetched
+	if oldest := service.oldestTimestamp(time.Now()); t.lastTimestamp < oldest {
+		t.log.Infof("Skipping events of log stream %s older than max_event_age %s", t.name, time.Duration(service.MaxEventAge))
+		t.lastTimestamp = oldest
+	}
+	t.log.Infof("Starting to tail log stream %s from timestamp %d (%s)", t.name, t.lastTimestamp, time.Unix(t.lastTimestamp/1000, 0).Format(time.RFC3339))
+	// end_time was validated when loading the config
+	t.end, _ = parseEndBound(service.EndTime)
+	t.pollInterval, t.maxPollInterval, t.fetchLimit = logConfig.pollSettings(service)
+	t.retryDelay = t.pollInterval
+	t.baseDelay, t.maxDelay = service.errorBackoff()
+	t.errorDelay = t.baseDelay
+	t.lateWindow = time.Duration(service.LateEventWindow).Milliseconds()
+	t.seen = newSeenEvents()
+	t.resumed = newResumeCutoff(t.checkpoint, t.byIngestion)
+	t.newestTimestamp = t.lastTimestamp
+	t.started = true
+}
+
+// step makes one GetLogEvents call and returns how long to wait before the
+// next one. A non-nil error ends the tail: errTailDone when the stream is
+// caught up or keeps failing in run-once mode or is past end_time,
+// errStreamGone when it was deleted, or the context error when the tail was
+// stopped.
+func (t *streamTail) step() (time.Duration, error) {
+	ctx := t.ctx
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if !t.started {
+		t.init()
+	}
+	service, logConfig, logStreamName := t.service, t.logConfig, t.name
+	var resp *cloudwatchlogs.GetLogEventsOutput
+	var err error
+	if t.prefetch != nil {
+		result := <-t.prefetch
+		t.prefetch = nil
+		resp, err = result.resp, result.err
+	} else {
+		resp, err = t.fetch(t.lastTimestamp, t.nextToken)
+	}
+
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException {
+		t.log.Infof("Log stream %s no longer exists, stopping tailer", logStreamName)
+		if service.DeleteOffsetOnStreamGone {
+			if err := deleteOffsetFromConsul(t.m.consulClient, t.offsetPath); err != nil {
+				t.log.Errorf("Error deleting offset for %s from Consul: %v", logStreamName, err)
+			}
+		}
+		return 0, errStreamGone
+	}
+
+	if err != nil && ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if err != nil {
+		t.log.Errorf("Error getting log events for stream %s: %v", logStreamName, err)
+		recordFetchError(t.key, service, logConfig.LogGroupName, logStreamName, t.checkpoint, err)
+		if t.failures++; giveUp(t.m.runOnce, t.failures) {
+			t.log.Errorf("Giving up on log stream %s after %d failed fetches", logStreamName, t.failures)
+			return 0, errTailDone
+		}
+		delay := jitter(t.errorDelay)
+		// throttled streams of a busy group back off exponentially so
+		// they give the group a chance to recover
+		if isThrottlingError(err) && t.errorDelay < t.maxDelay {
+			t.errorDelay = min(t.errorDelay*2, t.maxDelay)
+		}
+		return delay, nil
+	}
+	t.errorDelay, t.failures = t.baseDelay, 0
+
+	if len(resp.Events) > 0 {
+		// a full page means the stream is behind: request the next page
+		// now so it arrives while this one is written and checkpointed
+		if int64(len(resp.Events)) >= t.fetchLimit {
+			t.prefetch = make(chan fetchResult, 1)
+			go func(startTime int64, token *string) {
+				resp, err := t.fetch(startTime, token)
+				t.prefetch <- fetchResult{resp, err}
+			}(*resp.Events[len(resp.Events)-1].Timestamp, resp.NextForwardToken)
+		}
+		t.events = t.events[:0]
+		for _, event := range resp.Events {
+			if t.byIngestion && *event.IngestionTime < t.checkpoint {
+				continue
+			}
+			if t.resumed.written(*event.Timestamp, *event.IngestionTime) {
+				continue
+			}
+			if t.lateWindow > 0 && !t.seen.add(event) {
+				continue
+			}
+			at := *event.Timestamp
+			if t.byIngestion {
+				at = *event.IngestionTime
+			}
+			if t.boundary.tracks(at) {
+				id := streamEventID(event)
+				if t.boundary.written(at, id) {
+					continue
+				}
+				t.boundary.record(at, id)
+			}
+			t.events = append(t.events, logEvent{
+				LogGroup:      logConfig.LogGroupName,
+				LogStream:     logStreamName,
+				Timestamp:     *event.Timestamp,
+				IngestionTime: *event.IngestionTime,
+				Message:       *event.Message,
+			})
+			if t.byIngestion && *event.IngestionTime > t.checkpoint {
+				t.checkpoint = *event.IngestionTime
+			}
+		}
+		t.lastTimestamp = *resp.Events[len(resp.Events)-1].Timestamp
+		if t.lastTimestamp > t.newestTimestamp {
+			t.newestTimestamp = t.lastTimestamp
+		}
+		// a late event rescan reads older events again, the offset must
+		// never move backwards because of it
+		if !t.byIngestion && t.newestTimestamp > t.checkpoint {
+			t.checkpoint = t.newestTimestamp
+		}
+		if t.lateWindow > 0 {
+			t.seen.prune(t.newestTimestamp - t.lateWindow)
+		}
+		writeEvents(service, t.events)
+		recordFetch(t.key, service, logConfig.LogGroupName, logStreamName, t.checkpoint, t.newestTimestamp, false)
+		if len(t.events) > 0 {
+			err = saveOffsetToConsul(t.m.consulClient, t.offsetPath, t.checkpoint, t.boundary.saved(t.checkpoint))
+			if err != nil {
+				t.log.Errorf("Error saving offset to Consul: %v", err)
+			}
+			t.retryDelay = t.pollInterval
+		}
+		t.nextToken = resp.NextForwardToken
+		return 0, nil
+	}
+
+	if t.nextToken == nil || *resp.NextForwardToken != *t.nextToken {
+		t.nextToken = resp.NextForwardToken
+		return 0, nil
+	}
+	recordFetch(t.key, service, logConfig.LogGroupName, logStreamName, t.checkpoint, t.newestTimestamp, true)
+	if t.m.runOnce {
+		t.log.Infof("Log stream %s is caught up", logStreamName)
+		return 0, errTailDone
+	}
+	if t.end != nil && t.end.reached() {
+		t.log.Infof("Log stream %s reached end_time %s, stopping tailer", logStreamName, service.EndTime)
+		return 0, errTailDone
+	}
+	if t.lateWindow > 0 {
+		// re-read the window behind the newest event so events
+		// CloudWatch ingested late are still picked up
+		t.lastTimestamp = t.newestTimestamp - t.lateWindow
+		t.seen.prune(t.lastTimestamp)
+	} else {
+		t.lastTimestamp += 1
+	}
+	t.nextToken = nil
+	delay := t.retryDelay
+	if t.retryDelay < t.maxPollInterval {
+		t.retryDelay = min(t.retryDelay*2, t.maxPollInterval)
+	}
+	return delay, nil
+}
+
+// fetch makes one GetLogEvents call once the log group has a free fetch slot.
+func (t *streamTail) fetch(startTime int64, token *string) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	params := &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(t.logConfig.LogGroupName),
+		LogStreamName: aws.String(t.name),
+		StartTime:     aws.Int64(startTime),
+		StartFromHead: aws.Bool(true),
+		Limit:         aws.Int64(t.fetchLimit),
+		NextToken:     token,
+	}
+	if t.end != nil {
+		params.EndTime = aws.Int64(t.end.millis())
+	}
+	release, err := acquireGroupSlot(t.ctx, t.logConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return t.cwLogs.GetLogEventsWithContext(t.ctx, params)
+}
+
+// latestPosition returns the forward token at the current end of the stream,
+// so tailing only picks up events ingested from now on.
+func latestPosition(ctx context.Context, cwLogs *cloudwatchlogs.CloudWatchLogs, logConfig LogConfig, logStreamName string) (int64, *string, error) {
+	resp, err := cwLogs.GetLogEventsWithContext(ctx, &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(logConfig.LogGroupName),
+		LogStreamName: aws.String(logStreamName),
+		StartFromHead: aws.Bool(false),
+		Limit:         aws.Int64(1),
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	position := time.Now().UnixMilli()
+	if len(resp.Events) > 0 {
+		position = *resp.Events[len(resp.Events)-1].Timestamp
+	}
+	return position, resp.NextForwardToken, nil
+}
+
+const (
+	baseErrorDelay = 60 * time.Second
+	maxErrorDelay  = 5 * time.Minute
+)
+
+// errorBackoff returns the delay after a failed GetLogEvents call and the cap
+// it doubles up to while the service is throttled.
+func (s ServiceConfig) errorBackoff() (time.Duration, time.Duration) {
+	base := time.Duration(s.ErrorBackoff)
+	if base <= 0 {
+		base = baseErrorDelay
+	}
+	return base, max(base, maxErrorDelay)
+}
+
+func isThrottlingError(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case "ThrottlingException", cloudwatchlogs.ErrCodeLimitExceededException, cloudwatchlogs.ErrCodeServiceUnavailableException:
+		return true
+	}
+	return false
+}
+
+// jitter spreads d uniformly over [d/2, 3d/2) so streams that failed at the
+// same moment do not all retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d/2 + rand.N(d)
+}
+
+// sleepContext sleeps for d or until ctx is cancelled, whichever comes first.
+// It reports whether the full duration elapsed.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
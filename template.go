@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateFuncs are available in destination templates besides the
+// builtins.
+var templateFuncs = template.FuncMap{
+	// field looks up a parsed field by dotted path, empty if it is missing
+	"field": func(fields map[string]any, path string) any {
+		if value, ok := lookupField(fields, strings.Split(path, ".")); ok {
+			return value
+		}
+		return ""
+	},
+	"json": func(value any) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+// templateEvent is what a destination template is executed with.
+type templateEvent struct {
+	Time          time.Time
+	IngestionTime time.Time
+	// Timestamp is formatted by destination.timestamp, by default the
+	// write time like the default lines
+	Timestamp string
+	Service   string
+	Group     string
+	Stream    string
+	Message   string
+	Level     string
+	Fields    map[string]any
+	Labels    map[string]string
+}
+
+func parseEventTemplate(text string) (*template.Template, error) {
+	return template.New("destination").Funcs(templateFuncs).Parse(text)
+}
+
+// checkEventTemplate parses the template and runs it on an empty event, which
+// catches references to fields templateEvent does not have.
+func checkEventTemplate(text string) error {
+	tmpl, err := parseEventTemplate(text)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(io.Discard, templateEvent{})
+}
+
+// eventTemplate formats every event of a batch with destination.template
+// instead of the default "[stream] message" lines.
+type eventTemplate struct {
+	tmpl      *template.Template
+	service   string
+	labels    map[string]string
+	timestamp *timestampFormat
+}
+
+func newEventTemplate(service ServiceConfig, timestamp *timestampFormat) *eventTemplate {
+	if service.Destination.Template == "" {
+		return nil
+	}
+	// the template was validated when loading the config
+	tmpl, _ := parseEventTemplate(service.Destination.Template)
+	if timestamp == nil {
+		timestamp, _ = newTimestampFormat(TimestampConfig{Source: timestampSourceWrite})
+	}
+	return &eventTemplate{tmpl: tmpl, service: service.Name, labels: service.Labels, timestamp: timestamp}
+}
+
+// format appends the rendered event and a newline to buf. An event the
+// template fails on is written as its bare message, so it is not lost.
+func (t *eventTemplate) format(buf *bytes.Buffer, event *logEvent, now time.Time) {
+	start := buf.Len()
+	var stamp [64]byte
+	err := t.tmpl.Execute(buf, templateEvent{
+		Time:          time.UnixMilli(event.Timestamp),
+		IngestionTime: time.UnixMilli(event.IngestionTime),
+		Timestamp:     string(t.timestamp.appendTime(stamp[:0], event, now)),
+		Service:       t.service,
+		Group:         event.LogGroup,
+		Stream:        event.LogStream,
+		Message:       t.timestamp.message(event.Message),
+		Level:         event.Level,
+		Fields:        event.Fields,
+		Labels:        t.labels,
+	})
+	if err != nil {
+		pipelineLog.with("service", t.service).Errorf("Error executing the destination template of %s: %v", t.service, err)
+		buf.Truncate(start)
+		buf.WriteString(event.Message)
+	}
+	buf.WriteByte('\n')
+}
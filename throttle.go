@@ -0,0 +1,50 @@
+package main
+
+import "time"
+
+const metricOutputThrottled = "cwsync_output_throttled_seconds_total"
+
+func init() {
+	metrics.describe(metricOutputThrottled, "counter", "Seconds writers waited for the max_events_per_second and max_bytes_per_second limits of their destination.")
+}
+
+// outputThrottle holds a writer to the event and byte rate its destination
+// allows. Either bucket is nil if its limit is not set.
+type outputThrottle struct {
+	events *tokenBucket
+	bytes  *tokenBucket
+}
+
+// newOutputThrottle returns nil if the destination has no limits. The buckets
+// hold one second worth of tokens, so a writer that was idle may send that
+// much at once.
+func newOutputThrottle(d Destination) *outputThrottle {
+	if d.MaxEventsPerSecond <= 0 && d.MaxBytesPerSecond <= 0 {
+		return nil
+	}
+	t := &outputThrottle{}
+	if d.MaxEventsPerSecond > 0 {
+		t.events = newTokenBucket(d.MaxEventsPerSecond, int(d.MaxEventsPerSecond))
+	}
+	if d.MaxBytesPerSecond > 0 {
+		t.bytes = newTokenBucket(d.MaxBytesPerSecond, int(d.MaxBytesPerSecond))
+	}
+	return t
+}
+
+// delay takes the tokens of a batch and returns how long to wait before
+// delivering it. A batch larger than the bucket is let through on credit, so
+// the wait grows with the batch instead of it never fitting.
+func (t *outputThrottle) delay(events, bytes int) time.Duration {
+	if t == nil {
+		return 0
+	}
+	var wait time.Duration
+	if t.events != nil {
+		wait = t.events.reserveN(float64(events))
+	}
+	if t.bytes != nil {
+		wait = max(wait, t.bytes.reserveN(float64(bytes)))
+	}
+	return wait
+}
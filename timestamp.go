@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	timestampSourceWrite     = "write"
+	timestampSourceEvent     = "event"
+	timestampSourceIngestion = "ingestion"
+
+	timestampLayoutUnix   = "unix"
+	timestampLayoutUnixMs = "unixms"
+
+	defaultTimestampLayout = "2006/01/02 15:04:05"
+)
+
+var timestampLayouts = map[string]string{
+	"rfc3339":      time.RFC3339,
+	"rfc3339milli": "2006-01-02T15:04:05.000Z07:00",
+	"rfc3339nano":  time.RFC3339Nano,
+}
+
+// TimestampConfig controls the timestamp written in front of every event.
+type TimestampConfig struct {
+	// Source is the time written: when the event is written (default),
+	// its event timestamp or its cloudwatch ingestion time
+	Source   string `yaml:"source"`
+	Layout   string `yaml:"layout"`
+	Timezone string `yaml:"timezone"`
+	// Replace matches a timestamp at the start of messages, which is cut
+	// off so only the normalized one remains
+	Replace string `yaml:"replace"`
+}
+
+func (c TimestampConfig) enabled() bool {
+	return c.Source != "" || c.Layout != "" || c.Timezone != "" || c.Replace != ""
+}
+
+// timestampFormat is the parsed form of a TimestampConfig.
+type timestampFormat struct {
+	source  string
+	layout  string
+	loc     *time.Location
+	replace *regexp.Regexp
+}
+
+func newTimestampFormat(c TimestampConfig) (*timestampFormat, error) {
+	if !c.enabled() {
+		return nil, nil
+	}
+	f := &timestampFormat{source: c.Source, layout: c.Layout, loc: time.Local}
+	switch f.source {
+	case "":
+		f.source = timestampSourceWrite
+	case timestampSourceWrite, timestampSourceEvent, timestampSourceIngestion:
+	default:
+		return nil, fmt.Errorf("source must be %q, %q or %q, got %q", timestampSourceWrite, timestampSourceEvent, timestampSourceIngestion, c.Source)
+	}
+	if layout, ok := timestampLayouts[f.layout]; ok {
+		f.layout = layout
+	} else if f.layout == "" {
+		f.layout = defaultTimestampLayout
+	}
+	if c.Timezone != "" {
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %v", c.Timezone, err)
+		}
+		f.loc = loc
+	}
+	if c.Replace != "" {
+		re, err := regexp.Compile("^(?:" + c.Replace + ")")
+		if err != nil {
+			return nil, fmt.Errorf("invalid replace pattern %q: %v", c.Replace, err)
+		}
+		f.replace = re
+	}
+	return f, nil
+}
+
+// time returns the time of event the format writes.
+func (f *timestampFormat) time(event *logEvent, now time.Time) time.Time {
+	switch f.source {
+	case timestampSourceEvent:
+		return time.UnixMilli(event.Timestamp)
+	case timestampSourceIngestion:
+		return time.UnixMilli(event.IngestionTime)
+	default:
+		return now
+	}
+}
+
+// appendTime appends the formatted time of event to dst.
+func (f *timestampFormat) appendTime(dst []byte, event *logEvent, now time.Time) []byte {
+	t := f.time(event, now)
+	switch f.layout {
+	case timestampLayoutUnix:
+		return strconv.AppendInt(dst, t.Unix(), 10)
+	case timestampLayoutUnixMs:
+		return strconv.AppendInt(dst, t.UnixMilli(), 10)
+	default:
+		return t.In(f.loc).AppendFormat(dst, f.layout)
+	}
+}
+
+// message returns the message with a leading timestamp matched by replace
+// and the spaces after it cut off.
+func (f *timestampFormat) message(message string) string {
+	if f.replace == nil {
+		return message
+	}
+	if loc := f.replace.FindStringIndex(message); loc != nil {
+		rest := message[loc[1]:]
+		for len(rest) > 0 && (rest[0] == ' ' || rest[0] == '\t') {
+			rest = rest[1:]
+		}
+		return rest
+	}
+	return message
+}
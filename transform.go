@@ -0,0 +1,200 @@
+package main
+
+import "time"
+
+const (
+	metricFilteredEvents = "cwsync_filtered_events_total"
+	metricExpiredEvents  = "cwsync_expired_events_total"
+)
+
+func init() {
+	metrics.describe(metricFilteredEvents, "counter", "Events dropped by message_include and message_exclude.")
+	metrics.describe(metricExpiredEvents, "counter", "Events dropped for being older than max_event_age.")
+}
+
+// stage is one step of a service's transform chain, which every event runs
+// through before it is merged or written. apply appends what becomes of the
+// event to out: nothing to drop it, several events to split it.
+type stage interface {
+	apply(event logEvent, out []logEvent) []logEvent
+}
+
+// transformChain runs the stages of one service. It reuses its buffers, so
+// the events run and flush return are only valid until the next call.
+type transformChain struct {
+	stages         []stage
+	cur, next, out []logEvent
+	// tick is how often flush has to be called, 0 without a flusher
+	tick time.Duration
+}
+
+// newTransformChain builds the stages of a service in the order they run.
+// The settings were validated when loading the config.
+func newTransformChain(service ServiceConfig) *transformChain {
+	c := &transformChain{}
+	if service.MaxEventAge > 0 {
+		c.stages = append(c.stages, ageFilter{service: service})
+	}
+	// lines are joined first, so filters see whole records
+	if service.Multiline.enabled() {
+		c.stages = append(c.stages, newMultilineStage(service.Multiline))
+	}
+	if len(service.MessageInclude) > 0 || len(service.MessageExclude) > 0 {
+		filter, _ := newPatternFilter("message", service.MessageInclude, service.MessageExclude)
+		c.stages = append(c.stages, messageFilter{filter: filter, service: service.Name})
+	}
+	if service.MinLevel != "" || service.LevelField != "" {
+		c.stages = append(c.stages, newLevelStage(service))
+	}
+	if (service.SampleRate > 0 && service.SampleRate < 1) || len(service.SampleRules) > 0 {
+		c.stages = append(c.stages, newSampleStage(service))
+	}
+	if service.CollapseRepeats > 0 {
+		c.stages = append(c.stages, newRepeatsStage(service))
+	}
+	// stages working on the fields of JSON messages come first, then the
+	// fields are encoded into the message for the stages working on text
+	fieldStages := len(c.stages)
+	// metrics are extracted before the json settings can drop _aws
+	if service.EMF.enabled() {
+		c.stages = append(c.stages, newEMFStage(service))
+	}
+	if service.JSON.enabled() {
+		c.stages = append(c.stages, newJSONStage(service.JSON))
+	}
+	if service.Parse.enabled() {
+		c.stages = append(c.stages, newParseStage(service.Parse))
+	}
+	if service.Preset != "" {
+		c.stages = append(c.stages, presets[service.Preset](service))
+	}
+	if len(service.FieldMappings) > 0 {
+		c.stages = append(c.stages, newMappingStage(service.FieldMappings))
+	}
+	if service.Wasm.enabled() {
+		c.stages = append(c.stages, newWasmStage(service))
+	}
+	if service.JSONSchema.enabled() {
+		c.stages = append(c.stages, newSchemaStage(service))
+	}
+	if service.Filter != "" {
+		c.stages = append(c.stages, newExprFilter(service))
+	}
+	if len(service.Redact) > 0 {
+		c.stages = append(c.stages, newRedactStage(service))
+	}
+	if service.enriched() && service.Enrich.Format != enrichFormatPrefix {
+		c.stages = append(c.stages, newEnrichStage(service))
+	}
+	if len(c.stages) > fieldStages {
+		c.stages = append(c.stages, encodeStage{})
+	}
+	if service.enriched() && service.Enrich.Format == enrichFormatPrefix {
+		c.stages = append(c.stages, newEnrichStage(service))
+	}
+	for _, s := range c.stages {
+		if f, ok := s.(flusher); ok && (c.tick == 0 || f.flushInterval() < c.tick) {
+			c.tick = f.flushInterval()
+		}
+	}
+	return c
+}
+
+// run passes event through every stage. The share of max_buffered_bytes of
+// an event moves to the first event a stage makes of it, or is released if
+// the stage dropped it; flushers keep it for the events they hold.
+func (c *transformChain) run(event logEvent) []logEvent {
+	c.out = c.out[:0]
+	c.cur = append(c.cur[:0], event)
+	c.runFrom(0)
+	return c.out
+}
+
+// flush emits the events held by the flushers that are due, or all of them
+// with force, and passes them through the remaining stages.
+func (c *transformChain) flush(force bool) []logEvent {
+	c.out = c.out[:0]
+	now := time.Now()
+	for i, s := range c.stages {
+		if f, ok := s.(flusher); ok {
+			c.cur = f.flush(now, force, c.cur[:0])
+			c.runFrom(i + 1)
+		}
+	}
+	return c.out
+}
+
+// close releases what the stages hold, such as wasm plugins.
+func (c *transformChain) close() {
+	for _, s := range c.stages {
+		if closer, ok := s.(interface{ close() }); ok {
+			closer.close()
+		}
+	}
+}
+
+// runFrom passes c.cur through the stages from index i on and appends the
+// results to c.out.
+func (c *transformChain) runFrom(i int) {
+	for _, s := range c.stages[i:] {
+		if len(c.cur) == 0 {
+			return
+		}
+		_, holds := s.(flusher)
+		c.next = c.next[:0]
+		for _, e := range c.cur {
+			n := len(c.next)
+			c.next = s.apply(e, c.next)
+			if holds {
+				continue
+			}
+			if len(c.next) == n {
+				buffered.release(e.buffered)
+			}
+			for j := n + 1; j < len(c.next); j++ {
+				c.next[j].buffered = 0
+			}
+		}
+		c.cur, c.next = c.next, c.cur
+	}
+	c.out = append(c.out, c.cur...)
+}
+
+// encodeStage writes the fields of events that have them as their message.
+// The fields are kept for the destination template.
+type encodeStage struct{}
+
+func (encodeStage) apply(event logEvent, out []logEvent) []logEvent {
+	if event.Fields != nil {
+		event.Message = encodeFields(event.Fields)
+	}
+	return append(out, event)
+}
+
+// ageFilter drops events older than max_event_age, such as late events or
+// the backlog of a kinesis stream.
+type ageFilter struct {
+	service ServiceConfig
+}
+
+func (f ageFilter) apply(event logEvent, out []logEvent) []logEvent {
+	if event.Timestamp < f.service.oldestTimestamp(time.Now()) {
+		metrics.Add(metricExpiredEvents, 1, "service", f.service.Name)
+		return out
+	}
+	return append(out, event)
+}
+
+// messageFilter drops events by message_include and message_exclude.
+type messageFilter struct {
+	filter  *patternFilter
+	service string
+}
+
+func (f messageFilter) apply(event logEvent, out []logEvent) []logEvent {
+	if !f.filter.match(event.Message) {
+		metrics.Add(metricFilteredEvents, 1, "service", f.service)
+		return out
+	}
+	return append(out, event)
+}
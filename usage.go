@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+const (
+	metricAPICalls     = "cwsync_api_calls_total"
+	metricAPIBytes     = "cwsync_api_bytes_total"
+	metricAPICallError = "cwsync_api_errors_total"
+
+	defaultUsageSummaryInterval = time.Hour
+)
+
+func init() {
+	metrics.describe(metricAPICalls, "counter", "CloudWatch Logs API calls, including SDK retries.")
+	metrics.describe(metricAPIBytes, "counter", "Estimated bytes of log data returned by CloudWatch Logs.")
+	metrics.describe(metricAPICallError, "counter", "CloudWatch Logs API calls that returned an error.")
+}
+
+// instrumentClient counts every API attempt made by the client and the size
+// of returned events, attributed to the given service.
+func instrumentClient(cwLogs *cloudwatchlogs.CloudWatchLogs, serviceName string) {
+	cwLogs.Handlers.Send.PushBackNamed(request.NamedHandler{
+		Name: "cwsync.CountCalls",
+		Fn: func(r *request.Request) {
+			metrics.Add(metricAPICalls, 1, "service", serviceName, "operation", r.Operation.Name)
+		},
+	})
+	cwLogs.Handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "cwsync.CountBytes",
+		Fn: func(r *request.Request) {
+			if r.Error != nil {
+				metrics.Add(metricAPICallError, 1, "service", serviceName, "operation", r.Operation.Name)
+				return
+			}
+			var bytes int
+			switch out := r.Data.(type) {
+			case *cloudwatchlogs.GetLogEventsOutput:
+				for _, event := range out.Events {
+					bytes += len(*event.Message)
+				}
+			case *cloudwatchlogs.FilterLogEventsOutput:
+				for _, event := range out.Events {
+					bytes += len(*event.Message)
+				}
+			default:
+				return
+			}
+			metrics.Add(metricAPIBytes, float64(bytes), "service", serviceName, "operation", r.Operation.Name)
+		},
+	})
+}
+
+// logUsageSummary periodically logs the API call and byte counters per
+// service, for deployments that do not scrape the metrics endpoint.
+func logUsageSummary(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		byService := make(map[string][]string)
+		var order []string
+		for _, s := range metrics.Snapshot() {
+			if s.name != metricAPICalls && s.name != metricAPIBytes {
+				continue
+			}
+			service, operation := s.labels[1], s.labels[3]
+			if _, ok := byService[service]; !ok {
+				order = append(order, service)
+			}
+			unit := "calls"
+			if s.name == metricAPIBytes {
+				unit = "bytes"
+			}
+			byService[service] = append(byService[service], operation+" "+strconv.FormatFloat(s.value, 'f', -1, 64)+" "+unit)
+		}
+		for _, service := range order {
+			awsLog.Infof("API usage for %s: %s", service, strings.Join(byService[service], ", "))
+		}
+	}
+}
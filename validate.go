@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// configError is a validation problem at a path in the config document, such
+// as "services[0].log_configs[1].log_group_name". file is set for problems
+// in an included file, path is then relative to that file.
+type configError struct {
+	file string
+	path string
+	msg  string
+}
+
+func (e configError) format(file string, lines map[string]int) string {
+	if e.file != "" {
+		file = e.file
+		lines = locateFilePaths(e.file)
+	}
+	// fall back to the closest parent that exists in the document, e.g. for
+	// a required key that is missing entirely
+	path := e.path
+	for path != "" {
+		if line, ok := lines[path]; ok {
+			return fmt.Sprintf("%s:%d: %s: %s", file, line, e.path, e.msg)
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	if e.path == "" {
+		return fmt.Sprintf("%s: %s", file, e.msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", file, e.path, e.msg)
+}
+
+// validateConfig checks everything that can be checked without talking to
+// AWS or Consul and returns all problems instead of stopping at the first.
+func validateConfig(config Config) []configError {
+	var errs []configError
+	add := func(path, format string, args ...any) {
+		errs = append(errs, configError{path: path, msg: fmt.Sprintf(format, args...)})
+	}
+
+	if config.AWSRegion == "" && os.Getenv("AWS_REGION") == "" {
+		add("aws_region", "is required")
+	}
+	if (config.Consul.CertFile == "") != (config.Consul.KeyFile == "") {
+		add("consul.key_file", "consul.cert_file and consul.key_file must be set together")
+	}
+	switch config.Consul.Scheme {
+	case "", "http", "https":
+	default:
+		add("consul.scheme", "must be \"http\" or \"https\", got %q", config.Consul.Scheme)
+	}
+	if _, err := parseLogLevel(config.LogLevel); err != nil {
+		add("log_level", "must be debug, info, warn or error, got %q", config.LogLevel)
+	}
+	switch config.LogFormat {
+	case "", logFormatText, logFormatJSON:
+	default:
+		add("log_format", "must be %q or %q, got %q", logFormatText, logFormatJSON, config.LogFormat)
+	}
+	switch config.Color {
+	case "", colorAuto, colorAlways, colorNever:
+	default:
+		add("color", "must be %q, %q or %q, got %q", colorAuto, colorAlways, colorNever, config.Color)
+	}
+	if config.AdminAddr != "" {
+		if config.AdminToken == "" {
+			add("admin_token", "is required when admin_addr is set")
+		}
+		if config.Consul.ServicesKVPrefix == "" {
+			add("consul.services_kv_prefix", "is required when admin_addr is set, services are stored there")
+		}
+	}
+	if config.StatsD.Address != "" {
+		if err := config.StatsD.validate(); err != nil {
+			add("statsd", "%v", err)
+		}
+	}
+	switch config.Cluster.Mode {
+	case "", clusterModeShard, clusterModeClaim:
+	default:
+		add("cluster.mode", "must be %q or %q, got %q", clusterModeShard, clusterModeClaim, config.Cluster.Mode)
+	}
+	if config.Cluster.LeaderElect && config.Cluster.Mode != "" {
+		add("cluster.leader_elect", "cannot be combined with cluster.mode, only the leader would tail")
+	}
+	// Consul rejects session TTLs outside this range
+	if ttl := time.Duration(config.Cluster.SessionTTL); ttl != 0 && (ttl < 10*time.Second || ttl > 24*time.Hour) {
+		add("cluster.session_ttl", "must be between 10s and 24h")
+	}
+	if len(config.Services) == 0 && config.Consul.ServicesKVPrefix == "" {
+		add("services", "at least one service is required")
+	}
+
+	names := make(map[string]bool)
+	for i, service := range config.Services {
+		prefix := fmt.Sprintf("services[%d]", i)
+		if service.origin != "" {
+			prefix = ""
+		}
+		var serviceErrs []configError
+		if names[service.Name] && service.Name != "" {
+			serviceErrs = append(serviceErrs, configError{path: joinPath(prefix, "name"), msg: fmt.Sprintf("duplicate service name %q", service.Name)})
+		}
+		names[service.Name] = true
+		serviceErrs = append(serviceErrs, validateService(prefix, service)...)
+		for _, e := range serviceErrs {
+			e.file = service.origin
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
+
+// validateService checks a single service config. prefix is the service's
+// path in the document, e.g. "services[2]", or empty for a service that is a
+// document of its own.
+func validateService(prefix string, service ServiceConfig) []configError {
+	var errs []configError
+	add := func(path, format string, args ...any) {
+		errs = append(errs, configError{path: path, msg: fmt.Sprintf(format, args...)})
+	}
+
+	if service.Name == "" {
+		add(joinPath(prefix, "name"), "is required")
+	}
+	if service.ConsulKVPath == "" {
+		add(joinPath(prefix, "consul_kv_path"), "is required")
+	} else if _, err := expandKVPath(service.ConsulKVPath, kvPathVars{}); err != nil {
+		add(joinPath(prefix, "consul_kv_path"), "%v", err)
+	}
+
+	if (service.AWSAccessKey == "") != (service.AWSSecretKey == "") {
+		add(joinPath(prefix, "aws_secret_key"), "aws_access_key and aws_secret_key must be set together")
+	}
+
+	switch service.CheckpointBy {
+	case "", checkpointByTimestamp, checkpointByIngestionTime:
+	default:
+		add(joinPath(prefix, "checkpoint_by"), "must be %q or %q, got %q", checkpointByTimestamp, checkpointByIngestionTime, service.CheckpointBy)
+	}
+	if service.MaxEventAge < 0 {
+		add(joinPath(prefix, "max_event_age"), "cannot be negative")
+	}
+	if service.FetchLimit > maxFetchLimit {
+		add(joinPath(prefix, "fetch_limit"), "must be at most %d", maxFetchLimit)
+	}
+	switch service.Priority {
+	case "", "high", "normal", "low":
+	default:
+		add(joinPath(prefix, "priority"), "must be \"high\", \"normal\" or \"low\", got %q", service.Priority)
+	}
+	if err := service.Multiline.validate(); err != nil {
+		add(joinPath(prefix, "multiline"), "%v", err)
+	}
+	if _, err := compilePatterns("message_include", service.MessageInclude); err != nil {
+		add(joinPath(prefix, "message_include"), "%v", err)
+	}
+	if _, err := compilePatterns("message_exclude", service.MessageExclude); err != nil {
+		add(joinPath(prefix, "message_exclude"), "%v", err)
+	}
+	if service.CollapseRepeats < 0 {
+		add(joinPath(prefix, "collapse_repeats"), "cannot be negative")
+	}
+	if err := service.EMF.validate(); err != nil {
+		add(joinPath(prefix, "emf"), "%v", err)
+	}
+	if err := service.JSON.validate(); err != nil {
+		add(joinPath(prefix, "json"), "%v", err)
+	}
+	if service.MinLevel != "" {
+		if err := validateMinLevel(service.MinLevel); err != nil {
+			add(joinPath(prefix, "min_level"), "%v", err)
+		}
+	}
+	if service.SampleRate < 0 || service.SampleRate > 1 {
+		add(joinPath(prefix, "sample_rate"), "must be between 0 and 1, got %g", service.SampleRate)
+	}
+	if err := validateSampleRules(service.SampleRules); err != nil {
+		add(joinPath(prefix, "sample_rules"), "%v", err)
+	}
+	if err := service.Parse.validate(); err != nil {
+		add(joinPath(prefix, "parse"), "%v", err)
+	}
+	if service.Preset != "" {
+		if err := validatePreset(service.Preset); err != nil {
+			add(joinPath(prefix, "preset"), "%v", err)
+		}
+	}
+	if service.FlowLogFormat != "" {
+		if service.Preset != "vpc_flow" {
+			add(joinPath(prefix, "flow_log_format"), "only applies to preset vpc_flow")
+		} else if _, err := parseFlowLogFormat(service.FlowLogFormat); err != nil {
+			add(joinPath(prefix, "flow_log_format"), "%v", err)
+		}
+	}
+	if err := validateFieldMappings(service.FieldMappings); err != nil {
+		add(joinPath(prefix, "field_mappings"), "%v", err)
+	}
+	if service.Wasm.enabled() {
+		if err := service.Wasm.validate(); err != nil {
+			add(joinPath(prefix, "wasm"), "%v", err)
+		}
+	}
+	if err := service.JSONSchema.validate(); err != nil {
+		add(joinPath(prefix, "json_schema"), "%v", err)
+	}
+	if service.Filter != "" {
+		if _, err := compileFilter(service.Filter); err != nil {
+			add(joinPath(prefix, "filter"), "%v", err)
+		}
+	}
+	if _, err := compileRedactRules(service.Redact); err != nil {
+		add(joinPath(prefix, "redact"), "%v", err)
+	}
+	if err := service.Enrich.validate(); err != nil {
+		add(joinPath(prefix, "enrich"), "%v", err)
+	}
+	if err := validateLabels(service.Labels); err != nil {
+		add(joinPath(prefix, "labels"), "%v", err)
+	}
+	if _, err := parseSchedule(service.Schedule); err != nil {
+		add(joinPath(prefix, "schedule"), "%v", err)
+	}
+	if _, err := parseEndBound(service.EndTime); err != nil {
+		add(joinPath(prefix, "end_time"), "%v", err)
+	}
+
+	errs = append(errs, validateDestination(joinPath(prefix, "destination"), service.Destination)...)
+	names := make(map[string]bool)
+	for i, route := range service.Routes {
+		errs = append(errs, validateRoute(joinPath(prefix, fmt.Sprintf("routes[%d]", i)), route, names)...)
+	}
+
+	switch service.Source {
+	case "", sourcePoll:
+		if len(service.LogConfigs) == 0 {
+			add(joinPath(prefix, "log_configs"), "at least one log config is required")
+		}
+	case sourceKinesis:
+		if service.Kinesis.StreamName == "" {
+			add(joinPath(prefix, "kinesis.stream_name"), "is required for source kinesis")
+		}
+	default:
+		add(joinPath(prefix, "source"), "must be %q or %q, got %q", sourcePoll, sourceKinesis, service.Source)
+	}
+
+	for j, logConfig := range service.LogConfigs {
+		lcPrefix := joinPath(prefix, fmt.Sprintf("log_configs[%d]", j))
+		if logConfig.LogGroupName == "" && len(logConfig.LogGroupTags) == 0 {
+			add(lcPrefix+".log_group_name", "is required unless log_group_tags is set")
+		}
+		if isLogGroupPattern(logConfig.LogGroupName) {
+			if _, err := newLogGroupMatcher(logConfig.LogGroupName); err != nil {
+				add(lcPrefix+".log_group_name", "%v", err)
+			}
+		}
+		if _, err := compilePatterns("log_stream_include", logConfig.LogStreamInclude); err != nil {
+			add(lcPrefix+".log_stream_include", "%v", err)
+		}
+		if _, err := compilePatterns("log_stream_exclude", logConfig.LogStreamExclude); err != nil {
+			add(lcPrefix+".log_stream_exclude", "%v", err)
+		}
+		switch logConfig.FetchMode {
+		case "", fetchModeStreams, fetchModeGroup:
+		default:
+			add(lcPrefix+".fetch_mode", "must be %q or %q, got %q", fetchModeStreams, fetchModeGroup, logConfig.FetchMode)
+		}
+		if logConfig.FetchLimit > maxFetchLimit {
+			add(lcPrefix+".fetch_limit", "must be at most %d", maxFetchLimit)
+		}
+	}
+	return errs
+}
+
+// validateDestination checks the destination of a service or route.
+func validateDestination(prefix string, d Destination) []configError {
+	var errs []configError
+	add := func(path, format string, args ...any) {
+		errs = append(errs, configError{path: path, msg: fmt.Sprintf(format, args...)})
+	}
+	switch d.Type {
+	case "", "stdout":
+	case "file":
+		if d.FilePath == "" {
+			add(joinPath(prefix, "file_path"), "is required for file destinations")
+		}
+	default:
+		add(joinPath(prefix, "type"), "must be \"stdout\" or \"file\", got %q", d.Type)
+	}
+
+	if max := d.MaxMessageBytes; max != 0 && max < minMessageBytes {
+		add(joinPath(prefix, "max_message_bytes"), "must be at least %d, got %d", minMessageBytes, max)
+	}
+	if err := checkEventTemplate(d.Template); err != nil {
+		add(joinPath(prefix, "template"), "%v", err)
+	}
+	if d.Prefix != "" && d.Template != "" {
+		add(joinPath(prefix, "prefix"), "does not apply with template")
+	} else if err := checkPrefixTemplate(d.Prefix); err != nil {
+		add(joinPath(prefix, "prefix"), "%v", err)
+	}
+	if _, err := newTimestampFormat(d.Timestamp); err != nil {
+		add(joinPath(prefix, "timestamp"), "%v", err)
+	}
+	switch d.Oversized {
+	case "", oversizedSplit, oversizedTruncate:
+	default:
+		add(joinPath(prefix, "oversized"), "must be %q or %q, got %q", oversizedSplit, oversizedTruncate, d.Oversized)
+	}
+	return errs
+}
+
+func joinPath(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// locateConfigPaths maps every path in the YAML document to its line number.
+func locateConfigPaths(data []byte) map[string]int {
+	lines := make(map[string]int)
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &doc); err != nil || len(doc.Content) == 0 {
+		return lines
+	}
+	var walk func(node *yamlv3.Node, path string)
+	walk = func(node *yamlv3.Node, path string) {
+		switch node.Kind {
+		case yamlv3.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key := node.Content[i].Value
+				if path != "" {
+					key = path + "." + key
+				}
+				lines[key] = node.Content[i].Line
+				walk(node.Content[i+1], key)
+			}
+		case yamlv3.SequenceNode:
+			for i, item := range node.Content {
+				key := path + "[" + strconv.Itoa(i) + "]"
+				lines[key] = item.Line
+				walk(item, key)
+			}
+		}
+	}
+	walk(doc.Content[0], "")
+	return lines
+}
+
+// locateFilePaths is locateConfigPaths for a file other than the main config.
+// TOML files have no line numbers.
+func locateFilePaths(path string) map[string]int {
+	if format, err := configFormat(path); err != nil || format == configFormatTOML {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	if data, err = interpolateEnv(data); err != nil {
+		return nil
+	}
+	return locateConfigPaths(data)
+}
+
+// runValidate checks the config file and then verifies that Consul is
+// reachable and that every configured log group (or Kinesis stream) can be
+// read with the configured credentials.
+func runValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := fs.String("config", configPathFromEnv(), "path to the config file")
+	profile := fs.String("config-profile", profileFromEnv(), "config profile to apply")
+	offline := fs.Bool("offline", false, "only check the config file, skip Consul and AWS")
+	fs.Parse(args)
+
+	config, data, err := readConfig(*configPath, *profile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		os.Exit(1)
+	}
+	if errs := validateConfig(config); len(errs) > 0 {
+		lines := locateConfigPaths(data)
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e.format(*configPath, lines))
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("%s: config ok\n", *configPath)
+	if *offline {
+		return
+	}
+
+	failed := false
+	check := func(what string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Fprintf(os.Stderr, "FAIL %s: %v\n", what, err)
+			return
+		}
+		fmt.Printf("ok   %s\n", what)
+	}
+
+	// secret references are resolved like on startup, the checks below
+	// need the real tokens
+	ctx := context.Background()
+	globalSess := createAWSSession(config)
+	if err := resolveSecrets(ctx, globalSess, &config); err != nil {
+		check("resolve secrets", err)
+		os.Exit(1)
+	}
+
+	consulClient := setupConsulClient(config)
+	_, err = consulClient.Status().Leader()
+	check("consul "+config.Consul.Address, err)
+
+	limiter := newAPILimiter(config.APIRateLimits)
+	for _, service := range config.Services {
+		sess, awsConfig := globalSess, config
+		if hasOwnAWSConfig(service) {
+			awsConfig = serviceAWSConfig(config, service)
+			sess = createAWSSession(awsConfig)
+		}
+		cwLogs := newCloudWatchLogsClient(sess, awsConfig, limiter)
+		if service.Source == sourceKinesis {
+			_, err := kinesis.New(sess).DescribeStreamSummaryWithContext(ctx, &kinesis.DescribeStreamSummaryInput{
+				StreamName: aws.String(service.Kinesis.StreamName),
+			})
+			check(fmt.Sprintf("%s: kinesis stream %s", service.Name, service.Kinesis.StreamName), err)
+			continue
+		}
+		for _, logConfig := range service.LogConfigs {
+			logGroups, err := resolveLogGroups(ctx, cwLogs, logConfig)
+			if err != nil {
+				check(fmt.Sprintf("%s: resolve %s", service.Name, logConfig.LogGroupName), err)
+				continue
+			}
+			if len(logGroups) == 0 {
+				check(fmt.Sprintf("%s: resolve %s", service.Name, logConfig.LogGroupName), fmt.Errorf("no matching log groups"))
+			}
+			for _, logGroup := range logGroups {
+				input := &cloudwatchlogs.DescribeLogStreamsInput{
+					LogGroupName: aws.String(logGroup),
+					Limit:        aws.Int64(1),
+				}
+				if logConfig.LogStreamPrefix != "" {
+					input.LogStreamNamePrefix = aws.String(logConfig.LogStreamPrefix)
+				}
+				_, err := cwLogs.DescribeLogStreamsWithContext(ctx, input)
+				check(fmt.Sprintf("%s: describe streams of %s", service.Name, logGroup), err)
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
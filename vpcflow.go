@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultFlowLogFormat is the format of flow logs created without a custom
+// one, version 2.
+const defaultFlowLogFormat = "${version} ${account-id} ${interface-id} ${srcaddr} ${dstaddr} ${srcport} ${dstport} ${protocol} ${packets} ${bytes} ${start} ${end} ${action} ${log-status}"
+
+// flowLogText are the fields of flow log records that are not numbers, all
+// others are stored as numbers.
+var flowLogText = map[string]bool{
+	"account_id": true, "interface_id": true, "srcaddr": true, "dstaddr": true,
+	"action": true, "log_status": true, "vpc_id": true, "subnet_id": true,
+	"instance_id": true, "pkt_srcaddr": true, "pkt_dstaddr": true, "region": true,
+	"az_id": true, "sublocation_type": true, "sublocation_id": true,
+	"pkt_src_aws_service": true, "pkt_dst_aws_service": true, "flow_direction": true,
+	"ecs_cluster_arn": true, "ecs_cluster_name": true, "ecs_container_instance_arn": true,
+	"ecs_container_instance_id": true, "ecs_container_id": true, "ecs_second_container_id": true,
+	"ecs_service_name": true, "ecs_task_definition_arn": true, "ecs_task_arn": true,
+	"ecs_task_id": true, "reject_reason": true,
+}
+
+// parseFlowLogFormat returns the field names of a flow log format as given
+// to AWS, e.g. "${version} ${vpc-id} ...", with dashes turned into
+// underscores.
+func parseFlowLogFormat(format string) ([]string, error) {
+	var names []string
+	for _, token := range strings.Fields(format) {
+		name, ok := strings.CutPrefix(token, "${")
+		if name, ok = strings.CutSuffix(name, "}"); !ok || name == "" {
+			return nil, fmt.Errorf("invalid field %q in flow log format, expected ${name}", token)
+		}
+		names = append(names, strings.ReplaceAll(name, "-", "_"))
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("flow log format has no fields")
+	}
+	return names, nil
+}
+
+// vpcFlowPreset parses the space separated records of VPC flow logs in the
+// default format or the service's flow_log_format. Fields without data,
+// written as "-", are left out.
+type vpcFlowPreset struct {
+	names []string
+}
+
+func newVPCFlowPreset(service ServiceConfig) stage {
+	format := service.FlowLogFormat
+	if format == "" {
+		format = defaultFlowLogFormat
+	}
+	// the format was validated when loading the config
+	names, _ := parseFlowLogFormat(format)
+	return &vpcFlowPreset{names: names}
+}
+
+func (p *vpcFlowPreset) apply(event logEvent, out []logEvent) []logEvent {
+	values := strings.Fields(event.Message)
+	if event.Fields != nil || len(values) != len(p.names) {
+		return append(out, event)
+	}
+	fields := make(map[string]any, len(values))
+	for i, value := range values {
+		if value == "-" {
+			continue
+		}
+		name := p.names[i]
+		if flowLogText[name] {
+			fields[name] = value
+		} else {
+			fields[name] = presetNumber(value)
+		}
+	}
+	event.Fields = fields
+	return append(out, event)
+}
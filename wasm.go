@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+const (
+	metricWasmErrors = "cwsync_wasm_errors_total"
+
+	defaultWasmTimeout = 100 * time.Millisecond
+)
+
+func init() {
+	metrics.describe(metricWasmErrors, "counter", "Events a wasm plugin failed on, which were passed on unchanged.")
+}
+
+// WasmConfig runs every event through a WebAssembly module, for custom
+// parsing or enrichment without forking cwsync. See wasmPlugin for what the
+// module has to export.
+type WasmConfig struct {
+	Path string `yaml:"path"`
+	// Timeout bounds every call of transform, default defaultWasmTimeout
+	Timeout Duration `yaml:"timeout"`
+}
+
+func (c WasmConfig) enabled() bool {
+	return c.Path != ""
+}
+
+// validate loads the module once, so a missing file or export is reported
+// with the config.
+func (c WasmConfig) validate() error {
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout cannot be negative")
+	}
+	plugin, err := loadWasmPlugin(c.Path, c.timeout())
+	if err != nil {
+		return err
+	}
+	plugin.close()
+	return nil
+}
+
+func (c WasmConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultWasmTimeout
+	}
+	return time.Duration(c.Timeout)
+}
+
+// wasmEvent is how events are passed to and returned by a plugin.
+type wasmEvent struct {
+	LogGroup      string         `json:"log_group"`
+	LogStream     string         `json:"log_stream"`
+	Timestamp     int64          `json:"timestamp"`
+	IngestionTime int64          `json:"ingestion_time"`
+	Message       string         `json:"message"`
+	Level         string         `json:"level,omitempty"`
+	Fields        map[string]any `json:"fields,omitempty"`
+}
+
+// wasmOutput is an event returned by a plugin. Keys it leaves out keep the
+// value of the event it was given.
+type wasmOutput struct {
+	LogGroup      *string         `json:"log_group"`
+	LogStream     *string         `json:"log_stream"`
+	Timestamp     *int64          `json:"timestamp"`
+	IngestionTime *int64          `json:"ingestion_time"`
+	Message       *string         `json:"message"`
+	Level         *string         `json:"level"`
+	Fields        json.RawMessage `json:"fields"`
+}
+
+// wasmPlugin is an instance of a module exporting its memory and
+//
+//	alloc(size i32) i32
+//	transform(ptr i32, len i32) i64
+//
+// and optionally dealloc(ptr i32, len i32). transform is given an event as
+// JSON in memory from alloc and returns the pointer and length of a JSON
+// array of the resulting events, packed as ptr<<32 | len. Both buffers are
+// passed to dealloc afterwards if the module has it. WASI is available, e.g.
+// for modules built with TinyGo or for wasm32-wasip1.
+//
+// A call running longer than timeout is aborted, which closes the module; it
+// is instantiated again for the next call.
+type wasmPlugin struct {
+	runtime                   wazero.Runtime
+	compiled                  wazero.CompiledModule
+	path                      string
+	timeout                   time.Duration
+	module                    api.Module
+	alloc, transform, dealloc api.Function
+}
+
+func loadWasmPlugin(path string, timeout time.Duration) (*wasmPlugin, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wasm module: %v", err)
+	}
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to load wasm module %s: %v", path, err)
+	}
+	p := &wasmPlugin{runtime: runtime, compiled: compiled, path: path, timeout: timeout}
+	if err := p.instantiate(); err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *wasmPlugin) instantiate() error {
+	ctx := context.Background()
+	// reactor modules are initialized with _initialize, which is skipped
+	// if the module has none
+	config := wazero.NewModuleConfig().WithStartFunctions("_initialize").WithStdout(os.Stderr).WithStderr(os.Stderr)
+	module, err := p.runtime.InstantiateModule(ctx, p.compiled, config)
+	if err != nil {
+		return fmt.Errorf("failed to load wasm module %s: %v", p.path, err)
+	}
+	p.module = module
+	p.alloc = module.ExportedFunction("alloc")
+	p.transform = module.ExportedFunction("transform")
+	p.dealloc = module.ExportedFunction("dealloc")
+	if p.alloc == nil || p.transform == nil || module.Memory() == nil {
+		return fmt.Errorf("wasm module %s must export memory, alloc and transform", p.path)
+	}
+	return nil
+}
+
+func (p *wasmPlugin) close() {
+	p.runtime.Close(context.Background())
+}
+
+// call passes input to transform and returns a copy of its output.
+func (p *wasmPlugin) call(input []byte) ([]byte, error) {
+	if p.module.IsClosed() {
+		// the previous call timed out
+		if err := p.instantiate(); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	output, err := p.run(ctx, input)
+	if err != nil && ctx.Err() != nil {
+		return nil, fmt.Errorf("transform did not return within %s", p.timeout)
+	}
+	return output, err
+}
+
+func (p *wasmPlugin) run(ctx context.Context, input []byte) ([]byte, error) {
+	res, err := p.alloc.Call(ctx, uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("alloc failed: %v", err)
+	}
+	in := uint32(res[0])
+	memory := p.module.Memory()
+	if !memory.Write(in, input) {
+		return nil, fmt.Errorf("alloc returned %d, out of memory bounds", in)
+	}
+	res, err = p.transform.Call(ctx, uint64(in), uint64(len(input)))
+	if p.dealloc != nil {
+		p.dealloc.Call(ctx, uint64(in), uint64(len(input)))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("transform failed: %v", err)
+	}
+	out, size := uint32(res[0]>>32), uint32(res[0])
+	view, ok := memory.Read(out, size)
+	if !ok {
+		return nil, fmt.Errorf("transform returned %d bytes at %d, out of memory bounds", size, out)
+	}
+	output := bytes.Clone(view)
+	if p.dealloc != nil {
+		p.dealloc.Call(ctx, uint64(out), uint64(size))
+	}
+	return output, nil
+}
+
+// wasmStage runs the events of a service through its plugin. An event the
+// plugin fails on is logged and passed on unchanged.
+type wasmStage struct {
+	plugin  *wasmPlugin
+	service string
+}
+
+func newWasmStage(service ServiceConfig) *wasmStage {
+	plugin, err := loadWasmPlugin(service.Wasm.Path, service.Wasm.timeout())
+	if err != nil {
+		// the module was loaded when validating, but may have changed
+		pipelineLog.with("service", service.Name).Errorf("Error loading the wasm plugin of %s, passing events on unchanged: %v", service.Name, err)
+	}
+	return &wasmStage{plugin: plugin, service: service.Name}
+}
+
+func (s *wasmStage) apply(event logEvent, out []logEvent) []logEvent {
+	if s.plugin == nil {
+		return append(out, event)
+	}
+	results, err := s.run(event, out)
+	if err != nil {
+		metrics.Add(metricWasmErrors, 1, "service", s.service)
+		pipelineLog.with("service", s.service).Errorf("Error in the wasm plugin of %s: %v", s.service, err)
+		return append(out, event)
+	}
+	return results
+}
+
+func (s *wasmStage) run(event logEvent, out []logEvent) ([]logEvent, error) {
+	input, err := json.Marshal(wasmEvent{
+		LogGroup:      event.LogGroup,
+		LogStream:     event.LogStream,
+		Timestamp:     event.Timestamp,
+		IngestionTime: event.IngestionTime,
+		Message:       event.Message,
+		Level:         event.Level,
+		Fields:        event.Fields,
+	})
+	if err != nil {
+		return nil, err
+	}
+	output, err := s.plugin.call(input)
+	if err != nil {
+		return nil, err
+	}
+	var results []wasmOutput
+	if err := json.Unmarshal(output, &results); err != nil {
+		return nil, fmt.Errorf("transform did not return a JSON array of events: %v", err)
+	}
+	for i, r := range results {
+		e := event
+		if i > 0 && r.Fields == nil && event.Fields != nil {
+			// later stages change fields in place
+			e.Fields, _ = parseJSONObject(encodeFields(event.Fields))
+		}
+		if r.LogGroup != nil {
+			e.LogGroup = *r.LogGroup
+		}
+		if r.LogStream != nil {
+			e.LogStream = *r.LogStream
+		}
+		if r.Timestamp != nil {
+			e.Timestamp = *r.Timestamp
+		}
+		if r.IngestionTime != nil {
+			e.IngestionTime = *r.IngestionTime
+		}
+		if r.Message != nil {
+			e.Message = *r.Message
+		}
+		if r.Level != nil {
+			e.Level = *r.Level
+		}
+		if r.Fields != nil {
+			dec := json.NewDecoder(bytes.NewReader(r.Fields))
+			dec.UseNumber()
+			e.Fields = nil
+			if err := dec.Decode(&e.Fields); err != nil {
+				return nil, fmt.Errorf("invalid fields returned by transform: %v", err)
+			}
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func (s *wasmStage) close() {
+	if s.plugin != nil {
+		s.plugin.close()
+	}
+}
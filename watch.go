@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const defaultWatchDebounce = 2 * time.Second
+
+// watchConfigFile requests a reload whenever the config file changes. The
+// directory is watched rather than the file, because editors and tools like
+// consul-template replace the file instead of writing it in place. Bursts of
+// events are debounced into a single reload.
+//
+// Kubernetes ConfigMap volumes never touch the file itself: config.yaml is a
+// symlink into ..data, and an update atomically swaps the ..data symlink to a
+// new directory. Any event in the directory that changes where the path
+// resolves to is therefore treated as a change of the file as well.
+func watchConfigFile(ctx context.Context, path string, debounce time.Duration, reload chan<- struct{}) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		configLog.Errorf("Config file watching disabled: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	dir := filepath.Dir(path)
+	if err := watcher.Add(dir); err != nil {
+		configLog.Errorf("Config file watching disabled, cannot watch %s: %v", dir, err)
+		return
+	}
+	configLog.Infof("Watching %s for changes", path)
+
+	name := filepath.Clean(path)
+	target, _ := filepath.EvalSymlinks(path)
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			if filepath.Clean(event.Name) != name {
+				resolved, err := filepath.EvalSymlinks(path)
+				if err != nil || resolved == target {
+					continue
+				}
+				target = resolved
+			}
+			timer.Reset(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			configLog.Errorf("Error watching config file: %v", err)
+		case <-timer.C:
+			select {
+			case reload <- struct{}{}:
+			default:
+				// a reload is already pending
+			}
+		}
+	}
+}
+
+// isConfigMapMount reports whether path looks like a file of a Kubernetes
+// ConfigMap or Secret volume, which keeps its data behind a ..data symlink.
+func isConfigMapMount(path string) bool {
+	info, err := os.Lstat(filepath.Join(filepath.Dir(path), "..data"))
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}